@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// defaultRedirectURI is the redirect URI to give the Spotify app in the
+	// developer dashboard, unless you've set -redirect-uri.
+	defaultRedirectURI = "http://localhost:8080/callback"
+
+	// callbackShutdownTimeout is how long we give the callback server to
+	// finish responding to the browser once we're done with it.
+	callbackShutdownTimeout = 5 * time.Second
+)
+
+var (
+	// errNoCacheDir means there is nowhere to keep the oauth2 token.
+	errNoCacheDir = errors.New("failed to find the cache dir for the oauth2 token")
+	// errNotLoggedIn means there is no cached oauth2 token.
+	errNotLoggedIn = errors.New("not logged in")
+	// errLoginTimedOut means the user didn't finish logging in in time.
+	errLoginTimedOut = errors.New("timed out waiting for the login to complete")
+)
+
+// authError is an error from some step of getting a Spotify client, which
+// step says.
+type authError struct {
+	step string
+	err  error
+}
+
+func (e *authError) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.step, e.err)
+}
+
+func (e *authError) Unwrap() error {
+	return e.err
+}
+
+// getSpotifyClient returns a client using the cached token, going through the
+// login flow first if there isn't one.
+func (cfg *config) getSpotifyClient() (*SpotifyClient, error) {
+	client, err := cfg.getCachedSpotifyClient()
+	if errors.Is(err, errNotLoggedIn) {
+		client, err = cfg.getFreshSpotifyClient()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSpotifyClient(client, maxTries, retryDelay), nil
+}
+
+func (cfg *config) getCachedSpotifyClient() (*http.Client, error) {
+	token, err := cfg.tokens.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO: Should we be using token.Valid() to determine if we should actually
+	// re-cache?
+	return cfg.newClient(token), nil
+}
+
+// newClient makes an HTTP client that uses token, like cfg.auth.NewClient
+// does, except that its requests show up in the metrics.
+func (cfg *config) newClient(token *oauth2.Token) *http.Client {
+	conf := &oauth2.Config{
+		ClientID:     cfg.spotifyClientID,
+		ClientSecret: cfg.spotifyClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  spotify.AuthURL,
+			TokenURL: spotify.TokenURL,
+		},
+	}
+
+	// Like zmb3/spotify, we stick to HTTP/1.1, see
+	// https://github.com/zmb3/spotify/issues/20.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	httpClient := &http.Client{Transport: &metricsTransport{base: transport}}
+
+	// The token refreshes go through httpClient too.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+
+	return conf.Client(ctx, token)
+}
+
+// getFreshSpotifyClient has the user log in to Spotify in their browser, and
+// stores the token it gets out of it. The user has cfg.loginTimeout to do so.
+func (cfg *config) getFreshSpotifyClient() (*http.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.loginTimeout)
+	defer cancel()
+
+	// A fresh state for every login means a callback can't be replayed from
+	// an earlier one.
+	state, err := newLoginState()
+	if err != nil {
+		return nil, err
+	}
+
+	redirectURL, err := url.Parse(cfg.redirectURI)
+	if err != nil {
+		return nil, &authError{"parse the redirect URI", err}
+	}
+
+	tokens := make(chan *oauth2.Token, 1)
+	stop, err := startCallbackServer(cfg.callbackAddr, callbackPath(redirectURL), callbackHandler(cfg.auth, state, tokens))
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	authURL := cfg.auth.AuthURL(state)
+	fmt.Println("Please log in to Spotify by visiting the following page in your browser:", authURL)
+
+	// Wait for the auth flow to complete.
+	var token *oauth2.Token
+	select {
+	case token = <-tokens:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w after %v", errLoginTimedOut, cfg.loginTimeout)
+	}
+	httpClient := cfg.newClient(token)
+	client := spotify.NewClient(httpClient)
+
+	user, err := client.CurrentUser()
+	if err != nil {
+		return nil, &authError{"get the current user", err}
+	}
+	fmt.Println("You are logged in as:", user.ID)
+
+	token, err = client.Token()
+	if err != nil {
+		return nil, &authError{"retrieve the token from the client for saving", err}
+	}
+
+	if err := cfg.tokens.save(token); err != nil {
+		return nil, err
+	}
+
+	return httpClient, nil
+}
+
+// newLoginState returns a random value for the OAuth state parameter.
+func newLoginState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", &authError{"generate the login state", err}
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// getCallbackAddr returns the address to host the login callback on. Unless
+// one is given, it's the loopback address on the redirect URI's port, since
+// the only one who should be calling it is the user's own browser.
+func getCallbackAddr(redirectURI, callbackAddr string) (string, error) {
+	redirectURL, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", fmt.Errorf("-redirect-uri must be a URL: %w", err)
+	}
+	if redirectURL.Scheme != "http" && redirectURL.Scheme != "https" {
+		return "", fmt.Errorf("-redirect-uri must be an http or https URL, not %q", redirectURI)
+	}
+
+	if callbackAddr != "" {
+		if _, _, err := net.SplitHostPort(callbackAddr); err != nil {
+			return "", fmt.Errorf("-callback-addr must be a host:port: %w", err)
+		}
+		return callbackAddr, nil
+	}
+
+	port := redirectURL.Port()
+	switch {
+	case port != "":
+	case redirectURL.Scheme == "http":
+		port = "80"
+	default:
+		// We only speak plain HTTP, so something else must be terminating
+		// TLS in front of us, and we can't guess where it forwards to.
+		return "", errors.New("-callback-addr is required for an https -redirect-uri")
+	}
+
+	return net.JoinHostPort("127.0.0.1", port), nil
+}
+
+// callbackPath is the path the login callback is hosted on.
+func callbackPath(redirectURL *url.URL) string {
+	if redirectURL.Path == "" {
+		return "/"
+	}
+
+	return redirectURL.Path
+}
+
+// startCallbackServer starts an HTTP server on addr that handles the
+// callback URI's path, so that we can know when the OAuth flow has
+// completed. The returned function shuts the server down again.
+//
+// This and surrounding code is taken from the relevant examples from the
+// zmb3/spotify repository.
+func startCallbackServer(addr, path string, handler http.Handler) (func(), error) {
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+
+	// Listening up front means we find out right away if the port is taken,
+	// rather than leaving the user with a login page that goes nowhere.
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, &authError{"listen for the login callback", err}
+	}
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), callbackShutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+// callbackHandler handles the redirect back from Spotify's login page. Stray
+// or failed callbacks don't end the login, since the user can just try again
+// until they get it right (or the login times out). The token is sent to
+// tokens.
+func callbackHandler(auth spotify.Authenticator, state string, tokens chan<- *oauth2.Token) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// auth.Token checks the state too, but this way we can tell the user
+		// what went wrong.
+		if st := r.FormValue("state"); st != state {
+			slog.Warn("Ignoring login callback with mismatched state", logKeyPhase, phaseAuth)
+			http.Error(w, "State mismatch, please try logging in again.", http.StatusBadRequest)
+			return
+		}
+
+		tok, err := auth.Token(state, r)
+		if err != nil {
+			slog.Warn("Failed to get the token from the login callback", logKeyPhase, phaseAuth, logKeyError, err)
+			http.Error(w, "Couldn't get token, please try logging in again.", http.StatusForbidden)
+			return
+		}
+
+		select {
+		case tokens <- tok:
+			fmt.Fprintf(w, "Login to fangirl completed!")
+		default:
+			// Someone beat this request to it.
+			fmt.Fprintf(w, "Already logged in to fangirl.")
+		}
+	}
+}
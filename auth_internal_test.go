@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
+)
+
+func TestCallbackHandlerIgnoresBadCallbacks(t *testing.T) {
+	const state = "abc123"
+	tokens := make(chan *oauth2.Token, 1)
+	handler := callbackHandler(spotify.NewAuthenticator(defaultRedirectURI), state, tokens)
+
+	testCases := []struct {
+		url    string
+		status int
+	}{
+		// Someone else's login, or a stale tab.
+		{"/callback?state=nope&code=abc", http.StatusBadRequest},
+		// The user declined to log in.
+		{fmt.Sprintf("/callback?state=%s&error=access_denied", state), http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		assert.Equal(t, tc.status, rec.Code, tc.url)
+	}
+
+	// Neither should have ended the login.
+	assert.Empty(t, tokens)
+}
+
+func TestGetCallbackAddr(t *testing.T) {
+	testCases := []struct {
+		redirectURI  string
+		callbackAddr string
+		expected     string
+		err          bool
+	}{
+		{defaultRedirectURI, "", "127.0.0.1:8080", false},
+		{"http://127.0.0.1:9999/fangirl/callback", "", "127.0.0.1:9999", false},
+		{"http://fangirl.home/callback", "", "127.0.0.1:80", false},
+		{"https://fangirl.example.com/callback", "0.0.0.0:8080", "0.0.0.0:8080", false},
+		{"https://fangirl.example.com/callback", "", "", true},
+		{defaultRedirectURI, "8080", "", true},
+		{"localhost:8080/callback", "", "", true},
+	}
+
+	for _, tc := range testCases {
+		addr, err := getCallbackAddr(tc.redirectURI, tc.callbackAddr)
+		if tc.err {
+			assert.Error(t, err, tc.redirectURI)
+			continue
+		}
+		assert.NoError(t, err, tc.redirectURI)
+		assert.Equal(t, tc.expected, addr, tc.redirectURI)
+	}
+}
+
+func TestNewLoginState(t *testing.T) {
+	a, err := newLoginState()
+	assert.NoError(t, err)
+	b, err := newLoginState()
+	assert.NoError(t, err)
+	assert.Len(t, a, 32)
+	assert.NotEqual(t, a, b)
+}
+
+func TestAuthError(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &authError{"listen for the login callback", errNoCacheDir})
+	assert.EqualError(t, err, "wrapped: failed to listen for the login callback: failed to find the cache dir for the oauth2 token")
+	assert.True(t, errors.Is(err, errNoCacheDir))
+
+	var authErr *authError
+	assert.True(t, errors.As(err, &authErr))
+	assert.Equal(t, "listen for the login callback", authErr.step)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// command is one of fangirl's subcommands.
+type command struct {
+	name        string
+	description string
+	// needsClient is whether the command talks to Spotify, which means
+	// logging in first if the user hasn't already.
+	needsClient bool
+	run         func(cfg *config, client *SpotifyClient, args []string, start time.Time)
+}
+
+// needsCredentials is whether the command needs the Spotify app's client ID
+// and secret, which is only the case for those that log in.
+func (cmd command) needsCredentials() bool {
+	return cmd.needsClient || cmd.name == "login"
+}
+
+// defaultCommand is the command that is run when none is given.
+const defaultCommand = "run"
+
+var commands = []command{
+	{"run", "create a playlist of recent releases (the default)", true, noArgs(runPlaylist)},
+	{"preview", "show the playlists run would create, without creating them", true, noArgs(runPreview)},
+	{"export", "write the recent releases to stdout, in -export-format", true, noArgs(runExport)},
+	{"prune", "remove the tracks you've gotten to from a playlist fangirl created", true, noArgs(runPrune)},
+	{"history", "record your recently played tracks", true, noArgs(runSyncHistory)},
+	{"serve", "keep a single playlist up to date with recent releases", true, noArgs(runServe)},
+	{"login", "log in to Spotify, even if already logged in", false, noArgs(runLogin)},
+	{"logout", "forget the cached Spotify token", false, noArgs(runLogout)},
+	{"token", "'token migrate <storage>' moves the Spotify token from that storage to -token-storage", false, runToken},
+	{"status", "show whether you're logged in, and how the last runs went", false, noArgs(runStatus)},
+	{"config", "'config validate' checks the flags and config file, and shows the result", false, runConfig},
+}
+
+// commandAliases are the old names of commands, which still work so that
+// existing cronjobs don't break.
+var commandAliases = map[string]string{
+	"sync-history": "history",
+}
+
+func findCommand(name string) (command, bool) {
+	if alias, ok := commandAliases[name]; ok {
+		name = alias
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+
+	return command{}, false
+}
+
+// splitCommand splits the command off the front of args, if it's there.
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+
+	return "", args
+}
+
+// noArgs adapts a command that doesn't take any arguments, besides the flags.
+func noArgs(run func(cfg *config, client *SpotifyClient, start time.Time)) func(*config, *SpotifyClient, []string, time.Time) {
+	return func(cfg *config, client *SpotifyClient, args []string, start time.Time) {
+		if len(args) != 0 {
+			fatal("Unexpected arguments", "args", args)
+		}
+		run(cfg, client, start)
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: fangirl [command] [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func runLogin(cfg *config, _ *SpotifyClient, _ time.Time) {
+	if _, err := cfg.getFreshSpotifyClient(); err != nil {
+		fatal("Failed to log in", logKeyPhase, phaseAuth, logKeyError, err)
+	}
+}
+
+func runLogout(cfg *config, _ *SpotifyClient, _ time.Time) {
+	if err := cfg.tokens.clear(); errors.Is(err, errNotLoggedIn) {
+		fmt.Println("You are not logged in.")
+		return
+	} else if err != nil {
+		fatal("Failed to delete the token", logKeyPhase, phaseAuth, logKeyError, err)
+	}
+
+	fmt.Println("You are logged out.")
+}
+
+func runToken(cfg *config, _ *SpotifyClient, args []string, _ time.Time) {
+	if len(args) != 2 || args[0] != "migrate" {
+		fatal("Unknown token command, expected e.g. 'token migrate file'", "args", args)
+	}
+
+	fromStorage, err := parseTokenStorage(args[1])
+	if err != nil {
+		fatal("Failed to parse the token storage to migrate from", logKeyPhase, phaseAuth, logKeyError, err)
+	}
+	if err := checkTokenMigration(fromStorage, cfg.tokenStorage); err != nil {
+		fatal("Can't migrate the token", logKeyPhase, phaseAuth, logKeyError, err)
+	}
+
+	from, err := newTokenStore(fromStorage, cfg.tokenPassphrase)
+	if err != nil {
+		fatal("Failed to open the token storage to migrate from", logKeyPhase, phaseAuth, logKeyError, err)
+	}
+
+	if err := migrateToken(from, cfg.tokens); errors.Is(err, errNotLoggedIn) {
+		fmt.Printf("There is no token in %s storage to migrate.\n", fromStorage)
+		return
+	} else if err != nil {
+		fatal("Failed to migrate the token", logKeyPhase, phaseAuth, logKeyError, err)
+	}
+
+	fmt.Printf("Migrated the token from %s to %s storage.\n", fromStorage, cfg.tokenStorage)
+}
+
+func runStatus(cfg *config, _ *SpotifyClient, _ time.Time) {
+	token, err := cfg.tokens.load()
+	switch {
+	case errors.Is(err, errNotLoggedIn):
+		fmt.Printf("Token:      not logged in (%s storage), run 'fangirl login'\n", cfg.tokenStorage)
+	case err != nil:
+		fmt.Printf("Token:      unreadable from %s storage (%v)\n", cfg.tokenStorage, err)
+	case token.RefreshToken != "":
+		fmt.Printf("Token:      logged in (%s storage), access token expires %s, refreshable\n", cfg.tokenStorage, token.Expiry.Format(time.RFC3339))
+	default:
+		fmt.Printf("Token:      logged in (%s storage), expires %s\n", cfg.tokenStorage, token.Expiry.Format(time.RFC3339))
+	}
+
+	st, err := loadState()
+	if err != nil {
+		fatal("Failed to load the state", logKeyError, err)
+	}
+
+	if n := len(st.ManagedPlaylists); n != 0 {
+		latest := st.ManagedPlaylists[n-1]
+		fmt.Printf("Playlists:  %d created, the latest being %q (%s)\n", n, latest.Name, playlistURL(latest.ID))
+	} else {
+		fmt.Println("Playlists:  none created yet")
+	}
+	if !st.HistorySyncedAt.IsZero() {
+		fmt.Printf("History:    %d played tracks, up to %s\n", len(st.PlayedTracks), st.HistorySyncedAt.Format(time.RFC3339))
+	}
+	if !st.Serve.LastRunAt.IsZero() {
+		fmt.Printf("Serve:      last ran %s, next run %s\n", st.Serve.LastRunAt.Format(time.RFC3339), st.Serve.NextRunAt.Format(time.RFC3339))
+	}
+
+	report, path, err := latestRunReport()
+	switch {
+	case err != nil:
+		fmt.Printf("Last run:   unknown (%v)\n", err)
+	case report == nil:
+		fmt.Println("Last run:   none yet")
+	case report.Succeeded:
+		fmt.Printf("Last run:   %s succeeded at %s, see %s\n", report.Command, report.FinishedAt.Format(time.RFC3339), path)
+	default:
+		fmt.Printf("Last run:   %s failed at %s (%s), see %s\n", report.Command, report.FinishedAt.Format(time.RFC3339), report.Error, path)
+	}
+}
+
+func runPreview(cfg *config, client *SpotifyClient, start time.Time) {
+	startReport("preview", cfg, client, start)
+
+	st, err := loadState()
+	if err != nil {
+		fatal("Failed to load the state", logKeyError, err)
+	}
+
+	// A preview shouldn't change anything, including the state.
+	cfg.recordHistory = false
+	data, err := collectReleases(cfg, client, st, cfg.window(start))
+	if err != nil {
+		fatal("Failed to collect the releases", logKeyError, err)
+	}
+
+	_, plans, err := planPlaylists(client, cfg, data, start)
+	if err != nil {
+		fatal("Failed to plan the playlists", logKeyError, err)
+	}
+
+	for _, plan := range plans {
+		fmt.Printf("%s (%d releases, %d tracks)\n", plan.name, len(plan.albums), len(plan.trackIDs))
+		for _, album := range orderAlbums(plan.albums, cfg.order, data.albumPopularity) {
+			release := newDigestRelease(album)
+			fmt.Printf("  %s - %s (%s, %s)\n", release.Artist, release.Album, release.Type, release.ReleaseDate)
+		}
+		for _, dup := range plan.duplicates {
+			for _, dropped := range dup.dropped {
+				fmt.Printf("  Collapsed %q from %s into the one from %s\n", dup.kept.track.Name, dropped.album.Name, dup.kept.album.Name)
+			}
+		}
+	}
+
+	if len(data.upcomingAlbums) != 0 {
+		fmt.Printf("Upcoming (%d releases)\n", len(data.upcomingAlbums))
+		for _, album := range orderAlbums(data.upcomingAlbums, orderOldest, nil) {
+			release := newDigestRelease(album)
+			fmt.Printf("  %s - %s (%s, %s)\n", release.Artist, release.Album, release.Type, release.ReleaseDate)
+		}
+	}
+
+	finishReport(nil)
+}
+
+func runExport(cfg *config, client *SpotifyClient, start time.Time) {
+	startReport("export", cfg, client, start)
+
+	st, err := loadState()
+	if err != nil {
+		fatal("Failed to load the state", logKeyError, err)
+	}
+
+	// Like preview, exporting shouldn't change anything.
+	cfg.recordHistory = false
+	data, err := collectReleases(cfg, client, st, cfg.window(start))
+	if err != nil {
+		fatal("Failed to collect the releases", logKeyError, err)
+	}
+
+	if err := writeExport(os.Stdout, cfg.exportFormat, orderAlbums(data.albums, cfg.order, data.albumPopularity)); err != nil {
+		fatal("Failed to export the releases", logKeyError, err)
+	}
+
+	finishReport(nil)
+}
+
+func runConfig(cfg *config, _ *SpotifyClient, args []string, _ time.Time) {
+	if len(args) != 1 || args[0] != "validate" {
+		fatal("Unknown config command, expected 'config validate'", "args", args)
+	}
+
+	// getConfig has already done all the validating by now.
+	fmt.Println("The configuration is valid:")
+	fmt.Println(cfg.String())
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCommand(t *testing.T) {
+	name, args := splitCommand([]string{"serve", "-playlist", "releases"})
+	assert.Equal(t, "serve", name)
+	assert.Equal(t, []string{"-playlist", "releases"}, args)
+
+	name, args = splitCommand([]string{"-playlist", "releases", "serve"})
+	assert.Equal(t, "", name)
+	assert.Equal(t, []string{"-playlist", "releases", "serve"}, args)
+
+	name, args = splitCommand(nil)
+	assert.Equal(t, "", name)
+	assert.Empty(t, args)
+}
+
+func TestFindCommand(t *testing.T) {
+	cmd, ok := findCommand("prune")
+	assert.True(t, ok)
+	assert.Equal(t, "prune", cmd.name)
+
+	cmd, ok = findCommand("sync-history")
+	assert.True(t, ok)
+	assert.Equal(t, "history", cmd.name)
+
+	_, ok = findCommand("bogus")
+	assert.False(t, ok)
+}
+
+func TestCommandNeedsCredentials(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected bool
+	}{
+		{"run", true},
+		{"history", true},
+		{"login", true},
+		{"logout", false},
+		{"status", false},
+		{"token", false},
+		{"config", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, ok := findCommand(tc.name)
+			assert.True(t, ok)
+			assert.Equal(t, tc.expected, cmd.needsCredentials())
+		})
+	}
+}
@@ -1,29 +1,85 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"net/http"
+	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/zmb3/spotify"
-	"golang.org/x/oauth2"
 )
 
 type config struct {
-	duration           time.Duration
-	playlistName       string
-	blacklistedArtists map[string]struct{}
-
+	duration            time.Duration
+	since               time.Time
+	until               time.Time
+	playlistName        string
+	blacklistedArtists  map[string]struct{}
+	dedupTracks         bool
+	dedupPreference     dedupPreference
+	skipLikedTracks     bool
+	recordHistory       bool
+	playedThreshold     float64
+	prunePlaylistID     spotify.ID
+	serveInterval       time.Duration
+	serveJitter         time.Duration
+	order               playlistOrder
+	splitMode           splitMode
+	splitNames          bucketTemplates
+	splitNameTemplates  map[string]*template.Template
+	artistBuckets       map[string]string
+	nameTemplate        *template.Template
+	descriptionTemplate *template.Template
+	coverMode           coverMode
+	coverBytes          []byte
+	public              bool
+	collaborative       bool
+	webhookURLs         []string
+	webhookFormat       webhookFormat
+	digestTemplate      *template.Template
+	emailTo             []string
+	emailFrom           string
+	smtpServer          string
+	smtpUsername        string
+	smtpPassword        string
+	smtpStartTLS        bool
+	includeUpcoming     bool
+	precisionPolicy     precisionPolicy
+	icsPath             string
+	feedPath            string
+	feedAddr            string
+	metricsFile         string
+	metricsAddr         string
+	logLevel            slog.Level
+	logFormat           logFormat
+	progressMode        progressMode
+	exportFormat        exportFormat
+	loginTimeout        time.Duration
+	redirectURI         string
+	callbackAddr        string
+	tokenStorage        tokenStorage
+	tokenPassphraseFile string
+	tokenPassphrase     string
+	tokens              tokenStore
+
+	// clientIDSources and clientSecretSources are where the Spotify app's
+	// credentials may come from. They're only looked at by
+	// resolveCredentials, since running -client-secret-command is no good
+	// for commands that never talk to Spotify.
+	clientIDSources     []credentialSource
+	clientSecretSources []credentialSource
 	spotifyClientID     string
 	spotifyClientSecret string
+	// clientSecretSource is where spotifyClientSecret came from, so that we
+	// can say without showing the secret itself.
+	clientSecretSource string
 
 	auth spotify.Authenticator
 }
@@ -34,21 +90,67 @@ func (cfg *config) String() string {
 	// Yeah, this is kind of ugly. I don't care.
 	sb.WriteString("{")
 	sb.WriteString(fmt.Sprintf("duration: %v, ", cfg.duration))
+	sb.WriteString(fmt.Sprintf("since: %v, ", cfg.since))
+	sb.WriteString(fmt.Sprintf("until: %v, ", cfg.until))
 	sb.WriteString(fmt.Sprintf("playlistName: %q, ", cfg.playlistName))
 	blacklistedArtistsLst := make([]string, 0, len(cfg.blacklistedArtists))
 	for artistName := range cfg.blacklistedArtists {
 		blacklistedArtistsLst = append(blacklistedArtistsLst, artistName)
 	}
-	sb.WriteString(fmt.Sprintf("blacklistedArtists: [%s]", strings.Join(blacklistedArtistsLst, ", ")))
+	sb.WriteString(fmt.Sprintf("blacklistedArtists: [%s], ", strings.Join(blacklistedArtistsLst, ", ")))
+	sb.WriteString(fmt.Sprintf("dedupTracks: %t, ", cfg.dedupTracks))
+	sb.WriteString(fmt.Sprintf("dedupPreference: %q, ", cfg.dedupPreference))
+	sb.WriteString(fmt.Sprintf("skipLikedTracks: %t, ", cfg.skipLikedTracks))
+	sb.WriteString(fmt.Sprintf("recordHistory: %t, ", cfg.recordHistory))
+	sb.WriteString(fmt.Sprintf("playedThreshold: %v, ", cfg.playedThreshold))
+	sb.WriteString(fmt.Sprintf("prunePlaylistID: %q, ", cfg.prunePlaylistID))
+	sb.WriteString(fmt.Sprintf("serveInterval: %v, ", cfg.serveInterval))
+	sb.WriteString(fmt.Sprintf("serveJitter: %v, ", cfg.serveJitter))
+	sb.WriteString(fmt.Sprintf("order: %q, ", cfg.order))
+	sb.WriteString(fmt.Sprintf("splitMode: %q, ", cfg.splitMode))
+	sb.WriteString(fmt.Sprintf("splitNames: [%s], ", cfg.splitNames.String()))
+	sb.WriteString(fmt.Sprintf("artistBuckets: %d, ", len(cfg.artistBuckets)))
+	sb.WriteString(fmt.Sprintf("nameTemplate: %q, ", cfg.nameTemplate.Root.String()))
+	sb.WriteString(fmt.Sprintf("descriptionTemplate: %q, ", cfg.descriptionTemplate.Root.String()))
+	sb.WriteString(fmt.Sprintf("coverMode: %q, ", cfg.coverMode))
+	sb.WriteString(fmt.Sprintf("public: %t, ", cfg.public))
+	sb.WriteString(fmt.Sprintf("collaborative: %t, ", cfg.collaborative))
+	// Webhook URLs tend to have secrets in them, so don't print them.
+	sb.WriteString(fmt.Sprintf("webhooks: %d, ", len(cfg.webhookURLs)))
+	sb.WriteString(fmt.Sprintf("webhookFormat: %q, ", cfg.webhookFormat))
+	sb.WriteString(fmt.Sprintf("emailTo: [%s], ", strings.Join(cfg.emailTo, ", ")))
+	sb.WriteString(fmt.Sprintf("emailFrom: %q, ", cfg.emailFrom))
+	sb.WriteString(fmt.Sprintf("smtpServer: %q, ", cfg.smtpServer))
+	sb.WriteString(fmt.Sprintf("smtpUsername: %q, ", cfg.smtpUsername))
+	sb.WriteString(fmt.Sprintf("smtpStartTLS: %t, ", cfg.smtpStartTLS))
+	sb.WriteString(fmt.Sprintf("includeUpcoming: %t, ", cfg.includeUpcoming))
+	sb.WriteString(fmt.Sprintf("precisionPolicy: %q, ", cfg.precisionPolicy))
+	sb.WriteString(fmt.Sprintf("icsPath: %q, ", cfg.icsPath))
+	sb.WriteString(fmt.Sprintf("feedPath: %q, ", cfg.feedPath))
+	sb.WriteString(fmt.Sprintf("feedAddr: %q, ", cfg.feedAddr))
+	sb.WriteString(fmt.Sprintf("metricsFile: %q, ", cfg.metricsFile))
+	sb.WriteString(fmt.Sprintf("metricsAddr: %q, ", cfg.metricsAddr))
+	sb.WriteString(fmt.Sprintf("logLevel: %q, ", cfg.logLevel))
+	sb.WriteString(fmt.Sprintf("logFormat: %q, ", cfg.logFormat))
+	sb.WriteString(fmt.Sprintf("progressMode: %q, ", cfg.progressMode))
+	sb.WriteString(fmt.Sprintf("exportFormat: %q, ", cfg.exportFormat))
+	sb.WriteString(fmt.Sprintf("loginTimeout: %v, ", cfg.loginTimeout))
+	sb.WriteString(fmt.Sprintf("redirectURI: %q, ", cfg.redirectURI))
+	sb.WriteString(fmt.Sprintf("callbackAddr: %q, ", cfg.callbackAddr))
+	sb.WriteString(fmt.Sprintf("tokenStorage: %q, ", cfg.tokenStorage))
+	sb.WriteString(fmt.Sprintf("tokenPassphraseFile: %q, ", cfg.tokenPassphraseFile))
+	sb.WriteString(fmt.Sprintf("spotifyClientID: %q, ", cfg.spotifyClientID))
+	if cfg.clientSecretSource != "" {
+		sb.WriteString(fmt.Sprintf("spotifyClientSecret: <redacted, from %s>", cfg.clientSecretSource))
+	} else {
+		sb.WriteString("spotifyClientSecret: <not resolved>")
+	}
 	sb.WriteString("}")
 
 	return sb.String()
 }
 
 const (
-	redirectURI = "http://localhost:8080/callback"
-	state       = "fangirl"
-
 	// Together, maxTries and retryDelay gives us a total wait time of
 	// around 30 minutes. Sounds crazy, but this is a thing that runs in
 	// a cronjob once a month and it really sucks if it fails the one
@@ -60,7 +162,7 @@ const (
 	retryDelay = 30 * time.Second
 )
 
-func getTokenPath() (string, bool) {
+func getCacheDir() (string, bool) {
 	cacheDir, err := os.UserCacheDir()
 	if err != nil {
 		// Better to not just error here, since we can technically still function.
@@ -75,168 +177,529 @@ func getTokenPath() (string, bool) {
 		}
 	}
 
-	return filepath.Join(fangirlCacheDir, "token.txt"), true
+	return fangirlCacheDir, true
 }
 
-func (cfg *config) getSpotifyClient() (*SpotifyClient, error) {
-	if cfg.cacheExists() {
-		client, err := cfg.getCachedSpotifyClient()
-		if err != nil {
-			return nil, err
-		}
-		return NewSpotifyClient(client, maxTries, retryDelay), err
-	}
+// Obviously there is no constant value that can express the length of a month,
+// but we assume every month is 31 days. It really doesn'tt matter.
+const monthDuration = time.Hour * 24 * 31
 
-	client, err := cfg.getFreshSpotifyClient()
-	if err != nil {
-		return nil, err
-	}
+// getConfig reads the configuration from the flags in args, falling back to the
+// config file for any flags that aren't given.
+func getConfig(args []string) (*config, error) {
+	var configPath string
+	flag.StringVar(
+		&configPath,
+		"config",
+		"",
+		"a path to a config file of 'flag = value' lines, for flags not given on the command line; defaults to fangirl/config in the user config directory, if it exists",
+	)
 
-	return NewSpotifyClient(client, maxTries, retryDelay), err
-}
+	var playlistName string
+	flag.StringVar(
+		&playlistName,
+		"playlist",
+		"",
+		"the name for the playlist containing recent releases",
+	)
 
-func (cfg *config) cacheExists() bool {
-	cacheDir, ok := getTokenPath()
-	if !ok {
-		log.Panicln("failed to find a cache directory for saving the oauth2 token")
-		return false
-	}
+	durationPtr := flag.Duration(
+		"duration",
+		monthDuration,
+		"the duration to consider 'recent'; defaults to 1 month",
+	)
 
-	_, err := os.Stat(cacheDir)
+	var sinceStr string
+	flag.StringVar(
+		&sinceStr,
+		"since",
+		"",
+		"only consider releases from the start of this date onwards, overriding -duration; e.g. 2024-07-01, 2024-07, 2024-Q3, 2024 or last-month",
+	)
 
-	return !os.IsNotExist(err)
-}
+	var untilStr string
+	flag.StringVar(
+		&untilStr,
+		"until",
+		"",
+		"only consider releases up to the end of this date; takes the same dates as -since",
+	)
 
-func (cfg *config) getCachedSpotifyClient() (*spotify.Client, error) {
-	cacheDir, ok := getTokenPath()
-	if !ok {
-		return nil, errors.New("failed to find the cache dir for the oauth2 token")
-	}
+	var blacklistFile string
+	flag.StringVar(
+		&blacklistFile,
+		"blacklist",
+		"",
+		"a path to a blacklist file containing artists to skip",
+	)
 
-	tokenBytes, err := ioutil.ReadFile(cacheDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read the token file: %w", err)
-	}
+	dedupTracksPtr := flag.Bool(
+		"dedup",
+		true,
+		"whether to collapse tracks that appear on more than one release (e.g. a single and its album)",
+	)
 
-	token := oauth2.Token{}
-	if err := json.Unmarshal(tokenBytes, &token); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal the token bytes: %w", err)
-	}
+	dedupPreferenceStr := flag.String(
+		"dedup-prefer",
+		string(preferComplete),
+		"which release to keep a duplicated track from; one of 'complete' (most tracks) or 'recent' (newest release)",
+	)
 
-	// TODO: Should we be using token.Valid() to determine if we should actually
-	// re-cache?
-	client := cfg.auth.NewClient(&token)
+	skipLikedTracksPtr := flag.Bool(
+		"skip-liked",
+		true,
+		"whether to skip tracks that are already in your Liked Songs",
+	)
 
-	return &client, nil
-}
+	recordHistoryPtr := flag.Bool(
+		"record-history",
+		false,
+		"whether to record your recently played tracks on this run (see the history command)",
+	)
 
-func (cfg *config) getFreshSpotifyClient() (*spotify.Client, error) {
-	var clientChan = make(chan *spotify.Client)
+	playedThresholdPtr := flag.Float64(
+		"played-threshold",
+		0,
+		"skip releases where at least this fraction (0 to 1) of tracks are in the recorded history; 0 disables this",
+	)
 
-	cfg.startHTTPServer(cfg.auth, clientChan)
+	prunePlaylistIDPtr := flag.String(
+		"prune-playlist",
+		"",
+		"the ID of the playlist to prune with the prune command; defaults to the most recent one fangirl created",
+	)
 
-	url := cfg.auth.AuthURL(state)
-	fmt.Println("Please log in to Spotify by visiting the following page in your browser:", url)
+	serveIntervalPtr := flag.Duration(
+		"interval",
+		24*time.Hour,
+		"how often the serve command updates the rolling playlist",
+	)
 
-	// Wait for the auth flow to complete.
-	client := <-clientChan
+	serveJitterPtr := flag.Duration(
+		"jitter",
+		15*time.Minute,
+		"the maximum random delay added to each of the serve command's runs",
+	)
 
-	user, err := client.CurrentUser()
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println("You are logged in as:", user.ID)
+	orderStr := flag.String(
+		"order",
+		string(orderNewest),
+		"the order of releases in the playlist; one of newest, oldest, artist, type, popularity or interleave",
+	)
 
-	token, err := client.Token()
-	if err != nil {
-		return client, fmt.Errorf("failed to retrieve token from the client for saving: %w", err)
-	}
+	splitModeStr := flag.String(
+		"split",
+		string(splitNone),
+		"how to split releases into multiple playlists; one of none, type, genre or mapping",
+	)
 
-	cfg.saveToken(token)
+	var mappingFile string
+	flag.StringVar(
+		&mappingFile,
+		"split-mapping",
+		"",
+		"a path to a file of 'Artist Name = bucket' lines, for -split mapping",
+	)
 
-	return client, nil
-}
+	splitNames := bucketTemplates{}
+	flag.Var(
+		&splitNames,
+		"split-name",
+		"a bucket=template pair overriding -name-template for a bucket when splitting; may be repeated",
+	)
 
-func (cfg *config) saveToken(token *oauth2.Token) error {
-	tokenBytes, err := json.Marshal(token)
-	if err != nil {
-		return fmt.Errorf("failed to marshal the oauth2 token: %w", err)
-	}
+	nameTemplateStr := flag.String(
+		"name-template",
+		defaultNameTemplate,
+		"a Go template for the playlist name; use '{{.Name}}' to use -playlist as is",
+	)
 
-	cacheDir, ok := getTokenPath()
-	if !ok {
-		return errors.New("failed to find the cache dir for the oauth2 token")
-	}
+	descriptionTemplateStr := flag.String(
+		"description-template",
+		defaultDescriptionTemplate,
+		"a Go template for the playlist description",
+	)
 
-	if err := ioutil.WriteFile(cacheDir, tokenBytes, 0600); err != nil {
-		return fmt.Errorf("failed to write the token file: %w", err)
-	}
+	coverModeStr := flag.String(
+		"cover",
+		string(coverNone),
+		"the cover image for playlists; one of none, grid (newest artwork), text (date range) or file (see -cover-file)",
+	)
 
-	return nil
-}
+	var coverFilePath string
+	flag.StringVar(
+		&coverFilePath,
+		"cover-file",
+		"",
+		"a path to a JPEG of at most 192KB to use as the cover image, for -cover file",
+	)
 
-// startHTTPServer and surrounding code is taken from the relevant examples
-// from zmb3/spotify repository.
-func (cfg *config) startHTTPServer(auth spotify.Authenticator, clientChan chan *spotify.Client) {
-	// Start an HTTP server on our callback URI, so that we can know when the
-	// OAuth flow has completed.
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		tok, err := auth.Token(state, r)
-		if err != nil {
-			http.Error(w, "Couldn't get token", http.StatusForbidden)
-			log.Fatal(err)
-		}
+	publicPtr := flag.Bool(
+		"public",
+		false,
+		"whether fangirl's playlists should be public",
+	)
 
-		if st := r.FormValue("state"); st != state {
-			http.NotFound(w, r)
-			log.Fatalf("State mismatch: %s != %s\n", st, state)
-		}
+	collaborativePtr := flag.Bool(
+		"collaborative",
+		false,
+		"whether fangirl's playlists should be collaborative; these can't be public",
+	)
 
-		// Use the token to get an authenticated client
-		client := auth.NewClient(tok)
-		fmt.Fprintf(w, "Login to fangirl completed!")
-		clientChan <- &client
-	})
+	var webhookURLs stringList
+	flag.Var(
+		&webhookURLs,
+		"webhook",
+		"a URL to POST a digest of new releases to; may be repeated",
+	)
 
-	go http.ListenAndServe(":8080", nil)
-}
+	webhookFormatStr := flag.String(
+		"webhook-format",
+		string(webhookGeneric),
+		"the payload format for -webhook; one of generic, slack or discord",
+	)
 
-// Obviously there is no constant value that can express the length of a month,
-// but we assume every month is 31 days. It really doesn'tt matter.
-const monthDuration = time.Hour * 24 * 31
+	var digestTemplateFile string
+	flag.StringVar(
+		&digestTemplateFile,
+		"digest-template",
+		"",
+		"a path to a Go template for the digest message; defaults to a list of releases",
+	)
 
-func getConfig() (*config, error) {
-	var playlistName string
+	var emailTo stringList
+	flag.Var(
+		&emailTo,
+		"email-to",
+		"an address to email a digest of new releases to; may be repeated",
+	)
+
+	var emailFrom string
 	flag.StringVar(
-		&playlistName,
-		"playlist",
+		&emailFrom,
+		"email-from",
 		"",
-		"the name for the playlist containing recent releases",
+		"the address to send the email digest from",
 	)
 
-	durationPtr := flag.Duration(
-		"duration",
-		monthDuration,
-		"the duration to consider 'recent'; defaults to 1 month",
+	var smtpServer string
+	flag.StringVar(
+		&smtpServer,
+		"smtp-server",
+		"",
+		"the host:port of the SMTP server to send the email digest through",
 	)
 
-	var blacklistFile string
+	var smtpUsername string
 	flag.StringVar(
-		&blacklistFile,
-		"blacklist",
+		&smtpUsername,
+		"smtp-username",
 		"",
-		"a path to a blacklist file containing artists to skip",
+		"the username for the SMTP server, if it needs one; the password is read from SMTP_PASSWORD",
+	)
+
+	smtpStartTLSPtr := flag.Bool(
+		"smtp-starttls",
+		true,
+		"whether to require STARTTLS when talking to the SMTP server",
+	)
+
+	includeUpcomingPtr := flag.Bool(
+		"include-upcoming",
+		false,
+		"whether to put releases dated in the future into playlists, rather than listing them separately",
+	)
+
+	precisionPolicyStr := flag.String(
+		"imprecise-dates",
+		string(precisionEnd),
+		"what to do with releases only dated to the month or year that may or may not be recent; one of end (treat as the last day), include or exclude",
+	)
+
+	var icsPath string
+	flag.StringVar(
+		&icsPath,
+		"ics",
+		"",
+		"a path to write an iCalendar file of recent and upcoming release dates to after every run",
+	)
+
+	var feedPath string
+	flag.StringVar(
+		&feedPath,
+		"feed",
+		"",
+		"a path to write an Atom feed of new releases to after every run",
+	)
+
+	var feedAddr string
+	flag.StringVar(
+		&feedAddr,
+		"feed-addr",
+		"",
+		"the host:port the serve command should host the Atom feed on; disabled if empty",
+	)
+
+	var metricsFile string
+	flag.StringVar(
+		&metricsFile,
+		"metrics-file",
+		"",
+		"a path to write Prometheus metrics to after every run, e.g. for the node exporter's textfile collector",
+	)
+
+	var metricsAddr string
+	flag.StringVar(
+		&metricsAddr,
+		"metrics-addr",
+		"",
+		"the host:port the serve command should host Prometheus metrics on at /metrics; disabled if empty",
+	)
+
+	logLevelStr := flag.String(
+		"log-level",
+		"info",
+		"the minimum level of logs to write; one of debug, info, warn or error",
+	)
+
+	logFormatStr := flag.String(
+		"log-format",
+		string(logFormatText),
+		"the format to write logs in; one of text or json",
+	)
+
+	progressModeStr := flag.String(
+		"progress",
+		string(progressAuto),
+		"how to report progress; one of auto (a bar on a terminal, log otherwise), bar, log (a summary every 30s) or none",
+	)
+
+	exportFormatStr := flag.String(
+		"export-format",
+		string(exportJSON),
+		"the format the export command writes releases in; one of json or csv",
+	)
+
+	loginTimeoutPtr := flag.Duration(
+		"login-timeout",
+		5*time.Minute,
+		"how long to wait for you to log in to Spotify in your browser",
+	)
+
+	var redirectURI string
+	flag.StringVar(
+		&redirectURI,
+		"redirect-uri",
+		defaultRedirectURI,
+		"the redirect URI for logging in to Spotify; must match the one set for the app in the Spotify developer dashboard",
+	)
+
+	var callbackAddr string
+	flag.StringVar(
+		&callbackAddr,
+		"callback-addr",
+		"",
+		"the host:port to host the login callback on; defaults to the -redirect-uri's port on 127.0.0.1",
+	)
+
+	tokenStorageStr := flag.String(
+		"token-storage",
+		string(tokenStorageFile),
+		"where to keep the Spotify token between runs; one of file, encrypted-file (with a passphrase from "+tokenPassphraseEnv+" or -token-passphrase-file) or none (log in every time)",
+	)
+
+	var tokenPassphraseFile string
+	flag.StringVar(
+		&tokenPassphraseFile,
+		"token-passphrase-file",
+		"",
+		"a path to a file containing the passphrase for -token-storage encrypted-file; overrides "+tokenPassphraseEnv,
+	)
+
+	var clientID string
+	flag.StringVar(
+		&clientID,
+		"client-id",
+		"",
+		"the Spotify client ID; SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_ID_FILE take precedence",
+	)
+
+	var clientSecret string
+	flag.StringVar(
+		&clientSecret,
+		"client-secret",
+		"",
+		"the Spotify client secret; only accepted in the config file, since other users can see the command line",
+	)
+
+	var clientSecretFile string
+	flag.StringVar(
+		&clientSecretFile,
+		"client-secret-file",
+		"",
+		"a path to a file containing the Spotify client secret",
+	)
+
+	var clientSecretCommand string
+	flag.StringVar(
+		&clientSecretCommand,
+		"client-secret-command",
+		"",
+		"a shell command that prints the Spotify client secret, e.g. from a password manager",
 	)
 
 	// Parse the command line arguments.
-	flag.Parse()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+	// Other users can see the command line of a running process, and shells
+	// keep it in their history, so the secret itself can't go there.
+	var secretOnCommandLine bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "client-secret" {
+			secretOnCommandLine = true
+		}
+	})
+	if secretOnCommandLine {
+		return nil, errors.New(
+			"-client-secret is only accepted in the config file, use SPOTIFY_CLIENT_SECRET, " +
+				"-client-secret-file or -client-secret-command on the command line instead",
+		)
+	}
+	if err := applyConfigFile(configPath); err != nil {
+		return nil, err
+	}
 
 	// If not supplied, default the playlist name to 'fangirl'.
 	if playlistName == "" {
 		playlistName = "fangirl"
 	}
 
-	var err error
+	if *playedThresholdPtr < 0 || *playedThresholdPtr > 1 {
+		return nil, fmt.Errorf("-played-threshold must be between 0 and 1, got %v", *playedThresholdPtr)
+	}
+
+	if *serveIntervalPtr <= 0 {
+		return nil, fmt.Errorf("-interval must be positive, got %v", *serveIntervalPtr)
+	}
+	if *serveJitterPtr < 0 {
+		return nil, fmt.Errorf("-jitter must not be negative, got %v", *serveJitterPtr)
+	}
+
+	since, until, err := parseWindowFlags(sinceStr, untilStr, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	logLevel, err := parseLogLevel(*logLevelStr)
+	if err != nil {
+		return nil, err
+	}
+
+	logFormat, err := parseLogFormat(*logFormatStr)
+	if err != nil {
+		return nil, err
+	}
+
+	progressMode, err := parseProgressMode(*progressModeStr)
+	if err != nil {
+		return nil, err
+	}
+
+	exportFormat, err := parseExportFormat(*exportFormatStr)
+	if err != nil {
+		return nil, err
+	}
+
+	dedupPreference, err := parseDedupPreference(*dedupPreferenceStr)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := parsePlaylistOrder(*orderStr)
+	if err != nil {
+		return nil, err
+	}
+
+	splitMode, err := parseSplitMode(*splitModeStr)
+	if err != nil {
+		return nil, err
+	}
+
+	artistBuckets := map[string]string{}
+	if splitMode == splitMapping {
+		if mappingFile == "" {
+			return nil, errors.New("-split mapping requires a -split-mapping file")
+		}
+		artistBuckets, err = getArtistBuckets(mappingFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the artist buckets: %w", err)
+		}
+	}
+
+	nameTemplate, err := parsePlaylistTemplate("name", *nameTemplateStr)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptionTemplate, err := parsePlaylistTemplate("description", *descriptionTemplateStr)
+	if err != nil {
+		return nil, err
+	}
+
+	splitNameTemplates := make(map[string]*template.Template, len(splitNames))
+	for key, text := range splitNames {
+		splitNameTemplates[key], err = parsePlaylistTemplate(fmt.Sprintf("%s bucket name", key), text)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// This is a restriction on Spotify's end.
+	if *publicPtr && *collaborativePtr {
+		return nil, errors.New("playlists can't be both -public and -collaborative")
+	}
+
+	coverMode, err := parseCoverMode(*coverModeStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var coverBytes []byte
+	if coverMode == coverFile {
+		if coverFilePath == "" {
+			return nil, errors.New("-cover file requires a -cover-file")
+		}
+		coverBytes, err = readCoverFile(coverFilePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	precisionPolicy, err := parsePrecisionPolicy(*precisionPolicyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	webhookFormat, err := parseWebhookFormat(*webhookFormatStr)
+	if err != nil {
+		return nil, err
+	}
+
+	digestTemplate, err := getDigestTemplate(digestTemplateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(emailTo) != 0 && (smtpServer == "" || emailFrom == "") {
+		return nil, errors.New("-email-to requires an -smtp-server and -email-from")
+	}
+	if smtpServer != "" {
+		if _, _, err := net.SplitHostPort(smtpServer); err != nil {
+			return nil, fmt.Errorf("-smtp-server must be a host:port: %w", err)
+		}
+	}
+
 	blacklistedArtists := map[string]struct{}{}
 	if blacklistFile != "" {
 		blacklistedArtists, err = getBlacklistedArtists(blacklistFile)
@@ -245,37 +708,172 @@ func getConfig() (*config, error) {
 		}
 	}
 
+	callbackAddr, err = getCallbackAddr(redirectURI, callbackAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenStorage, err := parseTokenStorage(*tokenStorageStr)
+	if err != nil {
+		return nil, err
+	}
+	tokenPassphrase, err := getTokenPassphrase(tokenPassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := newTokenStore(tokenStorage, tokenPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
 	auth := spotify.NewAuthenticator(
 		redirectURI,
 		spotify.ScopeUserFollowRead,
 		spotify.ScopeUserLibraryRead,
 		spotify.ScopePlaylistModifyPrivate,
+		spotify.ScopePlaylistModifyPublic,
 		spotify.ScopePlaylistReadPrivate,
+		spotify.ScopePlaylistReadCollaborative,
+		spotify.ScopeUserReadRecentlyPlayed,
+		spotify.ScopeImageUpload,
 	)
 
-	spotifyClientID, ok := os.LookupEnv("SPOTIFY_CLIENT_ID")
-	if !ok {
-		return nil, errors.New("SPOTIFY_CLIENT_ID environment variable is required to be set")
+	// The environment comes first, since it's what a particular deployment
+	// sets, while the config file is more likely to be shared.
+	clientIDSources := []credentialSource{
+		envCredential("SPOTIFY_CLIENT_ID"),
+		envFileCredential("SPOTIFY_CLIENT_ID_FILE"),
+		flagCredential("client-id", clientID),
 	}
-
-	spotifyClientSecret, ok := os.LookupEnv("SPOTIFY_CLIENT_SECRET")
-	if !ok {
-		return nil, errors.New("SPOTIFY_CLIENT_SECRET environment variable is required to be set")
+	clientSecretSources := []credentialSource{
+		envCredential("SPOTIFY_CLIENT_SECRET"),
+		envFileCredential("SPOTIFY_CLIENT_SECRET_FILE"),
+		fileCredential("client-secret-file", clientSecretFile),
+		commandCredential("client-secret-command", clientSecretCommand),
+		flagCredential("client-secret", clientSecret),
 	}
-	auth.SetAuthInfo(spotifyClientID, spotifyClientSecret)
 
 	return &config{
-		duration:           *durationPtr,
-		playlistName:       playlistName,
-		blacklistedArtists: blacklistedArtists,
-
-		spotifyClientID:     spotifyClientID,
-		spotifyClientSecret: spotifyClientSecret,
+		duration:            *durationPtr,
+		since:               since,
+		until:               until,
+		playlistName:        playlistName,
+		blacklistedArtists:  blacklistedArtists,
+		dedupTracks:         *dedupTracksPtr,
+		dedupPreference:     dedupPreference,
+		skipLikedTracks:     *skipLikedTracksPtr,
+		recordHistory:       *recordHistoryPtr,
+		playedThreshold:     *playedThresholdPtr,
+		prunePlaylistID:     spotify.ID(*prunePlaylistIDPtr),
+		serveInterval:       *serveIntervalPtr,
+		serveJitter:         *serveJitterPtr,
+		order:               order,
+		splitMode:           splitMode,
+		splitNames:          splitNames,
+		splitNameTemplates:  splitNameTemplates,
+		artistBuckets:       artistBuckets,
+		nameTemplate:        nameTemplate,
+		descriptionTemplate: descriptionTemplate,
+		coverMode:           coverMode,
+		coverBytes:          coverBytes,
+		public:              *publicPtr,
+		collaborative:       *collaborativePtr,
+		webhookURLs:         webhookURLs,
+		webhookFormat:       webhookFormat,
+		digestTemplate:      digestTemplate,
+		emailTo:             emailTo,
+		emailFrom:           emailFrom,
+		smtpServer:          smtpServer,
+		smtpUsername:        smtpUsername,
+		smtpPassword:        os.Getenv("SMTP_PASSWORD"),
+		smtpStartTLS:        *smtpStartTLSPtr,
+		includeUpcoming:     *includeUpcomingPtr,
+		precisionPolicy:     precisionPolicy,
+		icsPath:             icsPath,
+		feedPath:            feedPath,
+		feedAddr:            feedAddr,
+		metricsFile:         metricsFile,
+		metricsAddr:         metricsAddr,
+		logLevel:            logLevel,
+		logFormat:           logFormat,
+		progressMode:        progressMode,
+		exportFormat:        exportFormat,
+		loginTimeout:        *loginTimeoutPtr,
+		redirectURI:         redirectURI,
+		callbackAddr:        callbackAddr,
+		tokenStorage:        tokenStorage,
+		tokenPassphraseFile: tokenPassphraseFile,
+		tokenPassphrase:     tokenPassphrase,
+		tokens:              tokens,
+
+		clientIDSources:     clientIDSources,
+		clientSecretSources: clientSecretSources,
 
 		auth: auth,
 	}, nil
 }
 
+func getConfigFilePath() (string, bool) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", false
+	}
+
+	return filepath.Join(configDir, "fangirl", "config"), true
+}
+
+// applyConfigFile sets the flags in the config file at path that weren't given
+// on the command line. If path is empty, the default config file is used, if
+// there is one. Repeatable flags like -webhook can be given more than once.
+func applyConfigFile(path string) error {
+	if path == "" {
+		defaultPath, ok := getConfigFilePath()
+		if !ok {
+			return nil
+		}
+		if _, err := os.Stat(defaultPath); os.IsNotExist(err) {
+			return nil
+		}
+		path = defaultPath
+	}
+
+	fileContents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// The command line takes precedence over the config file.
+	setOnCommandLine := make(map[string]struct{})
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = struct{}{}
+	})
+
+	for i, line := range strings.Split(string(fileContents), "\n") {
+		trimmedLine := strings.TrimSpace(line)
+		if len(trimmedLine) == 0 || strings.HasPrefix(trimmedLine, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(trimmedLine, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return fmt.Errorf("line %d of the config file is not of the form 'flag = value': %q", i+1, line)
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("line %d of the config file sets an unknown flag %q", i+1, name)
+		}
+		if _, ok := setOnCommandLine[name]; ok {
+			continue
+		}
+
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("line %d of the config file sets an invalid value for -%s: %w", i+1, name, err)
+		}
+	}
+
+	return nil
+}
+
 func getBlacklistedArtists(blacklistFile string) (map[string]struct{}, error) {
 	fileContents, err := ioutil.ReadFile(blacklistFile)
 	if err != nil {
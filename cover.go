@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png" // Artwork is pretty much always a JPEG, but just in case.
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// coverMode decides what fangirl uses for the cover image of the playlists it
+// creates.
+type coverMode string
+
+const (
+	// coverNone leaves Spotify's default mosaic cover alone.
+	coverNone coverMode = "none"
+	// coverGrid makes a grid of the artwork of the newest releases.
+	coverGrid coverMode = "grid"
+	// coverText makes a card with the date range of the releases on it.
+	coverText coverMode = "text"
+	// coverFile uses a static JPEG.
+	coverFile coverMode = "file"
+)
+
+const (
+	// coverSize is the width and height of the covers we generate, which is
+	// the size Spotify shows them at.
+	coverSize = 640
+	// maxCoverBytes is the largest image Spotify accepts for a playlist cover.
+	// The limit applies to the image once it's base64-encoded for the upload,
+	// so the JPEG itself has to be about a quarter smaller (see coverFits).
+	maxCoverBytes = 256 * 1024
+	// artworkTimeout is how long we give the download of a single release's
+	// artwork.
+	artworkTimeout = 30 * time.Second
+)
+
+// artworkClient downloads the artwork for grid covers. Unlike
+// spotify.Image.Download, which uses http.DefaultClient, it gives up on a
+// stalled download rather than hanging the whole run.
+var artworkClient = &http.Client{Timeout: artworkTimeout}
+
+func parseCoverMode(s string) (coverMode, error) {
+	switch mode := coverMode(s); mode {
+	case coverNone, coverGrid, coverText, coverFile:
+		return mode, nil
+	default:
+		return "", fmt.Errorf(
+			"unknown cover mode %q, expected one of: %s, %s, %s, %s",
+			s, coverNone, coverGrid, coverText, coverFile,
+		)
+	}
+}
+
+// readCoverFile reads a static cover image, making sure Spotify will actually
+// accept it.
+func readCoverFile(path string) ([]byte, error) {
+	coverBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the cover file: %w", err)
+	}
+
+	if _, err := jpeg.DecodeConfig(bytes.NewReader(coverBytes)); err != nil {
+		return nil, fmt.Errorf("the cover file must be a JPEG: %w", err)
+	}
+	if !coverFits(coverBytes) {
+		return nil, fmt.Errorf(
+			"the cover file must be at most %d bytes, but it is %d bytes",
+			base64.StdEncoding.DecodedLen(maxCoverBytes), len(coverBytes),
+		)
+	}
+
+	return coverBytes, nil
+}
+
+// coverFits reports whether Spotify will accept the JPEG coverBytes as a
+// playlist cover, which it only checks after they've been base64-encoded.
+func coverFits(coverBytes []byte) bool {
+	return base64.StdEncoding.EncodedLen(len(coverBytes)) <= maxCoverBytes
+}
+
+// makeCover returns the JPEG-encoded cover for a playlist of the given albums,
+// released between start and end, or nil if the playlist should keep the
+// default cover.
+func makeCover(cfg *config, albums []spotify.SimpleAlbum, start time.Time, end time.Time) ([]byte, error) {
+	var img image.Image
+	switch cfg.coverMode {
+	case coverNone:
+		return nil, nil
+	case coverFile:
+		return cfg.coverBytes, nil
+	case coverGrid:
+		var err error
+		img, err = gridCover(albums)
+		if errors.Is(err, errNoArtwork) {
+			// Better to have some cover than none at all.
+			img = textCover(start, end)
+		} else if err != nil {
+			return nil, err
+		}
+	case coverText:
+		img = textCover(start, end)
+	}
+
+	return encodeCover(img)
+}
+
+// encodeCover encodes img as a JPEG, lowering the quality until it fits within
+// Spotify's size limit.
+func encodeCover(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	for quality := 90; quality > 0; quality -= 10 {
+		buf.Reset()
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, fmt.Errorf("failed to encode the cover: %w", err)
+		}
+
+		if coverFits(buf.Bytes()) {
+			return buf.Bytes(), nil
+		}
+	}
+
+	return nil, errors.New("failed to encode the cover small enough for Spotify")
+}
+
+var errNoArtwork = errors.New("none of the albums have any artwork")
+
+// gridCover makes a 1x1, 2x2 or 3x3 grid (whichever is the largest we have
+// enough artwork for) of the artwork of the newest albums.
+func gridCover(albums []spotify.SimpleAlbum) (image.Image, error) {
+	newest := make([]spotify.SimpleAlbum, 0, len(albums))
+	for _, album := range albums {
+		if len(album.Images) != 0 {
+			newest = append(newest, album)
+		}
+	}
+	sort.SliceStable(newest, func(i, j int) bool {
+		return compareAlbumsNewest(newest[i], newest[j])
+	})
+
+	var gridSize int
+	switch {
+	case len(newest) >= 9:
+		gridSize = 3
+	case len(newest) >= 4:
+		gridSize = 2
+	case len(newest) >= 1:
+		gridSize = 1
+	default:
+		return nil, errNoArtwork
+	}
+
+	cellSize := coverSize / gridSize
+	cover := image.NewRGBA(image.Rect(0, 0, coverSize, coverSize))
+	for i, album := range newest[:gridSize*gridSize] {
+		artwork, err := downloadArtwork(album.Images, cellSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download the artwork for %q: %w", album.Name, err)
+		}
+
+		x, y := (i%gridSize)*cellSize, (i/gridSize)*cellSize
+		drawScaled(cover, image.Rect(x, y, x+cellSize, y+cellSize), artwork)
+	}
+
+	return cover, nil
+}
+
+// downloadArtwork downloads the smallest of images that is still at least
+// minSize wide, or the largest one if none are.
+func downloadArtwork(images []spotify.Image, minSize int) (image.Image, error) {
+	// Images are sorted widest first.
+	best := images[0]
+	for _, img := range images[1:] {
+		if img.Width >= minSize {
+			best = img
+		}
+	}
+
+	resp, err := artworkClient.Get(best.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("artwork download responded with HTTP %d", resp.StatusCode)
+	}
+
+	artwork, _, err := image.Decode(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the artwork: %w", err)
+	}
+
+	return artwork, nil
+}
+
+// drawScaled draws src into the rectangle r of dst, stretching it to fit. The
+// standard library doesn't do scaling, and nearest neighbour is good enough
+// for album art at this size.
+func drawScaled(dst *image.RGBA, r image.Rectangle, src image.Image) {
+	srcBounds := src.Bounds()
+	for y := 0; y < r.Dy(); y++ {
+		srcY := srcBounds.Min.Y + y*srcBounds.Dy()/r.Dy()
+		for x := 0; x < r.Dx(); x++ {
+			srcX := srcBounds.Min.X + x*srcBounds.Dx()/r.Dx()
+			dst.Set(r.Min.X+x, r.Min.Y+y, src.At(srcX, srcY))
+		}
+	}
+}
+
+// textCover makes a card with the date range of the releases written on it.
+// The background colour is derived from the dates, so that consecutive
+// playlists are easy to tell apart.
+func textCover(start time.Time, end time.Time) image.Image {
+	const dateFormat = "Jan 2 2006"
+	lines := []string{
+		"FANGIRL",
+		strings.ToUpper(start.Format(dateFormat)),
+		"-",
+		strings.ToUpper(end.Format(dateFormat)),
+	}
+
+	hash := fnv.New32a()
+	for _, line := range lines {
+		hash.Write([]byte(line))
+	}
+	sum := hash.Sum32()
+	// Keep the colour on the darker side so that white text stays readable.
+	background := color.RGBA{R: uint8(sum) % 160, G: uint8(sum>>8) % 160, B: uint8(sum>>16) % 160, A: 255}
+
+	cover := image.NewRGBA(image.Rect(0, 0, coverSize, coverSize))
+	draw.Draw(cover, cover.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
+
+	longest := 0
+	for _, line := range lines {
+		if len(line) > longest {
+			longest = len(line)
+		}
+	}
+
+	// Make the longest line take up about 80% of the width of the cover.
+	scale := (coverSize * 8 / 10) / (longest * (glyphWidth + 1))
+	lineHeight := (glyphHeight + 3) * scale
+	y := (coverSize - len(lines)*lineHeight) / 2
+	for _, line := range lines {
+		x := (coverSize - len(line)*(glyphWidth+1)*scale) / 2
+		drawText(cover, x, y, scale, line, color.White)
+		y += lineHeight
+	}
+
+	return cover
+}
+
+func drawText(dst *image.RGBA, x int, y int, scale int, text string, c color.Color) {
+	for i, r := range text {
+		glyph, ok := glyphs[r]
+		if !ok {
+			continue
+		}
+
+		glyphX := x + i*(glyphWidth+1)*scale
+		for row, bits := range glyph {
+			for col, bit := range bits {
+				if bit != '#' {
+					continue
+				}
+				pixel := image.Rect(glyphX+col*scale, y+row*scale, glyphX+(col+1)*scale, y+(row+1)*scale)
+				draw.Draw(dst, pixel, &image.Uniform{C: c}, image.Point{}, draw.Src)
+			}
+		}
+	}
+}
+
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// glyphs is a tiny bitmap font, covering just enough characters for the text
+// covers. Since there's no font rendering in the standard library, this was
+// easier than pulling in a dependency.
+var glyphs = map[rune][glyphHeight]string{
+	' ': {".....", ".....", ".....", ".....", ".....", ".....", "....."},
+	'-': {".....", ".....", ".....", "#####", ".....", ".....", "....."},
+	',': {".....", ".....", ".....", ".....", ".##..", "..#..", ".#..."},
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"####.", "....#", "....#", ".###.", "....#", "....#", "####."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {".###.", "#....", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "....#", ".###."},
+	'A': {".###.", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'B': {"####.", "#...#", "#...#", "####.", "#...#", "#...#", "####."},
+	'C': {".###.", "#...#", "#....", "#....", "#....", "#...#", ".###."},
+	'D': {"####.", "#...#", "#...#", "#...#", "#...#", "#...#", "####."},
+	'E': {"#####", "#....", "#....", "####.", "#....", "#....", "#####"},
+	'F': {"#####", "#....", "#....", "####.", "#....", "#....", "#...."},
+	'G': {".###.", "#...#", "#....", "#.###", "#...#", "#...#", ".####"},
+	'H': {"#...#", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'I': {".###.", "..#..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'J': {"..###", "...#.", "...#.", "...#.", "...#.", "#..#.", ".##.."},
+	'K': {"#...#", "#..#.", "#.#..", "##...", "#.#..", "#..#.", "#...#"},
+	'L': {"#....", "#....", "#....", "#....", "#....", "#....", "#####"},
+	'M': {"#...#", "##.##", "#.#.#", "#.#.#", "#...#", "#...#", "#...#"},
+	'N': {"#...#", "#...#", "##..#", "#.#.#", "#..##", "#...#", "#...#"},
+	'O': {".###.", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'P': {"####.", "#...#", "#...#", "####.", "#....", "#....", "#...."},
+	'Q': {".###.", "#...#", "#...#", "#...#", "#.#.#", "#..#.", ".##.#"},
+	'R': {"####.", "#...#", "#...#", "####.", "#.#..", "#..#.", "#...#"},
+	'S': {".####", "#....", "#....", ".###.", "....#", "....#", "####."},
+	'T': {"#####", "..#..", "..#..", "..#..", "..#..", "..#..", "..#.."},
+	'U': {"#...#", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'V': {"#...#", "#...#", "#...#", "#...#", "#...#", ".#.#.", "..#.."},
+	'W': {"#...#", "#...#", "#...#", "#.#.#", "#.#.#", "#.#.#", ".#.#."},
+	'X': {"#...#", "#...#", ".#.#.", "..#..", ".#.#.", "#...#", "#...#"},
+	'Y': {"#...#", "#...#", ".#.#.", "..#..", "..#..", "..#..", "..#.."},
+	'Z': {"#####", "....#", "...#.", "..#..", ".#...", "#....", "#####"},
+}
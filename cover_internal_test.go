@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestTextCover(t *testing.T) {
+	start := time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)
+
+	cover := textCover(start, end)
+	assert.Equal(t, image.Rect(0, 0, coverSize, coverSize), cover.Bounds())
+
+	// The background is derived from the dates, so the same dates give the
+	// same cover and different ones (most likely) don't.
+	assert.Equal(t, cover, textCover(start, end))
+	assert.NotEqual(t, cover.At(0, 0), textCover(start, end.AddDate(0, 0, 1)).At(0, 0))
+
+	// Something other than the background has to have been drawn.
+	background := cover.At(0, 0)
+	drawn := false
+	for y := 0; y < coverSize && !drawn; y++ {
+		for x := 0; x < coverSize && !drawn; x++ {
+			drawn = cover.At(x, y) != background
+		}
+	}
+	assert.True(t, drawn)
+}
+
+func TestEncodeCover(t *testing.T) {
+	// Noise compresses terribly, so it takes a few tries to get it small
+	// enough.
+	rng := rand.New(rand.NewSource(1))
+	noise := image.NewRGBA(image.Rect(0, 0, coverSize, coverSize))
+	for y := 0; y < coverSize; y++ {
+		for x := 0; x < coverSize; x++ {
+			noise.Set(x, y, color.RGBA{R: uint8(rng.Intn(256)), G: uint8(rng.Intn(256)), B: uint8(rng.Intn(256)), A: 255})
+		}
+	}
+
+	testCases := []struct {
+		name string
+		img  image.Image
+	}{
+		{"text", textCover(time.Now(), time.Now())},
+		{"noise", noise},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			coverBytes, err := encodeCover(tc.img)
+			require.NoError(t, err)
+
+			assert.LessOrEqual(t, base64.StdEncoding.EncodedLen(len(coverBytes)), maxCoverBytes)
+			decoded, err := jpeg.Decode(bytes.NewReader(coverBytes))
+			require.NoError(t, err)
+			assert.Equal(t, tc.img.Bounds(), decoded.Bounds())
+		})
+	}
+}
+
+func TestReadCoverFile(t *testing.T) {
+	var jpegBytes bytes.Buffer
+	require.NoError(t, jpeg.Encode(&jpegBytes, textCover(time.Now(), time.Now()), nil))
+	var pngBytes bytes.Buffer
+	require.NoError(t, png.Encode(&pngBytes, textCover(time.Now(), time.Now())))
+
+	// Pad a JPEG out to a size that's under Spotify's limit, but not once it's
+	// base64-encoded.
+	padded := append([]byte{}, jpegBytes.Bytes()...)
+	padded = append(padded, make([]byte, 200*1024-len(padded))...)
+	justFits := append([]byte{}, jpegBytes.Bytes()...)
+	justFits = append(justFits, make([]byte, maxCoverBytes/4*3-len(justFits))...)
+
+	testCases := []struct {
+		name     string
+		contents []byte
+		errorMsg string
+	}{
+		{"jpeg", jpegBytes.Bytes(), ""},
+		{"just fits", justFits, ""},
+		{"png", pngBytes.Bytes(), "the cover file must be a JPEG"},
+		{"too big once encoded", padded, "the cover file must be at most 196608 bytes, but it is 204800 bytes"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cover.jpg")
+			require.NoError(t, os.WriteFile(path, tc.contents, 0600))
+
+			coverBytes, err := readCoverFile(path)
+			if tc.errorMsg != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errorMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.contents, coverBytes)
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := readCoverFile(filepath.Join(t.TempDir(), "cover.jpg"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to read the cover file")
+	})
+}
+
+func TestDownloadArtwork(t *testing.T) {
+	var artwork bytes.Buffer
+	require.NoError(t, png.Encode(&artwork, textCover(time.Now(), time.Now())))
+
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write(artwork.Bytes())
+		case "/stalled":
+			<-stalled
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	// Cleanups run last first, so this lets the server close.
+	t.Cleanup(func() { close(stalled) })
+
+	oldClient := artworkClient
+	artworkClient = &http.Client{Timeout: 100 * time.Millisecond}
+	t.Cleanup(func() { artworkClient = oldClient })
+
+	// The smallest image that's still big enough is the one downloaded.
+	img, err := downloadArtwork([]spotify.Image{
+		{Width: 640, URL: server.URL + "/missing"},
+		{Width: 300, URL: server.URL + "/small"},
+		{Width: 64, URL: server.URL + "/missing"},
+	}, 300)
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, coverSize, coverSize), img.Bounds())
+
+	_, err = downloadArtwork([]spotify.Image{{Width: 640, URL: server.URL + "/missing"}}, 300)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "HTTP 404")
+
+	_, err = downloadArtwork([]spotify.Image{{Width: 640, URL: server.URL + "/stalled"}}, 300)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Client.Timeout exceeded")
+}
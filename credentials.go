@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// credentialSource is somewhere a Spotify credential can come from.
+type credentialSource struct {
+	// name describes the source, e.g. the environment variable or flag.
+	name string
+	// get returns the credential, and whether the source has one at all.
+	get func() (string, bool, error)
+}
+
+// getCredential returns the credential from the first of the sources that
+// has one, along with that source's name.
+func getCredential(what string, sources []credentialSource) (string, string, error) {
+	names := make([]string, 0, len(sources))
+	for _, source := range sources {
+		value, ok, err := source.get()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get the %s from %s: %w", what, source.name, err)
+		}
+		if ok {
+			return value, source.name, nil
+		}
+		names = append(names, source.name)
+	}
+
+	return "", "", fmt.Errorf("the %s is required, from one of: %s", what, strings.Join(names, ", "))
+}
+
+// resolveCredentials gets the Spotify app's client ID and secret, for
+// commands that need them.
+func (cfg *config) resolveCredentials() error {
+	clientID, _, err := getCredential("Spotify client ID", cfg.clientIDSources)
+	if err != nil {
+		return err
+	}
+
+	clientSecret, clientSecretSource, err := getCredential("Spotify client secret", cfg.clientSecretSources)
+	if err != nil {
+		return err
+	}
+
+	cfg.spotifyClientID = clientID
+	cfg.spotifyClientSecret = clientSecret
+	cfg.clientSecretSource = clientSecretSource
+	cfg.auth.SetAuthInfo(clientID, clientSecret)
+
+	return nil
+}
+
+// envCredential gets a credential from an environment variable.
+func envCredential(name string) credentialSource {
+	return credentialSource{name, func() (string, bool, error) {
+		value := os.Getenv(name)
+		return value, value != "", nil
+	}}
+}
+
+// envFileCredential gets a credential from the file an environment variable
+// points to, like systemd's credentials or Docker's secrets.
+func envFileCredential(name string) credentialSource {
+	return credentialSource{name, func() (string, bool, error) {
+		path := os.Getenv(name)
+		if path == "" {
+			return "", false, nil
+		}
+
+		value, err := readCredentialFile(path)
+		return value, true, err
+	}}
+}
+
+// fileCredential gets a credential from the file a flag points to.
+func fileCredential(flagName, path string) credentialSource {
+	return credentialSource{"-" + flagName, func() (string, bool, error) {
+		if path == "" {
+			return "", false, nil
+		}
+
+		value, err := readCredentialFile(path)
+		return value, true, err
+	}}
+}
+
+// commandCredential gets a credential from the stdout of a shell command,
+// e.g. a password manager's CLI.
+func commandCredential(flagName, command string) credentialSource {
+	return credentialSource{"-" + flagName, func() (string, bool, error) {
+		if command == "" {
+			return "", false, nil
+		}
+
+		cmd := exec.Command("sh", "-c", command)
+		// The command may well want to prompt for a password of its own.
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", true, fmt.Errorf("failed to run %q: %w", command, err)
+		}
+
+		value := strings.TrimSpace(string(output))
+		if value == "" {
+			return "", true, fmt.Errorf("%q printed nothing", command)
+		}
+
+		return value, true, nil
+	}}
+}
+
+// flagCredential gets a credential given directly to a flag, which is mostly
+// useful in the config file.
+func flagCredential(flagName, value string) credentialSource {
+	return credentialSource{"-" + flagName, func() (string, bool, error) {
+		return value, value != "", nil
+	}}
+}
+
+func readCredentialFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Files like these almost always end in a newline that isn't part of
+	// the credential.
+	value := strings.TrimSpace(string(contents))
+	if value == "" {
+		return "", errors.New(path + " is empty")
+	}
+
+	return value, nil
+}
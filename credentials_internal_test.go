@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestGetCredential(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("from a file\n"), 0600))
+
+	sources := func() []credentialSource {
+		return []credentialSource{
+			envCredential("FANGIRL_TEST_SECRET"),
+			envFileCredential("FANGIRL_TEST_SECRET_FILE"),
+			commandCredential("secret-command", "echo '  from a command  '"),
+			flagCredential("secret", "from a flag"),
+		}
+	}
+
+	// Earlier sources win over later ones.
+	t.Setenv("FANGIRL_TEST_SECRET", "")
+	t.Setenv("FANGIRL_TEST_SECRET_FILE", "")
+	value, source, err := getCredential("secret", sources())
+	require.NoError(t, err)
+	assert.Equal(t, "from a command", value)
+	assert.Equal(t, "-secret-command", source)
+
+	t.Setenv("FANGIRL_TEST_SECRET_FILE", secretFile)
+	value, source, err = getCredential("secret", sources())
+	require.NoError(t, err)
+	assert.Equal(t, "from a file", value)
+	assert.Equal(t, "FANGIRL_TEST_SECRET_FILE", source)
+
+	t.Setenv("FANGIRL_TEST_SECRET", "from the env")
+	value, source, err = getCredential("secret", sources())
+	require.NoError(t, err)
+	assert.Equal(t, "from the env", value)
+	assert.Equal(t, "FANGIRL_TEST_SECRET", source)
+}
+
+func TestGetCredentialErrors(t *testing.T) {
+	_, _, err := getCredential("secret", []credentialSource{
+		flagCredential("secret", ""),
+		fileCredential("secret-file", ""),
+	})
+	assert.EqualError(t, err, "the secret is required, from one of: -secret, -secret-file")
+
+	emptyFile := filepath.Join(t.TempDir(), "empty")
+	require.NoError(t, os.WriteFile(emptyFile, []byte("\n"), 0600))
+	_, _, err = getCredential("secret", []credentialSource{fileCredential("secret-file", emptyFile)})
+	assert.ErrorContains(t, err, "is empty")
+
+	// A source that's set but broken shouldn't fall through to the next one.
+	_, _, err = getCredential("secret", []credentialSource{
+		commandCredential("secret-command", "exit 1"),
+		flagCredential("secret", "from a flag"),
+	})
+	assert.ErrorContains(t, err, "failed to get the secret from -secret-command")
+}
+
+func TestResolveCredentials(t *testing.T) {
+	// The command leaves a mark, so we can tell whether it ran.
+	marker := filepath.Join(t.TempDir(), "ran")
+	cfg := &config{
+		clientIDSources: []credentialSource{flagCredential("client-id", "id")},
+		clientSecretSources: []credentialSource{
+			commandCredential("client-secret-command", "touch '"+marker+"' && echo secret"),
+		},
+		auth: spotify.NewAuthenticator(defaultRedirectURI),
+	}
+	assert.NoFileExists(t, marker)
+
+	require.NoError(t, cfg.resolveCredentials())
+	assert.FileExists(t, marker)
+	assert.Equal(t, "id", cfg.spotifyClientID)
+	assert.Equal(t, "secret", cfg.spotifyClientSecret)
+	assert.Equal(t, "-client-secret-command", cfg.clientSecretSource)
+
+	cfg.clientIDSources = []credentialSource{flagCredential("client-id", "")}
+	assert.EqualError(t, cfg.resolveCredentials(), "the Spotify client ID is required, from one of: -client-id")
+}
+
+func TestClientSecretOnlyFromConfigFile(t *testing.T) {
+	// getConfig defines its flags on the global flag set, so it needs a fresh
+	// one every time.
+	defaultFlags := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = defaultFlags })
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("SPOTIFY_CLIENT_SECRET", "")
+	t.Setenv("SPOTIFY_CLIENT_SECRET_FILE", "")
+
+	configFile := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(configFile, []byte("client-id = id\nclient-secret = from the file\n"), 0600))
+
+	flag.CommandLine = flag.NewFlagSet("fangirl", flag.ContinueOnError)
+	_, err := getConfig([]string{"-config", configFile, "-client-secret", "from the command line"})
+	assert.ErrorContains(t, err, "-client-secret is only accepted in the config file")
+
+	flag.CommandLine = flag.NewFlagSet("fangirl", flag.ContinueOnError)
+	cfg, err := getConfig([]string{"-config", configFile})
+	require.NoError(t, err)
+	require.NoError(t, cfg.resolveCredentials())
+	assert.Equal(t, "from the file", cfg.spotifyClientSecret)
+	assert.Equal(t, "-client-secret", cfg.clientSecretSource)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/zmb3/spotify"
+)
+
+// dedupPreference decides which release wins when the same track shows up on
+// more than one of them, e.g. a lead single that later appears on the album.
+type dedupPreference string
+
+const (
+	// preferComplete keeps the track from the release with the most tracks,
+	// e.g. the album over the single.
+	preferComplete dedupPreference = "complete"
+	// preferRecent keeps the track from the most recently released release.
+	preferRecent dedupPreference = "recent"
+)
+
+func parseDedupPreference(s string) (dedupPreference, error) {
+	switch pref := dedupPreference(s); pref {
+	case preferComplete, preferRecent:
+		return pref, nil
+	default:
+		return "", fmt.Errorf("unknown dedup preference %q, expected one of %q or %q", s, preferComplete, preferRecent)
+	}
+}
+
+// albumTrack is a track along with the album we got it from.
+type albumTrack struct {
+	album spotify.SimpleAlbum
+	track spotify.SimpleTrack
+}
+
+// duplicateGroup is a set of tracks that we've decided are all the same
+// recording. Only kept makes it into the playlist.
+type duplicateGroup struct {
+	kept    albumTrack
+	dropped []albumTrack
+}
+
+var (
+	// featuringRegex matches the "(feat. Someone)" style suffixes that tend to
+	// get added to or dropped from titles between singles and albums.
+	featuringRegex = regexp.MustCompile(`(?i)[(\[](feat\.?|ft\.?|featuring|with) [^)\]]*[)\]]`)
+	// nonAlphanumericRegex matches everything we don't care about when
+	// comparing titles.
+	nonAlphanumericRegex = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+)
+
+func normalizeTitle(title string) string {
+	title = featuringRegex.ReplaceAllString(title, "")
+	title = nonAlphanumericRegex.ReplaceAllString(title, " ")
+	return strings.TrimSpace(strings.ToLower(title))
+}
+
+// durationTolerance is how far apart two tracks' durations can be for the
+// title fallback to still consider them the same, since re-releases often
+// differ by a few milliseconds, and sometimes by the odd second of silence.
+const durationTolerance = 2000
+
+// titleCluster is a set of tracks that share a normalized title and have
+// durations within durationTolerance of the first of them.
+type titleCluster struct {
+	key      string
+	duration int
+}
+
+// trackKeys hands out the keys under which two tracks are considered the
+// same. ISRCs identify recordings, so they're the best signal we have. Not
+// every track has one though, in which case we fall back to the normalized
+// title and the duration. Durations can't be compared within a tolerance by
+// just rounding them, so tracks without an ISRC are clustered as they're
+// seen, and keys are only comparable when they come from the same trackKeys.
+type trackKeys struct {
+	isrcs    map[spotify.ID]string
+	clusters map[string][]titleCluster
+}
+
+func newTrackKeys(isrcs map[spotify.ID]string) *trackKeys {
+	return &trackKeys{isrcs: isrcs, clusters: make(map[string][]titleCluster)}
+}
+
+func (k *trackKeys) key(track spotify.SimpleTrack) string {
+	if isrc, ok := k.isrcs[track.ID]; ok {
+		return "isrc:" + strings.ToUpper(isrc)
+	}
+
+	title := normalizeTitle(track.Name)
+	for _, cluster := range k.clusters[title] {
+		diff := track.Duration - cluster.duration
+		if diff >= -durationTolerance && diff <= durationTolerance {
+			return cluster.key
+		}
+	}
+
+	cluster := titleCluster{
+		key:      fmt.Sprintf("title:%s:%d", title, len(k.clusters[title])),
+		duration: track.Duration,
+	}
+	k.clusters[title] = append(k.clusters[title], cluster)
+
+	return cluster.key
+}
+
+// dedupTracks removes tracks that appear on more than one of the given albums,
+// keeping only the copy from the release preferred by pref. The returned map
+// has the same shape as albumTracks, and the relative order of the remaining
+// tracks is preserved. The collapsed duplicates are returned in the order we
+// first saw them, so that they can be reported.
+func dedupTracks(
+	albums []spotify.SimpleAlbum,
+	albumTracks map[spotify.ID][]spotify.SimpleTrack,
+	isrcs map[spotify.ID]string,
+	pref dedupPreference,
+) (map[spotify.ID][]spotify.SimpleTrack, []duplicateGroup) {
+	trackKeys := newTrackKeys(isrcs)
+	keys := make([]string, 0)
+	candidates := make(map[string][]albumTrack)
+	for _, album := range albums {
+		for _, track := range albumTracks[album.ID] {
+			key := trackKeys.key(track)
+			if _, ok := candidates[key]; !ok {
+				keys = append(keys, key)
+			}
+			candidates[key] = append(candidates[key], albumTrack{album: album, track: track})
+		}
+	}
+
+	// isPreferred reports whether a should be kept over b.
+	isPreferred := func(a, b albumTrack) bool {
+		aSize, bSize := len(albumTracks[a.album.ID]), len(albumTracks[b.album.ID])
+		aRelease, bRelease := a.album.ReleaseDateTime(), b.album.ReleaseDateTime()
+		if pref == preferRecent && !aRelease.Equal(bRelease) {
+			return aRelease.After(bRelease)
+		}
+		if aSize != bSize {
+			return aSize > bSize
+		}
+		if !aRelease.Equal(bRelease) {
+			return aRelease.After(bRelease)
+		}
+		// At this point it really doesn't matter, we just want to make the same
+		// choice every time.
+		return a.album.ID < b.album.ID
+	}
+
+	type trackKey struct {
+		albumID spotify.ID
+		trackID spotify.ID
+	}
+	kept := make(map[trackKey]struct{})
+	duplicates := make([]duplicateGroup, 0)
+	for _, key := range keys {
+		group := candidates[key]
+		best := 0
+		for i := range group[1:] {
+			if isPreferred(group[i+1], group[best]) {
+				best = i + 1
+			}
+		}
+		kept[trackKey{group[best].album.ID, group[best].track.ID}] = struct{}{}
+
+		if len(group) > 1 {
+			dup := duplicateGroup{kept: group[best]}
+			for i, candidate := range group {
+				if i != best {
+					dup.dropped = append(dup.dropped, candidate)
+				}
+			}
+			duplicates = append(duplicates, dup)
+		}
+	}
+
+	dedupedAlbumTracks := make(map[spotify.ID][]spotify.SimpleTrack, len(albumTracks))
+	for _, album := range albums {
+		tracks := make([]spotify.SimpleTrack, 0, len(albumTracks[album.ID]))
+		for _, track := range albumTracks[album.ID] {
+			if _, ok := kept[trackKey{album.ID, track.ID}]; ok {
+				tracks = append(tracks, track)
+			}
+		}
+		dedupedAlbumTracks[album.ID] = tracks
+	}
+
+	return dedupedAlbumTracks, duplicates
+}
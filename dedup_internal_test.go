@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify"
+)
+
+func TestNormalizeTitle(t *testing.T) {
+	testCases := []struct {
+		title    string
+		expected string
+	}{
+		{title: "Song", expected: "song"},
+		{title: "  Song!  ", expected: "song"},
+		{title: "Song (feat. Someone Else)", expected: "song"},
+		{title: "Song [ft. Someone]", expected: "song"},
+		{title: "Song (with Someone)", expected: "song"},
+		{title: "Song (Remix)", expected: "song remix"},
+		{title: "Don't Stop", expected: "don t stop"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, normalizeTitle(tc.title), tc.title)
+	}
+}
+
+func TestDedupTracks(t *testing.T) {
+	single := spotify.SimpleAlbum{
+		ID:                   "single",
+		Name:                 "Lead Single",
+		AlbumType:            "single",
+		ReleaseDate:          "2024-03-01",
+		ReleaseDatePrecision: "day",
+	}
+	album := spotify.SimpleAlbum{
+		ID:                   "album",
+		Name:                 "The Album",
+		AlbumType:            "album",
+		ReleaseDate:          "2024-04-01",
+		ReleaseDatePrecision: "day",
+	}
+	ep := spotify.SimpleAlbum{
+		ID:                   "ep",
+		Name:                 "The EP",
+		AlbumType:            "single",
+		ReleaseDate:          "2024-05-01",
+		ReleaseDatePrecision: "day",
+	}
+
+	leadOnSingle := spotify.SimpleTrack{ID: "lead-single", Name: "Lead (feat. X)", Duration: 200_100}
+	leadOnAlbum := spotify.SimpleTrack{ID: "lead-album", Name: "Lead", Duration: 200_400}
+	leadOnEP := spotify.SimpleTrack{ID: "lead-ep", Name: "Lead (Live)", Duration: 250_000}
+	other := spotify.SimpleTrack{ID: "other", Name: "Other", Duration: 180_000}
+	closer := spotify.SimpleTrack{ID: "closer", Name: "Closer", Duration: 300_000}
+	bSide := spotify.SimpleTrack{ID: "b-side", Name: "B-Side", Duration: 150_000}
+
+	albums := []spotify.SimpleAlbum{single, album, ep}
+	albumTracks := map[spotify.ID][]spotify.SimpleTrack{
+		single.ID: {leadOnSingle},
+		album.ID:  {leadOnAlbum, other, closer},
+		ep.ID:     {leadOnEP, bSide},
+	}
+
+	t.Run("falls back to title and duration", func(t *testing.T) {
+		deduped, duplicates := dedupTracks(albums, albumTracks, map[spotify.ID]string{}, preferComplete)
+
+		assert.Empty(t, deduped[single.ID])
+		assert.Equal(t, []spotify.SimpleTrack{leadOnAlbum, other, closer}, deduped[album.ID])
+		assert.Equal(t, []spotify.SimpleTrack{leadOnEP, bSide}, deduped[ep.ID])
+
+		if assert.Len(t, duplicates, 1) {
+			assert.Equal(t, leadOnAlbum.ID, duplicates[0].kept.track.ID)
+			if assert.Len(t, duplicates[0].dropped, 1) {
+				assert.Equal(t, leadOnSingle.ID, duplicates[0].dropped[0].track.ID)
+			}
+		}
+	})
+
+	t.Run("prefers ISRCs over titles", func(t *testing.T) {
+		isrcs := map[spotify.ID]string{
+			leadOnSingle.ID: "USABC2400001",
+			leadOnAlbum.ID:  "usabc2400001",
+			// The live version is a different recording as far as the title and
+			// duration are concerned, but the ISRC says otherwise.
+			leadOnEP.ID: "USABC2400001",
+		}
+
+		deduped, duplicates := dedupTracks(albums, albumTracks, isrcs, preferComplete)
+
+		assert.Empty(t, deduped[single.ID])
+		assert.Equal(t, []spotify.SimpleTrack{leadOnAlbum, other, closer}, deduped[album.ID])
+		assert.Equal(t, []spotify.SimpleTrack{bSide}, deduped[ep.ID])
+		if assert.Len(t, duplicates, 1) {
+			assert.Len(t, duplicates[0].dropped, 2)
+		}
+	})
+
+	t.Run("prefers recent releases when asked to", func(t *testing.T) {
+		isrcs := map[spotify.ID]string{
+			leadOnSingle.ID: "USABC2400001",
+			leadOnAlbum.ID:  "USABC2400001",
+			leadOnEP.ID:     "USABC2400001",
+		}
+
+		deduped, _ := dedupTracks(albums, albumTracks, isrcs, preferRecent)
+
+		assert.Empty(t, deduped[single.ID])
+		assert.Equal(t, []spotify.SimpleTrack{other, closer}, deduped[album.ID])
+		assert.Equal(t, []spotify.SimpleTrack{leadOnEP, bSide}, deduped[ep.ID])
+	})
+
+	t.Run("leaves unique tracks alone", func(t *testing.T) {
+		deduped, duplicates := dedupTracks(
+			[]spotify.SimpleAlbum{album},
+			map[spotify.ID][]spotify.SimpleTrack{album.ID: {leadOnAlbum, other}},
+			map[spotify.ID]string{},
+			preferComplete,
+		)
+
+		assert.Equal(t, []spotify.SimpleTrack{leadOnAlbum, other}, deduped[album.ID])
+		assert.Empty(t, duplicates)
+	})
+}
+
+func TestTrackKeys(t *testing.T) {
+	keys := newTrackKeys(map[spotify.ID]string{"with-isrc": "usabc1234567", "same-isrc": "USABC1234567"})
+
+	first := keys.key(spotify.SimpleTrack{ID: "a", Name: "Song", Duration: 199_900})
+	// Either side of a second boundary, which rounding would have split.
+	assert.Equal(t, first, keys.key(spotify.SimpleTrack{ID: "b", Name: "Song (feat. X)", Duration: 200_100}))
+	assert.Equal(t, first, keys.key(spotify.SimpleTrack{ID: "c", Name: "Song", Duration: 198_000}))
+	// Too far off to be the same recording, e.g. a live version.
+	assert.NotEqual(t, first, keys.key(spotify.SimpleTrack{ID: "d", Name: "Song", Duration: 230_000}))
+	assert.NotEqual(t, first, keys.key(spotify.SimpleTrack{ID: "e", Name: "Other Song", Duration: 199_900}))
+
+	assert.Equal(
+		t,
+		keys.key(spotify.SimpleTrack{ID: "with-isrc", Name: "Song", Duration: 199_900}),
+		keys.key(spotify.SimpleTrack{ID: "same-isrc", Name: "Different", Duration: 100_000}),
+	)
+	assert.NotEqual(t, first, keys.key(spotify.SimpleTrack{ID: "with-isrc", Name: "Song", Duration: 199_900}))
+}
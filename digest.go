@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// defaultDigestTemplate is the message sent along with a digest, unless
+// overridden with -digest-template.
+const defaultDigestTemplate = `{{len .Releases}} new releases from {{.Start.Format "Jan _2, 2006"}} to {{.End.Format "Jan _2, 2006"}}:
+{{range .Releases}}• {{.Artist}} - {{.Album}} ({{.Type}}, {{.ReleaseDate}}) {{.URL}}
+{{end}}`
+
+const (
+	// digestMaxTries is the number of times we retry sending a digest. This is
+	// a lot less patient than what we do for Spotify, since the digest is a
+	// nice-to-have.
+	digestMaxTries = 5
+	// digestRetryDelay is how long we wait before retrying sending a digest.
+	digestRetryDelay = 10 * time.Second
+)
+
+// retrySending retries sending a digest, see retry. Unlike wrapInRetry, the
+// failures don't count as Spotify API retries.
+func retrySending(fun func() error, maxTries uint, retryDelay time.Duration, allowedErrs ...error) error {
+	return retry(fun, maxTries, retryDelay, func(attempt uint, retrying bool, err error) {
+		slog.Warn("Failed to send the digest", logKeyPhase, phaseDigest, logKeyAttempt, attempt, "max_attempts", maxTries+1, logKeyError, err)
+	}, allowedErrs...)
+}
+
+// digest is a summary of new releases, for telling people about them outside
+// of Spotify.
+type digest struct {
+	// Start and End are the first and last moments of the window the
+	// releases came out in.
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	Releases []digestRelease `json:"releases"`
+}
+
+type digestRelease struct {
+	ID          spotify.ID `json:"id"`
+	Artist      string     `json:"artist"`
+	Album       string     `json:"album"`
+	Type        string     `json:"type"`
+	ReleaseDate string     `json:"releaseDate"`
+	URL         string     `json:"url"`
+	ArtworkURL  string     `json:"artworkURL"`
+}
+
+func newDigest(cfg *config, albums []spotify.SimpleAlbum, start time.Time, end time.Time) *digest {
+	releases := make([]digestRelease, 0, len(albums))
+	// We don't have the popularity here, but the other orders are all fair
+	// game.
+	for _, album := range orderAlbums(albums, cfg.order, nil) {
+		releases = append(releases, newDigestRelease(album))
+	}
+
+	return &digest{
+		Start:    start,
+		End:      end,
+		Releases: releases,
+	}
+}
+
+// artistNames lists the artists of album, which may well be none at all.
+func artistNames(album spotify.SimpleAlbum) string {
+	names := make([]string, 0, len(album.Artists))
+	for _, artist := range album.Artists {
+		names = append(names, artist.Name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func newDigestRelease(album spotify.SimpleAlbum) digestRelease {
+	release := digestRelease{
+		ID:          album.ID,
+		Artist:      artistNames(album),
+		Album:       album.Name,
+		Type:        album.AlbumType,
+		ReleaseDate: album.ReleaseDate,
+		URL:         album.ExternalURLs["spotify"],
+	}
+	// Images are sorted widest first.
+	if len(album.Images) != 0 {
+		release.ArtworkURL = album.Images[0].URL
+	}
+
+	return release
+}
+
+// sendDigest tells everyone who wants to know about the given albums. Failing
+// to do so is not the end of the world, so we only log the errors rather than
+// fail the run.
+func sendDigest(cfg *config, albums []spotify.SimpleAlbum, start time.Time, end time.Time) {
+	defer timePhase(phaseDigest)()
+
+	if len(cfg.webhookURLs) == 0 && len(cfg.emailTo) == 0 {
+		return
+	}
+
+	if len(albums) == 0 {
+		slog.Info("No new releases, skipping the digest", logKeyPhase, phaseDigest)
+		return
+	}
+
+	dg := newDigest(cfg, albums, start, end)
+	message, err := executeDigestTemplate(cfg.digestTemplate, dg)
+	if err != nil {
+		slog.Warn("Failed to make the digest message", logKeyPhase, phaseDigest, logKeyError, err)
+		return
+	}
+
+	notifier := newWebhookNotifier(cfg.webhookFormat)
+	for i, url := range cfg.webhookURLs {
+		// Don't log the URL, it is usually a secret.
+		if err := notifier.notify(url, dg, message); err != nil {
+			slog.Warn("Failed to send the digest to webhook", logKeyPhase, phaseDigest, "webhook", i+1, logKeyError, err)
+			continue
+		}
+		slog.Info("Sent the digest to webhook", logKeyPhase, phaseDigest, "webhook", i+1)
+	}
+
+	if len(cfg.emailTo) != 0 {
+		if err := newEmailer(cfg).send(dg, message); err != nil {
+			slog.Warn("Failed to email the digest", logKeyPhase, phaseDigest, logKeyError, err)
+		} else {
+			slog.Info("Emailed the digest", logKeyPhase, phaseDigest, "recipients", len(cfg.emailTo))
+		}
+	}
+}
+
+// getDigestTemplate parses the digest message template from the given file,
+// or the default one if there isn't one.
+func getDigestTemplate(templateFile string) (*template.Template, error) {
+	text := defaultDigestTemplate
+	if templateFile != "" {
+		fileContents, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the digest template file: %w", err)
+		}
+		text = string(fileContents)
+	}
+
+	tmpl, err := template.New("digest").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the digest template: %w", err)
+	}
+
+	// Catch mistakes now, rather than after we've spent half an hour talking
+	// to Spotify.
+	if _, err := executeDigestTemplate(tmpl, &digest{}); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+func executeDigestTemplate(tmpl *template.Template, dg *digest) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, dg); err != nil {
+		return "", fmt.Errorf("failed to execute the digest template: %w", err)
+	}
+
+	return sb.String(), nil
+}
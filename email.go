@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// digestEmailTemplate is the HTML version of the digest email. The plain text
+// version is just the digest message.
+var digestEmailTemplate = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif;">
+<h2>{{len .Releases}} new releases</h2>
+<p>From {{.Start.Format "Jan _2, 2006"}} to {{.End.Format "Jan _2, 2006"}}.</p>
+<table cellpadding="4">
+{{- range .Releases}}
+<tr>
+<td>{{if .ArtworkURL}}<a href="{{.URL}}"><img src="{{.ArtworkURL}}" alt="{{.Album}}" width="64" height="64"></a>{{end}}</td>
+<td><a href="{{.URL}}"><strong>{{.Album}}</strong></a><br>{{.Artist}}<br><small>{{.Type}}, released {{.ReleaseDate}}</small></td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+const (
+	// smtpDialTimeout is how long we wait to connect to the SMTP server.
+	smtpDialTimeout = 30 * time.Second
+	// smtpTimeout is how long we give the SMTP server to take the email,
+	// from connecting to saying goodbye, so that a stalled server can't hang
+	// the run.
+	smtpTimeout = 2 * time.Minute
+)
+
+type emailer struct {
+	// server is the host:port of the SMTP server.
+	server   string
+	username string
+	password string
+	// startTLS requires the connection to be upgraded with STARTTLS before
+	// anything is sent.
+	startTLS   bool
+	from       string
+	to         []string
+	maxTries   uint
+	retryDelay time.Duration
+	timeout    time.Duration
+}
+
+func newEmailer(cfg *config) *emailer {
+	return &emailer{
+		server:     cfg.smtpServer,
+		username:   cfg.smtpUsername,
+		password:   cfg.smtpPassword,
+		startTLS:   cfg.smtpStartTLS,
+		from:       cfg.emailFrom,
+		to:         cfg.emailTo,
+		maxTries:   digestMaxTries,
+		retryDelay: digestRetryDelay,
+		timeout:    smtpTimeout,
+	}
+}
+
+// send emails the digest, with message as its plain text version.
+func (e *emailer) send(dg *digest, message string) error {
+	msg, err := makeDigestEmail(e.from, e.to, dg, message, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return retrySending(func() error {
+		return e.deliver(msg)
+	}, e.maxTries, e.retryDelay)
+}
+
+func (e *emailer) deliver(msg []byte) error {
+	host, _, err := net.SplitHostPort(e.server)
+	if err != nil {
+		return fmt.Errorf("failed to parse the SMTP server address: %w", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", e.server, smtpDialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the SMTP server: %w", err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(e.timeout)); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to set the SMTP deadline: %w", err)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to greet the SMTP server: %w", err)
+	}
+	defer c.Close()
+
+	if e.startTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("the SMTP server does not support STARTTLS")
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+
+	if e.username != "" {
+		// PlainAuth refuses to send the password over an unencrypted
+		// connection, unless the server is on localhost.
+		if err := c.Auth(smtp.PlainAuth("", e.username, e.password, host)); err != nil {
+			return fmt.Errorf("failed to authenticate with the SMTP server: %w", err)
+		}
+	}
+
+	if err := c.Mail(e.from); err != nil {
+		return fmt.Errorf("failed to set the sender: %w", err)
+	}
+	for _, to := range e.to {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("failed to add recipient %q: %w", to, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("failed to start the message: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to write the message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send the message: %w", err)
+	}
+
+	return c.Quit()
+}
+
+// makeDigestEmail makes a multipart/alternative email with both a plain text
+// and HTML version of the digest.
+func makeDigestEmail(from string, to []string, dg *digest, message string, now time.Time) ([]byte, error) {
+	var html bytes.Buffer
+	if err := digestEmailTemplate.Execute(&html, dg); err != nil {
+		return nil, fmt.Errorf("failed to execute the email template: %w", err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	parts := []struct {
+		contentType string
+		content     []byte
+	}{
+		// Clients show the last part they understand, so the fancy one goes
+		// last.
+		{"text/plain; charset=utf-8", []byte(message)},
+		{"text/html; charset=utf-8", html.Bytes()},
+	}
+	for _, part := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the email part: %w", err)
+		}
+
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write(part.content); err != nil {
+			return nil, fmt.Errorf("failed to write the email part: %w", err)
+		}
+		if err := qw.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write the email part: %w", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish the email: %w", err)
+	}
+
+	subject := fmt.Sprintf(
+		"%d new releases from %s to %s",
+		len(dg.Releases),
+		dg.Start.Format("Jan _2, 2006"),
+		dg.End.Format("Jan _2, 2006"),
+	)
+
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", from},
+		{"To", strings.Join(to, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", mw.Boundary())},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", header[0], header[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer accepts a single SMTP session and sends whatever it received
+// down the returned channel.
+func fakeSMTPServer(t *testing.T) (string, <-chan smtpMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan smtpMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tc := textproto.NewConn(conn)
+		var msg smtpMessage
+		tc.PrintfLine("220 localhost ESMTP fake")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch verb {
+			case "EHLO", "HELO":
+				tc.PrintfLine("250 localhost")
+			case "MAIL":
+				msg.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+				tc.PrintfLine("250 OK")
+			case "RCPT":
+				msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+				tc.PrintfLine("250 OK")
+			case "DATA":
+				tc.PrintfLine("354 go ahead")
+				data, err := ioutil.ReadAll(tc.DotReader())
+				if err != nil {
+					return
+				}
+				msg.data = string(data)
+				tc.PrintfLine("250 OK")
+			case "QUIT":
+				tc.PrintfLine("221 bye")
+				messages <- msg
+				return
+			default:
+				tc.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), messages
+}
+
+func TestEmailerSend(t *testing.T) {
+	addr, messages := fakeSMTPServer(t)
+
+	dg := &digest{
+		Start: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		Releases: []digestRelease{{
+			ID:          "a1",
+			Artist:      "Alpha",
+			Album:       "First & Last",
+			Type:        "album",
+			ReleaseDate: "2024-03-03",
+			URL:         "https://open.spotify.com/album/a1",
+			ArtworkURL:  "https://i.scdn.co/image/a1",
+		}},
+	}
+
+	e := &emailer{
+		server:     addr,
+		from:       "fangirl@example.com",
+		to:         []string{"me@example.com", "you@example.com"},
+		timeout:    time.Minute,
+		maxTries:   0,
+		retryDelay: time.Millisecond,
+	}
+	require.NoError(t, e.send(dg, "1 new release: First & Last"))
+
+	msg := <-messages
+	assert.Equal(t, "fangirl@example.com", msg.from)
+	assert.Equal(t, []string{"me@example.com", "you@example.com"}, msg.to)
+
+	parsed, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(msg.data)))
+	require.NoError(t, err)
+	assert.Equal(t, "1 new releases from Mar  1, 2024 to Apr  1, 2024", parsed.Header.Get("Subject"))
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+
+	parts := map[string]string{}
+	mr := multipart.NewReader(parsed.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		// The multipart reader decodes quoted-printable by itself.
+		content, err := ioutil.ReadAll(part)
+		require.NoError(t, err)
+		parts[strings.Split(part.Header.Get("Content-Type"), ";")[0]] = string(content)
+	}
+
+	assert.Equal(t, "1 new release: First & Last", parts["text/plain"])
+	assert.Contains(t, parts["text/html"], `<img src="https://i.scdn.co/image/a1"`)
+	assert.Contains(t, parts["text/html"], `<a href="https://open.spotify.com/album/a1"><strong>First &amp; Last</strong></a>`)
+}
+
+func TestEmailerRequiresStartTLS(t *testing.T) {
+	addr, _ := fakeSMTPServer(t)
+
+	e := &emailer{
+		server:   addr,
+		startTLS: true,
+		from:     "fangirl@example.com",
+		to:       []string{"me@example.com"},
+		timeout:  time.Minute,
+	}
+	assert.ErrorContains(t, e.send(&digest{}, ""), "STARTTLS")
+}
+
+func TestEmailerTimesOut(t *testing.T) {
+	// A server that accepts the connection and then never says a word.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	conns := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conns <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		select {
+		case conn := <-conns:
+			conn.Close()
+		default:
+		}
+	})
+
+	e := &emailer{
+		server:  listener.Addr().String(),
+		from:    "fangirl@example.com",
+		to:      []string{"me@example.com"},
+		timeout: 50 * time.Millisecond,
+	}
+	err = e.send(&digest{}, "")
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
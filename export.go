@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/zmb3/spotify"
+)
+
+// exportFormat is the format the export command writes releases in.
+type exportFormat string
+
+const (
+	exportJSON exportFormat = "json"
+	exportCSV  exportFormat = "csv"
+)
+
+func parseExportFormat(s string) (exportFormat, error) {
+	switch format := exportFormat(s); format {
+	case exportJSON, exportCSV:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown export format %q, expected one of: %s, %s", s, exportJSON, exportCSV)
+	}
+}
+
+// writeExport writes the albums to w in the given format.
+func writeExport(w io.Writer, format exportFormat, albums []spotify.SimpleAlbum) error {
+	releases := make([]digestRelease, 0, len(albums))
+	for _, album := range albums {
+		releases = append(releases, newDigestRelease(album))
+	}
+
+	switch format {
+	case exportCSV:
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write([]string{"id", "artist", "album", "type", "release_date", "url", "artwork_url"})
+		for _, release := range releases {
+			csvWriter.Write([]string{
+				string(release.ID),
+				release.Artist,
+				release.Album,
+				release.Type,
+				release.ReleaseDate,
+				release.URL,
+				release.ArtworkURL,
+			})
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return fmt.Errorf("failed to write the CSV: %w", err)
+		}
+	default:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(releases); err != nil {
+			return fmt.Errorf("failed to write the JSON: %w", err)
+		}
+	}
+
+	return nil
+}
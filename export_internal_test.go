@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestWriteExport(t *testing.T) {
+	albums := []spotify.SimpleAlbum{{
+		ID:          "abc",
+		Name:        "Hello, World",
+		AlbumType:   "album",
+		ReleaseDate: "2024-03-01",
+		Artists:     []spotify.SimpleArtist{{Name: "Carly Rae Jepsen"}},
+	}}
+
+	var sb strings.Builder
+	require.NoError(t, writeExport(&sb, exportCSV, albums))
+	assert.Equal(
+		t,
+		"id,artist,album,type,release_date,url,artwork_url\n"+
+			"abc,Carly Rae Jepsen,\"Hello, World\",album,2024-03-01,,\n",
+		sb.String(),
+	)
+
+	sb.Reset()
+	require.NoError(t, writeExport(&sb, exportJSON, albums))
+	assert.JSONEq(
+		t,
+		`[{"id": "abc", "artist": "Carly Rae Jepsen", "album": "Hello, World", "type": "album",
+		"releaseDate": "2024-03-01", "url": "", "artworkURL": ""}]`,
+		sb.String(),
+	)
+}
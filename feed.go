@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+const (
+	// maxReleaseHistory is how many releases we remember for the feed. Past
+	// this, the ones we saw first are forgotten.
+	maxReleaseHistory = 1000
+	// maxFeedEntries is how many releases go into the feed. Feed readers
+	// remember what they've seen, so this only needs to cover the gap between
+	// the reader's polls.
+	maxFeedEntries = 100
+
+	feedID    = "urn:fangirl:releases"
+	feedTitle = "fangirl: new releases"
+	feedPath  = "/feed.atom"
+)
+
+var feedEntryTemplate = template.Must(template.New("entry").Parse(
+	`{{if .ArtworkURL}}<p><a href="{{.URL}}"><img src="{{.ArtworkURL}}" alt="{{.Album}}" width="300" height="300"></a></p>{{end}}` +
+		`<p><a href="{{.URL}}"><strong>{{.Album}}</strong></a> by {{.Artist}}</p>` +
+		`<p>{{.Type}}, released {{.ReleaseDate}}</p>`,
+))
+
+// releaseRecord is a release that fangirl has come across.
+type releaseRecord struct {
+	digestRelease
+	// FirstSeenAt is when we first came across the release. Unlike the
+	// release date, this only goes forward, which is what feed readers expect.
+	FirstSeenAt time.Time `json:"firstSeenAt"`
+}
+
+// recordReleases remembers the given albums for the feed, returning how many
+// of them we hadn't seen before.
+func (s *localState) recordReleases(albums []spotify.SimpleAlbum, now time.Time) int {
+	numNew := 0
+	for _, album := range albums {
+		if _, ok := s.Releases[album.ID]; ok {
+			continue
+		}
+		s.Releases[album.ID] = releaseRecord{
+			digestRelease: newDigestRelease(album),
+			FirstSeenAt:   now,
+		}
+		numNew++
+	}
+
+	if len(s.Releases) > maxReleaseHistory {
+		for _, record := range sortedReleaseRecords(s.Releases)[maxReleaseHistory:] {
+			delete(s.Releases, record.ID)
+		}
+	}
+
+	return numNew
+}
+
+// sortedReleaseRecords returns the records with the most recently seen ones
+// first.
+func sortedReleaseRecords(releases map[spotify.ID]releaseRecord) []releaseRecord {
+	records := make([]releaseRecord, 0, len(releases))
+	for _, record := range releases {
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].FirstSeenAt.Equal(records[j].FirstSeenAt) {
+			return records[i].FirstSeenAt.After(records[j].FirstSeenAt)
+		}
+		if records[i].ReleaseDate != records[j].ReleaseDate {
+			return records[i].ReleaseDate > records[j].ReleaseDate
+		}
+		return records[i].ID < records[j].ID
+	})
+
+	return records
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Author    atomPerson `xml:"author"`
+	Links     []atomLink `xml:"link"`
+	Summary   atomText   `xml:"summary"`
+	Content   atomText   `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// makeFeed makes an Atom feed of the most recently seen releases.
+func makeFeed(releases map[spotify.ID]releaseRecord) ([]byte, error) {
+	records := sortedReleaseRecords(releases)
+	if len(records) > maxFeedEntries {
+		records = records[:maxFeedEntries]
+	}
+
+	feed := atomFeed{
+		ID:      feedID,
+		Title:   feedTitle,
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: "fangirl"},
+		Entries: make([]atomEntry, 0, len(records)),
+	}
+	// The feed was last updated when its newest entry was, so that it doesn't
+	// look like it changes every time it's written.
+	if len(records) != 0 {
+		feed.Updated = records[0].FirstSeenAt.UTC().Format(time.RFC3339)
+	}
+
+	for _, record := range records {
+		var content bytes.Buffer
+		if err := feedEntryTemplate.Execute(&content, record); err != nil {
+			return nil, fmt.Errorf("failed to execute the feed entry template: %w", err)
+		}
+
+		seenAt := record.FirstSeenAt.UTC().Format(time.RFC3339)
+		entry := atomEntry{
+			// The album ID never changes, so readers won't show the same
+			// release twice.
+			ID:        "spotify:album:" + string(record.ID),
+			Title:     fmt.Sprintf("%s - %s", record.Artist, record.Album),
+			Updated:   seenAt,
+			Published: seenAt,
+			Author:    atomPerson{Name: record.Artist},
+			Summary: atomText{
+				Type: "text",
+				Body: fmt.Sprintf("%s by %s (%s, released %s)", record.Album, record.Artist, record.Type, record.ReleaseDate),
+			},
+			Content: atomText{Type: "html", Body: content.String()},
+		}
+		if record.URL != "" {
+			entry.Links = []atomLink{{Href: record.URL, Rel: "alternate", Type: "text/html"}}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	feedBytes, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the feed: %w", err)
+	}
+
+	return append([]byte(xml.Header), feedBytes...), nil
+}
+
+// writeFeed writes the feed of the releases in st to path.
+func writeFeed(path string, st *localState) error {
+	defer timePhase(phaseFeed)()
+
+	feedBytes, err := makeFeed(st.Releases)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomically(path, feedBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write the feed: %w", err)
+	}
+
+	return nil
+}
+
+// serveFeed hosts the feed on addr until ctx is cancelled.
+func serveFeed(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(feedPath, func(w http.ResponseWriter, r *http.Request) {
+		// The state is reloaded on every request, rather than shared with the
+		// scheduled runs, since those may be updating it.
+		st, err := loadState()
+		if err != nil {
+			slog.Error("Failed to load the state for the feed", logKeyPhase, phaseFeed, logKeyError, err)
+			http.Error(w, "failed to load the feed", http.StatusInternalServerError)
+			return
+		}
+
+		feedBytes, err := makeFeed(st.Releases)
+		if err != nil {
+			slog.Error("Failed to make the feed", logKeyPhase, phaseFeed, logKeyError, err)
+			http.Error(w, "failed to make the feed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.Write(feedBytes)
+	})
+
+	return serveHTTP(ctx, addr, mux, fmt.Sprintf("http://%s%s", addr, feedPath), phaseFeed)
+}
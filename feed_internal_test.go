@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestRecordReleases(t *testing.T) {
+	makeAlbum := func(id string) spotify.SimpleAlbum {
+		return spotify.SimpleAlbum{
+			ID:           spotify.ID(id),
+			Name:         id,
+			Artists:      []spotify.SimpleArtist{{Name: "Alpha"}},
+			ReleaseDate:  "2024-03-01",
+			ExternalURLs: map[string]string{"spotify": "https://open.spotify.com/album/" + id},
+		}
+	}
+
+	first := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+
+	s := &localState{Releases: map[spotify.ID]releaseRecord{}}
+	assert.Equal(t, 2, s.recordReleases([]spotify.SimpleAlbum{makeAlbum("a1"), makeAlbum("a2")}, first))
+	assert.Equal(t, 1, s.recordReleases([]spotify.SimpleAlbum{makeAlbum("a2"), makeAlbum("a3")}, second))
+
+	// Seeing a release again doesn't make it new again.
+	assert.Equal(t, first, s.Releases["a2"].FirstSeenAt)
+	assert.Equal(t, second, s.Releases["a3"].FirstSeenAt)
+
+	albums := make([]spotify.SimpleAlbum, 0, maxReleaseHistory)
+	for i := 0; i < maxReleaseHistory; i++ {
+		albums = append(albums, makeAlbum(fmt.Sprintf("b%d", i)))
+	}
+	s.recordReleases(albums, second.Add(24*time.Hour))
+	assert.Len(t, s.Releases, maxReleaseHistory)
+	assert.NotContains(t, s.Releases, spotify.ID("a1"))
+}
+
+func TestMakeFeed(t *testing.T) {
+	first := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	releases := map[spotify.ID]releaseRecord{
+		"a1": {
+			digestRelease: digestRelease{
+				ID:          "a1",
+				Artist:      "Alpha",
+				Album:       "First",
+				Type:        "album",
+				ReleaseDate: "2024-02-28",
+				URL:         "https://open.spotify.com/album/a1",
+				ArtworkURL:  "https://i.scdn.co/image/a1",
+			},
+			FirstSeenAt: first,
+		},
+		"a2": {
+			digestRelease: digestRelease{
+				ID:          "a2",
+				Artist:      "Alpha",
+				Album:       "Second",
+				Type:        "single",
+				ReleaseDate: "2024-03-02",
+			},
+			FirstSeenAt: first.Add(48 * time.Hour),
+		},
+	}
+
+	feedBytes, err := makeFeed(releases)
+	require.NoError(t, err)
+
+	var feed atomFeed
+	require.NoError(t, xml.Unmarshal(feedBytes, &feed))
+	assert.Equal(t, "2024-03-03T00:00:00Z", feed.Updated)
+	require.Len(t, feed.Entries, 2)
+
+	assert.Equal(t, "spotify:album:a2", feed.Entries[0].ID)
+	assert.Empty(t, feed.Entries[0].Links)
+
+	entry := feed.Entries[1]
+	assert.Equal(t, "spotify:album:a1", entry.ID)
+	assert.Equal(t, "Alpha - First", entry.Title)
+	assert.Equal(t, "2024-03-01T00:00:00Z", entry.Published)
+	assert.Equal(t, []atomLink{{Href: "https://open.spotify.com/album/a1", Rel: "alternate", Type: "text/html"}}, entry.Links)
+	assert.Contains(t, entry.Content.Body, `<img src="https://i.scdn.co/image/a1"`)
+
+	// Making the feed again gives the exact same thing, so readers don't see
+	// changes that aren't there.
+	again, err := makeFeed(releases)
+	require.NoError(t, err)
+	assert.Equal(t, feedBytes, again)
+}
@@ -1,22 +1,30 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/zmb3/spotify"
 )
 
-func filterData(d *data, duration time.Duration) *data {
+// filterData keeps the albums released in w that the user hasn't saved. If w
+// runs up to now, albums released after it are kept separately in
+// upcomingAlbums, unless includeUpcoming is set, in which case they are kept
+// like any other recent album. Release dates that are only precise to the month or year are dealt
+// with according to policy.
+func filterData(d *data, w window, policy precisionPolicy, includeUpcoming bool) *data {
 	// We know that this is a strict subset of allAlbums, so it must have its
 	// length or less.
-	albums := make(map[string]spotify.SimpleAlbum, len(d.albums))
+	albums := make([]spotify.SimpleAlbum, 0, len(d.albums))
+	upcomingAlbums := make([]spotify.SimpleAlbum, 0)
+	seen := make(map[string]struct{}, len(d.albums))
+	numImprecise := 0
 
-	log.Println("Filtering albums")
+	slog.Info("Filtering albums", logKeyPhase, phaseFilter, "window", w)
 	// At this point, we've effectively flat mapped the artists to a slice of albums.
 	// Next, we want to filter out albums that we don't want.
 	// This means:
-	//      Albums outside the duration.
+	//      Albums outside the window.
 	//      Albums the user has already liked.
 	//  Duplicates (it is unclear sometimes why we get these from the Spotify API)
 	// Technically, we could have done this earlier in the above loop for
@@ -25,37 +33,141 @@ func filterData(d *data, duration time.Duration) *data {
 	// bottlenecked by Spotify API calls no matter how you look at it. An extra
 	// in-memory loop won't hurt anyone.
 	for _, album := range d.albums {
-		if _, ok := albums[album.ID.String()]; ok {
+		if _, ok := seen[album.ID.String()]; ok {
 			// Skip albums we've seen already.
-			// If we haven't seen it and the album passes the other filter conditions,
-			// we'll remember it for next time.
+			rejectedMetric.add(1, rejectReasonDuplicate)
 			continue
 		}
+		seen[album.ID.String()] = struct{}{}
 
-		releaseTime := album.ReleaseDateTime()
-		timeSinceRelease := time.Now().Sub(releaseTime)
-		// If the time since it was released is less than the specified duration,
-		// then the album was released in the the last `duration` time. Therefore,
-		// this album qualifies and should pass the filter.
-		isRecent := timeSinceRelease < duration
-		_, alreadySaved := d.savedAlbums[album.ID.String()]
+		if _, alreadySaved := d.savedAlbums[album.ID.String()]; alreadySaved {
+			rejectedMetric.add(1, rejectReasonSaved)
+			continue
+		}
 
-		if isRecent && !alreadySaved {
-			albums[album.ID.String()] = album
+		placement, imprecise := placeRelease(album, w, policy)
+		if imprecise {
+			slog.Debug(
+				"Release date is imprecise",
+				logKeyPhase, phaseFilter,
+				logKeyAlbumID, album.ID,
+				"album", album.Name,
+				"release_date", album.ReleaseDate,
+				"precision", album.ReleaseDatePrecision,
+			)
+			numImprecise++
 		}
-	}
 
-	// Now we need to convert albums to a slice:
-	albumsSlice := make([]spotify.SimpleAlbum, 0, len(albums))
-	for _, album := range albums {
-		albumsSlice = append(albumsSlice, album)
+		switch {
+		case placement == releasedWithin:
+			albums = append(albums, album)
+		case placement == releasedAfter && w.upToNow && includeUpcoming:
+			// Anything released in the future is recent too, even if there's
+			// nothing to listen to yet.
+			albums = append(albums, album)
+		case placement == releasedAfter && w.upToNow:
+			upcomingAlbums = append(upcomingAlbums, album)
+			rejectedMetric.add(1, rejectReasonUpcoming)
+		case placement == releasedAfter || placement == releasedLater:
+			rejectedMetric.add(1, rejectReasonAfter)
+		default:
+			rejectedMetric.add(1, rejectReasonOld)
+		}
 	}
 
-	log.Println("Filtered albums")
+	if numImprecise > 0 {
+		slog.Info("Decided on albums with imprecise release dates", logKeyPhase, phaseFilter, "albums", numImprecise, "policy", policy)
+	}
+	slog.Info("Filtered albums", logKeyPhase, phaseFilter, "albums", len(albums), "upcoming", len(upcomingAlbums))
 
 	return &data{
-		albums:      albumsSlice,
-		savedAlbums: d.savedAlbums,
-		artists:     d.artists,
+		albums:         albums,
+		savedAlbums:    d.savedAlbums,
+		upcomingAlbums: upcomingAlbums,
+		artists:        d.artists,
+		artistGenres:   d.artistGenres,
+	}
+}
+
+// filterLikedTracks removes the tracks that the user already has in their
+// Liked Songs. If matchDuplicates is set, we also remove tracks that are the
+// same as a liked track according to trackKeys, e.g. the album version of a
+// single the user liked. It returns the number of tracks removed.
+//
+// The albums are gone through in order, like dedupTracks does, since which
+// tracks trackKeys considers the same depends on the order it sees them in.
+func filterLikedTracks(d *data, matchDuplicates bool) (map[spotify.ID][]spotify.SimpleTrack, int) {
+	trackKeys := newTrackKeys(d.isrcs)
+	likedKeys := make(map[string]struct{})
+	if matchDuplicates {
+		for _, album := range d.albums {
+			for _, track := range d.albumTracks[album.ID] {
+				if _, ok := d.likedTracks[track.ID]; ok {
+					likedKeys[trackKeys.key(track)] = struct{}{}
+				}
+			}
+		}
+	}
+
+	numRemoved := 0
+	albumTracks := make(map[spotify.ID][]spotify.SimpleTrack, len(d.albums))
+	for _, album := range d.albums {
+		tracks := d.albumTracks[album.ID]
+		remaining := make([]spotify.SimpleTrack, 0, len(tracks))
+		for _, track := range tracks {
+			_, liked := d.likedTracks[track.ID]
+			_, likedDuplicate := likedKeys[trackKeys.key(track)]
+			if liked || likedDuplicate {
+				numRemoved++
+				continue
+			}
+			remaining = append(remaining, track)
+		}
+		albumTracks[album.ID] = remaining
+	}
+
+	return albumTracks, numRemoved
+}
+
+// filterPlayedAlbums removes the albums for which at least threshold (a
+// fraction between 0 and 1) of their tracks show up in playedTracks. We can't
+// know whether a user has listened to something on another device or before
+// fangirl started keeping track, but this catches the common case of having
+// already played through a release. It returns the number of albums removed.
+func filterPlayedAlbums(d *data, playedTracks map[spotify.ID]time.Time, threshold float64) int {
+	albums := make([]spotify.SimpleAlbum, 0, len(d.albums))
+	for _, album := range d.albums {
+		tracks := d.albumTracks[album.ID]
+		if len(tracks) == 0 {
+			albums = append(albums, album)
+			continue
+		}
+
+		numPlayed := 0
+		for _, track := range tracks {
+			if _, ok := playedTracks[track.ID]; ok {
+				numPlayed++
+			}
+		}
+
+		if float64(numPlayed)/float64(len(tracks)) >= threshold {
+			slog.Debug(
+				"Skipping already played album",
+				logKeyPhase, phaseFilter,
+				logKeyAlbumID, album.ID,
+				"album", album.Name,
+				"played", numPlayed,
+				"tracks", len(tracks),
+			)
+			rejectedMetric.add(1, rejectReasonPlayed)
+			continue
+		}
+
+		albums = append(albums, album)
 	}
+
+	numRemoved := len(d.albums) - len(albums)
+	d.albums = albums
+
+	return numRemoved
 }
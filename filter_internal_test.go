@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify"
+)
+
+func TestFilterLikedTracks(t *testing.T) {
+	likedSingle := spotify.SimpleTrack{ID: "single-lead", Name: "Lead", Duration: 200_000}
+	albumLead := spotify.SimpleTrack{ID: "album-lead", Name: "Lead", Duration: 200_500}
+	albumOther := spotify.SimpleTrack{ID: "album-other", Name: "Other", Duration: 180_000}
+	likedOnAlbum := spotify.SimpleTrack{ID: "album-liked", Name: "Liked", Duration: 190_000}
+	withISRC := spotify.SimpleTrack{ID: "album-isrc", Name: "Renamed", Duration: 100_000}
+	likedWithISRC := spotify.SimpleTrack{ID: "single-isrc", Name: "Original", Duration: 300_000}
+
+	d := &data{
+		albums: []spotify.SimpleAlbum{{ID: "single"}, {ID: "album"}},
+		albumTracks: map[spotify.ID][]spotify.SimpleTrack{
+			"single": {likedSingle, likedWithISRC},
+			"album":  {albumLead, albumOther, likedOnAlbum, withISRC},
+		},
+		isrcs: map[spotify.ID]string{
+			"album-isrc":  "USABC1234567",
+			"single-isrc": "USABC1234567",
+		},
+		likedTracks: map[spotify.ID]struct{}{
+			"single-lead": {},
+			"album-liked": {},
+			"single-isrc": {},
+		},
+	}
+
+	testCases := []struct {
+		name            string
+		matchDuplicates bool
+		expected        map[spotify.ID][]spotify.SimpleTrack
+		removed         int
+	}{
+		{
+			name:            "liked tracks only",
+			matchDuplicates: false,
+			expected: map[spotify.ID][]spotify.SimpleTrack{
+				"single": {},
+				"album":  {albumLead, albumOther, withISRC},
+			},
+			removed: 3,
+		},
+		{
+			name:            "with duplicates of liked tracks",
+			matchDuplicates: true,
+			expected: map[spotify.ID][]spotify.SimpleTrack{
+				"single": {},
+				"album":  {albumOther},
+			},
+			removed: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		albumTracks, removed := filterLikedTracks(d, tc.matchDuplicates)
+		assert.Equal(t, tc.expected, albumTracks, tc.name)
+		assert.Equal(t, tc.removed, removed, tc.name)
+	}
+}
+
+func TestFilterLikedTracksIsDeterministic(t *testing.T) {
+	// Whether the last track is a duplicate depends on which of the liked ones
+	// is seen first, as the titles are clustered around the first duration
+	// seen. The albums decide that order.
+	d := &data{
+		albums: []spotify.SimpleAlbum{{ID: "first"}, {ID: "second"}, {ID: "third"}},
+		albumTracks: map[spotify.ID][]spotify.SimpleTrack{
+			"first":  {{ID: "liked-1", Name: "Song", Duration: 200_000}},
+			"second": {{ID: "liked-2", Name: "Song", Duration: 201_500}},
+			"third":  {{ID: "unliked", Name: "Song", Duration: 203_000}},
+		},
+		isrcs: map[spotify.ID]string{},
+		likedTracks: map[spotify.ID]struct{}{
+			"liked-1": {},
+			"liked-2": {},
+		},
+	}
+
+	for i := 0; i < 20; i++ {
+		albumTracks, removed := filterLikedTracks(d, true)
+		assert.Equal(t, d.albumTracks["third"], albumTracks["third"])
+		assert.Equal(t, 2, removed)
+	}
+}
+
+func TestFilterPlayedAlbums(t *testing.T) {
+	playedAt := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	tracks := func(ids ...spotify.ID) []spotify.SimpleTrack {
+		tracks := make([]spotify.SimpleTrack, 0, len(ids))
+		for _, id := range ids {
+			tracks = append(tracks, spotify.SimpleTrack{ID: id})
+		}
+		return tracks
+	}
+
+	d := &data{
+		albums: []spotify.SimpleAlbum{{ID: "all-played"}, {ID: "half-played"}, {ID: "unplayed"}, {ID: "no-tracks"}},
+		albumTracks: map[spotify.ID][]spotify.SimpleTrack{
+			"all-played":  tracks("a1", "a2"),
+			"half-played": tracks("h1", "h2", "h3", "h4"),
+			"unplayed":    tracks("u1"),
+		},
+	}
+	playedTracks := map[spotify.ID]time.Time{"a1": playedAt, "a2": playedAt, "h1": playedAt, "h2": playedAt}
+
+	testCases := []struct {
+		threshold float64
+		expected  []spotify.ID
+	}{
+		{1, []spotify.ID{"half-played", "unplayed", "no-tracks"}},
+		{0.5, []spotify.ID{"unplayed", "no-tracks"}},
+		{0.6, []spotify.ID{"half-played", "unplayed", "no-tracks"}},
+	}
+
+	for _, tc := range testCases {
+		d := &data{albums: d.albums, albumTracks: d.albumTracks}
+		removed := filterPlayedAlbums(d, playedTracks, tc.threshold)
+
+		ids := make([]spotify.ID, 0, len(d.albums))
+		for _, album := range d.albums {
+			ids = append(ids, album.ID)
+		}
+		assert.Equal(t, tc.expected, ids, tc.threshold)
+		assert.Equal(t, 4-len(tc.expected), removed, tc.threshold)
+	}
+}
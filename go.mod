@@ -1,10 +1,11 @@
 module github.com/utagai/fangirl
 
-go 1.18
+go 1.21
 
 require (
 	github.com/stretchr/testify v1.8.0
 	github.com/zmb3/spotify v0.0.0-20201231194903-e2d01d9b8bd2
+	golang.org/x/crypto v0.31.0
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 )
 
@@ -12,7 +13,7 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/golang/protobuf v1.2.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/net v0.7.0 // indirect
+	golang.org/x/net v0.21.0 // indirect
 	google.golang.org/appengine v1.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
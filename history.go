@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// playedTracksGrace is how much longer than the start of the window we keep
+// plays around for. Singles often come out months ahead of their album and
+// can share track IDs with it, so plays from before the window still matter
+// for a while.
+const playedTracksGrace = 365 * 24 * time.Hour
+
+// syncHistory records the user's recently played tracks into s. Spotify only
+// remembers the last 50 plays, so anything older than that is lost unless this
+// runs often enough, which is why it is also exposed as its own command that
+// is cheap enough to run from a frequent cronjob. Plays from long enough
+// before windowStart that no release in the window could have them are
+// forgotten. It returns the number of new plays that were recorded.
+func syncHistory(client *SpotifyClient, s *localState, windowStart time.Time) (int, error) {
+	defer timePhase(phaseHistory)()
+
+	// 50 is the most the API will give us.
+	opts := spotify.RecentlyPlayedOptions{
+		Limit: 50,
+	}
+	if !s.HistorySyncedAt.IsZero() {
+		opts.AfterEpochMs = s.HistorySyncedAt.UnixNano() / int64(1e6)
+	}
+
+	items, err := client.PlayerRecentlyPlayedOpt(&opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get recently played tracks: %w", err)
+	}
+
+	if err := s.update(func(s *localState) {
+		s.recordPlays(items, windowStart.Add(-playedTracksGrace))
+	}); err != nil {
+		return 0, err
+	}
+
+	return len(items), nil
+}
+
+// recordPlays records the given plays, and forgets the plays from before
+// keepSince.
+func (s *localState) recordPlays(items []spotify.RecentlyPlayedItem, keepSince time.Time) {
+	for _, item := range items {
+		if lastPlayed, ok := s.PlayedTracks[item.Track.ID]; !ok || item.PlayedAt.After(lastPlayed) {
+			s.PlayedTracks[item.Track.ID] = item.PlayedAt
+		}
+		if item.PlayedAt.After(s.HistorySyncedAt) {
+			s.HistorySyncedAt = item.PlayedAt
+		}
+	}
+
+	for trackID, playedAt := range s.PlayedTracks {
+		if playedAt.Before(keepSince) {
+			delete(s.PlayedTracks, trackID)
+		}
+	}
+}
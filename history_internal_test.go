@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestSyncHistory(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	syncedAt := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	windowStart := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	var gotAfter string
+	client := newTestSpotifyClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAfter = r.URL.Query().Get("after")
+		fmt.Fprint(w, `{"items": [
+			{"track": {"id": "new"}, "played_at": "2024-03-16T12:00:00Z"},
+			{"track": {"id": "again"}, "played_at": "2024-03-16T11:00:00Z"}
+		]}`)
+	}))
+
+	st, err := loadState()
+	require.NoError(t, err)
+	require.NoError(t, st.update(func(s *localState) {
+		s.HistorySyncedAt = syncedAt
+		s.PlayedTracks["again"] = syncedAt
+		s.PlayedTracks["ancient"] = windowStart.Add(-playedTracksGrace - time.Hour)
+	}))
+
+	numPlays, err := syncHistory(client, st, windowStart)
+	require.NoError(t, err)
+	assert.Equal(t, 2, numPlays)
+	assert.Equal(t, fmt.Sprint(syncedAt.UnixNano()/int64(1e6)), gotAfter)
+
+	// What's on disk has the new plays, and not the ones too old to matter.
+	saved, err := loadState()
+	require.NoError(t, err)
+	assert.Equal(t, map[spotify.ID]time.Time{
+		"new":   time.Date(2024, 3, 16, 12, 0, 0, 0, time.UTC),
+		"again": time.Date(2024, 3, 16, 11, 0, 0, 0, time.UTC),
+	}, saved.PlayedTracks)
+	assert.Equal(t, time.Date(2024, 3, 16, 12, 0, 0, 0, time.UTC), saved.HistorySyncedAt)
+	assert.Equal(t, saved.PlayedTracks, st.PlayedTracks)
+}
+
+func TestRecordPlaysKeepsTheLatestPlay(t *testing.T) {
+	st := &localState{PlayedTracks: map[spotify.ID]time.Time{}}
+	earlier := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Hour)
+
+	st.recordPlays([]spotify.RecentlyPlayedItem{
+		{Track: spotify.SimpleTrack{ID: "track"}, PlayedAt: later},
+		{Track: spotify.SimpleTrack{ID: "track"}, PlayedAt: earlier},
+	}, time.Time{})
+
+	assert.Equal(t, map[spotify.ID]time.Time{"track": later}, st.PlayedTracks)
+	assert.Equal(t, later, st.HistorySyncedAt)
+}
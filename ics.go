@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+const (
+	icsDateFormat     = "20060102"
+	icsDateTimeFormat = "20060102T150405Z"
+	// icsMaxLineLength is the longest a line may be, in octets, before it
+	// has to be folded.
+	icsMaxLineLength = 75
+)
+
+// makeCalendar makes an iCalendar file with an all-day event for every date
+// that one of the albums was (or will be) released on. Albums without a
+// precise release date are left out, since there's no day to put them on.
+func makeCalendar(albums []spotify.SimpleAlbum, now time.Time) []byte {
+	dates := make([]string, 0)
+	albumsByDate := make(map[string][]spotify.SimpleAlbum)
+	for _, album := range albums {
+		if album.ReleaseDatePrecision != "day" {
+			continue
+		}
+		if _, ok := albumsByDate[album.ReleaseDate]; !ok {
+			dates = append(dates, album.ReleaseDate)
+		}
+		albumsByDate[album.ReleaseDate] = append(albumsByDate[album.ReleaseDate], album)
+	}
+	// These are all YYYY-MM-DD, so this sorts them chronologically.
+	sort.Strings(dates)
+
+	var sb strings.Builder
+	writeLine := func(name string, value string) {
+		writeICSLine(&sb, name+":"+value)
+	}
+
+	writeLine("BEGIN", "VCALENDAR")
+	writeLine("VERSION", "2.0")
+	writeLine("PRODID", "-//fangirl//fangirl//EN")
+	writeLine("CALSCALE", "GREGORIAN")
+	writeLine("X-WR-CALNAME", "fangirl releases")
+	for _, date := range dates {
+		releaseDay, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			// Spotify said it was day precision, so this should never
+			// happen.
+			continue
+		}
+		dateAlbums := orderAlbums(albumsByDate[date], orderArtist, nil)
+
+		summaries := make([]string, 0, len(dateAlbums))
+		descriptions := make([]string, 0, len(dateAlbums))
+		for _, album := range dateAlbums {
+			summary := album.Name
+			if artists := artistNames(album); artists != "" {
+				summary = fmt.Sprintf("%s - %s", artists, album.Name)
+			}
+			summaries = append(summaries, summary)
+			descriptions = append(descriptions, fmt.Sprintf(
+				"%s (%s) %s", summary, album.AlbumType, album.ExternalURLs["spotify"],
+			))
+		}
+
+		writeLine("BEGIN", "VEVENT")
+		// There's one event per date, so the date makes for a UID that stays
+		// the same across exports.
+		writeLine("UID", releaseDay.Format(icsDateFormat)+"@fangirl")
+		writeLine("DTSTAMP", now.UTC().Format(icsDateTimeFormat))
+		writeLine("DTSTART;VALUE=DATE", releaseDay.Format(icsDateFormat))
+		writeLine("DTEND;VALUE=DATE", releaseDay.AddDate(0, 0, 1).Format(icsDateFormat))
+		if len(dateAlbums) == 1 {
+			writeLine("SUMMARY", escapeICSText(summaries[0]))
+			if url := dateAlbums[0].ExternalURLs["spotify"]; url != "" {
+				writeLine("URL", url)
+			}
+		} else {
+			writeLine("SUMMARY", escapeICSText(fmt.Sprintf("%d releases: %s", len(dateAlbums), strings.Join(summaries, ", "))))
+		}
+		writeLine("DESCRIPTION", escapeICSText(strings.Join(descriptions, "\n")))
+		writeLine("TRANSP", "TRANSPARENT")
+		writeLine("END", "VEVENT")
+	}
+	writeLine("END", "VCALENDAR")
+
+	return []byte(sb.String())
+}
+
+// writeCalendar writes the calendar of both the albums that are out and the
+// upcoming ones to path.
+func writeCalendar(path string, albums []spotify.SimpleAlbum, upcomingAlbums []spotify.SimpleAlbum) error {
+	allAlbums := make([]spotify.SimpleAlbum, 0, len(albums)+len(upcomingAlbums))
+	allAlbums = append(allAlbums, albums...)
+	allAlbums = append(allAlbums, upcomingAlbums...)
+	if err := writeFileAtomically(path, makeCalendar(allAlbums, time.Now()), 0644); err != nil {
+		return fmt.Errorf("failed to write the calendar: %w", err)
+	}
+
+	return nil
+}
+
+var icsTextEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`;`, `\;`,
+	`,`, `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+func escapeICSText(s string) string {
+	return icsTextEscaper.Replace(s)
+}
+
+// writeICSLine writes a content line, folding it as the RFC asks: lines longer
+// than 75 octets are split, with every continuation starting with a space.
+// We're careful not to split in the middle of a UTF-8 sequence.
+func writeICSLine(sb *strings.Builder, line string) {
+	limit := icsMaxLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isUTF8Start(line[cut]) {
+			cut--
+		}
+		sb.WriteString(line[:cut])
+		sb.WriteString("\r\n ")
+		line = line[cut:]
+		// The leading space counts towards the limit.
+		limit = icsMaxLineLength - 1
+	}
+	sb.WriteString(line)
+	sb.WriteString("\r\n")
+}
+
+func isUTF8Start(b byte) bool {
+	return b&0xC0 != 0x80
+}
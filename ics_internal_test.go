@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify"
+)
+
+func TestMakeCalendar(t *testing.T) {
+	makeAlbum := func(id, artist, releaseDate, precision string) spotify.SimpleAlbum {
+		return spotify.SimpleAlbum{
+			ID:                   spotify.ID(id),
+			Name:                 id,
+			Artists:              []spotify.SimpleArtist{{Name: artist}},
+			AlbumType:            "album",
+			ReleaseDate:          releaseDate,
+			ReleaseDatePrecision: precision,
+			ExternalURLs:         map[string]string{"spotify": "https://open.spotify.com/album/" + id},
+		}
+	}
+
+	albums := []spotify.SimpleAlbum{
+		makeAlbum("b1", "Beta, Inc.", "2024-03-02", "day"),
+		makeAlbum("a1", "Alpha", "2024-03-02", "day"),
+		makeAlbum("c1", "Gamma", "2024-03-01", "day"),
+		makeAlbum("d1", "Delta", "2024-03", "month"),
+		{ID: "e1", Name: "e1", AlbumType: "album", ReleaseDate: "2024-03-05", ReleaseDatePrecision: "day"},
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	calendar := string(makeCalendar(albums, now))
+
+	assert.True(t, strings.HasPrefix(calendar, "BEGIN:VCALENDAR\r\n"))
+	assert.True(t, strings.HasSuffix(calendar, "END:VCALENDAR\r\n"))
+	assert.Equal(t, 3, strings.Count(calendar, "BEGIN:VEVENT"))
+	assert.NotContains(t, calendar, "Delta")
+
+	// Events are in date order, with an event per date.
+	first, second := strings.Index(calendar, "UID:20240301@fangirl"), strings.Index(calendar, "UID:20240302@fangirl")
+	assert.True(t, first != -1 && second != -1 && first < second)
+
+	assert.Contains(t, calendar, "DTSTART;VALUE=DATE:20240302\r\nDTEND;VALUE=DATE:20240303\r\n")
+	assert.Contains(t, calendar, "SUMMARY:Gamma - c1\r\nURL:https://open.spotify.com/album/c1\r\n")
+	// An album without any artists is just its name.
+	assert.Contains(t, calendar, "SUMMARY:e1\r\n")
+	// Releases on the same day are escaped and folded into the one event.
+	unfolded := strings.ReplaceAll(calendar, "\r\n ", "")
+	assert.Contains(t, unfolded, `SUMMARY:2 releases: Alpha - a1\, Beta\, Inc. - b1`)
+	assert.Contains(t, unfolded, `DESCRIPTION:Alpha - a1 (album) https://open.spotify.com/album/a1\nBeta\, Inc. - b1`)
+
+	for _, line := range strings.Split(calendar, "\r\n") {
+		assert.LessOrEqual(t, len(line), icsMaxLineLength)
+	}
+}
+
+func TestWriteICSLineFoldsUTF8(t *testing.T) {
+	var sb strings.Builder
+	line := "SUMMARY:" + strings.Repeat("é", 100)
+	writeICSLine(&sb, line)
+
+	folded := sb.String()
+	for _, part := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(part), icsMaxLineLength)
+		assert.True(t, strings.ToValidUTF8(part, "?") == part)
+	}
+	assert.Equal(t, line, strings.ReplaceAll(strings.TrimSuffix(folded, "\r\n"), "\r\n ", ""))
+}
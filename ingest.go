@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/zmb3/spotify"
 )
@@ -13,51 +13,78 @@ type ingester struct {
 }
 
 type data struct {
-	artists     []spotify.SimpleArtist
-	albums      []spotify.SimpleAlbum
-	savedAlbums map[string]spotify.SavedAlbum
+	artists      []spotify.SimpleArtist
+	artistGenres map[spotify.ID][]string
+	albums       []spotify.SimpleAlbum
+	savedAlbums  map[string]spotify.SavedAlbum
+	// upcomingAlbums are the albums with release dates in the future, e.g.
+	// ones that are up for pre-save. These are only populated by filterData,
+	// and only if they aren't being treated like any other album.
+	upcomingAlbums []spotify.SimpleAlbum
+
+	// The fields below are only populated by IngestTracks, which is run
+	// after filtering. Fetching the tracks of every single album from
+	// every followed artist would take forever, so we only do it for the
+	// albums that actually made it through.
+	albumTracks map[spotify.ID][]spotify.SimpleTrack
+	isrcs       map[spotify.ID]string
+	likedTracks map[spotify.ID]struct{}
+	// albumPopularity is only populated when ordering by popularity, since
+	// that is the only thing that needs it.
+	albumPopularity map[spotify.ID]int
 }
 
 func (in *ingester) Ingest() (*data, error) {
-	log.Println("Fetching all followed artists")
-	artists, err := in.getArtists()
+	defer timePhase(phaseIngest)()
+
+	slog.Info("Fetching all followed artists", logKeyPhase, phaseIngest)
+	artists, artistGenres, err := in.getArtists()
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Fetched all followed artists")
+	slog.Info("Fetched all followed artists", logKeyPhase, phaseIngest, "artists", len(artists))
+	processedMetric.add(float64(len(artists)), processedArtists)
 
-	log.Println("Getting albums for artists")
+	slog.Info("Getting albums for artists", logKeyPhase, phaseIngest)
 	allAlbums, err := in.getAlbumsForArtists(artists)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Fetched albums for all artists")
+	slog.Info("Fetched albums for all artists", logKeyPhase, phaseIngest, "albums", len(allAlbums))
+	processedMetric.add(float64(len(allAlbums)), processedAlbums)
 
-	log.Println("Getting saved albums for user")
+	slog.Info("Getting saved albums for user", logKeyPhase, phaseIngest)
 	savedAlbums, err := in.getSavedAlbums()
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Got saved albums")
+	slog.Info("Got saved albums", logKeyPhase, phaseIngest, "albums", len(savedAlbums))
 
 	return &data{
-		artists:     artists,
-		albums:      allAlbums,
-		savedAlbums: savedAlbums,
+		artists:      artists,
+		artistGenres: artistGenres,
+		albums:       allAlbums,
+		savedAlbums:  savedAlbums,
 	}, nil
 }
 
-func (in *ingester) getArtists() ([]spotify.SimpleArtist, error) {
+func (in *ingester) getArtists() ([]spotify.SimpleArtist, map[spotify.ID][]string, error) {
 	// I didn't try super hard, but I also didn't find any better/cleaner way to
 	// use this API because FullArtistCursorPage does not implement
 	// spotify.pageable.
 	after := ""
 	numArtists := 0
 	artists := make([]spotify.SimpleArtist, 0)
+	// We only keep the SimpleArtists around, but the genres of the artists are
+	// useful for splitting playlists up.
+	artistGenres := make(map[spotify.ID][]string)
+	// We don't know how many artists there are until we get the first page.
+	progress := startProgress(phaseIngest, "Fetching followed artists", 0)
+	defer progress.finish()
 	for {
 		followedArtists, err := in.client.CurrentUsersFollowedArtistsOpt(-1, after)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get the followed artists: %w", err)
+			return nil, nil, fmt.Errorf("failed to get the followed artists: %w", err)
 		}
 
 		for _, artist := range followedArtists.Artists {
@@ -65,15 +92,17 @@ func (in *ingester) getArtists() ([]spotify.SimpleArtist, error) {
 
 			if _, ok := in.cfg.blacklistedArtists[artist.Name]; ok {
 				// If this is a blacklisted artist, then skip it.
-				log.Printf("\tSkipping blacklisted artist: %q", artist.Name)
+				slog.Info("Skipping blacklisted artist", logKeyPhase, phaseIngest, logKeyArtistID, artist.ID, "artist", artist.Name)
+				rejectedMetric.add(1, rejectReasonBlacklist)
 				continue
 			}
 
 			artists = append(artists, artist.SimpleArtist)
+			artistGenres[artist.ID] = artist.Genres
 		}
 
-		percentageDone := 100 * (float64(numArtists) / float64(followedArtists.Total))
-		log.Printf("\t(%f%% done) Fetching albums", percentageDone)
+		progress.setTotal(followedArtists.Total)
+		progress.add(len(followedArtists.Artists))
 		if numArtists >= followedArtists.Total {
 			break
 		}
@@ -81,7 +110,7 @@ func (in *ingester) getArtists() ([]spotify.SimpleArtist, error) {
 		after = followedArtists.Cursor.After
 	}
 
-	return artists, nil
+	return artists, artistGenres, nil
 }
 
 func (in *ingester) getAlbumsForArtists(artists []spotify.SimpleArtist) ([]spotify.SimpleAlbum, error) {
@@ -90,10 +119,11 @@ func (in *ingester) getAlbumsForArtists(artists []spotify.SimpleArtist) ([]spoti
 		Country: &countryCode,
 	}
 	allAlbums := make([]spotify.SimpleAlbum, 0)
+	progress := startProgress(phaseIngest, "Getting albums for artists", len(artists))
+	defer progress.finish()
 	// At this point we have a slice of artists. We want to, for each artist, get their albums.
-	for i, artist := range artists {
-		percentageDone := 100 * (float64(i) / float64(len(artists)))
-		log.Printf("(%f%% done) Getting albums for artist: %q", percentageDone, artist.Name)
+	for _, artist := range artists {
+		slog.Debug("Getting albums for artist", logKeyPhase, phaseIngest, logKeyArtistID, artist.ID, "artist", artist.Name)
 		simpleAlbumPage, err := in.client.GetArtistAlbumsOpt(
 			artist.ID,
 			&opts,
@@ -105,14 +135,8 @@ func (in *ingester) getAlbumsForArtists(artists []spotify.SimpleArtist) ([]spoti
 			return nil, fmt.Errorf("failed to get artist albums for %q: %w", artist.Name, err)
 		}
 
-		numAlbums := 0
 		for {
-			for _, album := range simpleAlbumPage.Albums {
-				numAlbums++
-				percentageDone := 100 * (float64(numAlbums) / float64(simpleAlbumPage.Total))
-				log.Printf("\tFetched %f%%", percentageDone)
-				allAlbums = append(allAlbums, album)
-			}
+			allAlbums = append(allAlbums, simpleAlbumPage.Albums...)
 
 			if err := in.client.NextSimpleAlbumPage(simpleAlbumPage); err == spotify.ErrNoMorePages {
 				break
@@ -120,6 +144,8 @@ func (in *ingester) getAlbumsForArtists(artists []spotify.SimpleArtist) ([]spoti
 				return nil, fmt.Errorf("failed to iterate to the next artist album page: %w", err)
 			}
 		}
+
+		progress.add(1)
 	}
 
 	return allAlbums, nil
@@ -136,22 +162,225 @@ func (in *ingester) getSavedAlbums() (map[string]spotify.SavedAlbum, error) {
 	}
 
 	savedAlbums := make(map[string]spotify.SavedAlbum, 0)
-	numAlbums := 0
+	progress := startProgress(phaseIngest, "Getting saved albums", savedAlbumsPage.Total)
+	defer progress.finish()
 	for {
 		for _, album := range savedAlbumsPage.Albums {
 			savedAlbums[album.ID.String()] = album
-			numAlbums++
 		}
+		progress.add(len(savedAlbumsPage.Albums))
 
 		if err := in.client.NextSavedAlbumPage(savedAlbumsPage); err == spotify.ErrNoMorePages {
 			break
 		} else if err != nil {
 			return nil, fmt.Errorf("failed to iterate to the next saved albums page: %w", err)
 		}
-
-		percentageDone := 100 * (float64(numAlbums) / float64(savedAlbumsPage.Total))
-		log.Printf("\tFetched %f%%", percentageDone)
 	}
 
 	return savedAlbums, nil
 }
+
+// IngestTracks fetches the tracks of the albums in d, along with their ISRCs
+// if we're deduplicating tracks across releases, and which of them the user
+// has already liked if we're skipping those. This is separate from Ingest
+// because it is only worth doing for albums that survived filterData.
+func (in *ingester) IngestTracks(d *data) error {
+	defer timePhase(phaseTracks)()
+
+	slog.Info("Getting tracks for albums", logKeyPhase, phaseTracks)
+	albumTracks, err := in.getAlbumTracks(d.albums)
+	if err != nil {
+		return err
+	}
+	slog.Info("Got tracks for albums", logKeyPhase, phaseTracks)
+
+	// The ISRCs are only used to find duplicates, and cost a pass over all
+	// the tracks to get.
+	if in.cfg.dedupTracks {
+		slog.Info("Getting ISRCs for tracks", logKeyPhase, phaseTracks)
+		isrcs, err := in.getISRCs(albumTracks)
+		if err != nil {
+			return err
+		}
+		slog.Info("Got ISRCs for tracks", logKeyPhase, phaseTracks, "isrcs", len(isrcs))
+		d.isrcs = isrcs
+	}
+
+	if in.cfg.skipLikedTracks {
+		slog.Info("Checking for tracks the user already liked", logKeyPhase, phaseTracks)
+		likedTracks, err := in.getLikedTracks(albumTracks)
+		if err != nil {
+			return err
+		}
+		slog.Info("Found tracks the user already liked", logKeyPhase, phaseTracks, "tracks", len(likedTracks))
+		d.likedTracks = likedTracks
+	}
+
+	d.albumTracks = albumTracks
+
+	if in.cfg.order == orderPopularity {
+		slog.Info("Getting album popularity", logKeyPhase, phaseTracks)
+		albumPopularity, err := in.getAlbumPopularity(d.albums)
+		if err != nil {
+			return err
+		}
+		slog.Info("Got album popularity", logKeyPhase, phaseTracks)
+
+		d.albumPopularity = albumPopularity
+	}
+
+	return nil
+}
+
+func (in *ingester) getAlbumTracks(albums []spotify.SimpleAlbum) (map[spotify.ID][]spotify.SimpleTrack, error) {
+	albumTracks := make(map[spotify.ID][]spotify.SimpleTrack, len(albums))
+	progress := startProgress(phaseTracks, "Getting tracks for albums", len(albums))
+	defer progress.finish()
+	for _, album := range albums {
+		albumTracksPage, err := in.client.GetAlbumTracks(album.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get album tracks for %q: %w", album.Name, err)
+		}
+
+		tracks := make([]spotify.SimpleTrack, 0, albumTracksPage.Total)
+		for {
+			tracks = append(tracks, albumTracksPage.Tracks...)
+
+			if err := in.client.NextSimpleTrackPage(albumTracksPage); err == spotify.ErrNoMorePages {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to iterate to the next album track page: %w", err)
+			}
+		}
+		albumTracks[album.ID] = tracks
+		processedMetric.add(float64(len(tracks)), processedTracks)
+
+		slog.Debug("Got album tracks", logKeyPhase, phaseTracks, logKeyAlbumID, album.ID, "tracks", len(tracks))
+		progress.add(1)
+	}
+
+	return albumTracks, nil
+}
+
+// getISRCs looks up the ISRC of every track in albumTracks. The album tracks
+// endpoint only gives us simplified tracks, which don't include external IDs,
+// so we have to go through the full track endpoint for these.
+func (in *ingester) getISRCs(albumTracks map[spotify.ID][]spotify.SimpleTrack) (map[spotify.ID]string, error) {
+	// This is the maximum number of IDs the tracks endpoint accepts.
+	const batchSize = 50
+
+	trackIDs := make([]spotify.ID, 0)
+	for _, tracks := range albumTracks {
+		for _, track := range tracks {
+			trackIDs = append(trackIDs, track.ID)
+		}
+	}
+
+	isrcs := make(map[spotify.ID]string, len(trackIDs))
+	progress := startProgress(phaseTracks, "Getting ISRCs for tracks", len(trackIDs))
+	defer progress.finish()
+	for start := 0; start < len(trackIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(trackIDs) {
+			end = len(trackIDs)
+		}
+
+		fullTracks, err := in.client.GetTracks(trackIDs[start:end]...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get full tracks: %w", err)
+		}
+
+		for _, track := range fullTracks {
+			// The API returns null for IDs it doesn't know about.
+			if track == nil {
+				continue
+			}
+			if isrc, ok := track.ExternalIDs["isrc"]; ok && isrc != "" {
+				isrcs[track.ID] = isrc
+			}
+		}
+
+		progress.add(end - start)
+	}
+
+	return isrcs, nil
+}
+
+// getLikedTracks returns the subset of the tracks in albumTracks that are in
+// the user's Liked Songs. Users can have tens of thousands of liked songs, so
+// rather than paging through all of them, we just ask Spotify about the tracks
+// we actually care about.
+func (in *ingester) getLikedTracks(albumTracks map[spotify.ID][]spotify.SimpleTrack) (map[spotify.ID]struct{}, error) {
+	// This is the maximum number of IDs the contains endpoint accepts.
+	const batchSize = 50
+
+	trackIDs := make([]spotify.ID, 0)
+	for _, tracks := range albumTracks {
+		for _, track := range tracks {
+			trackIDs = append(trackIDs, track.ID)
+		}
+	}
+
+	likedTracks := make(map[spotify.ID]struct{})
+	progress := startProgress(phaseTracks, "Checking for liked tracks", len(trackIDs))
+	defer progress.finish()
+	for start := 0; start < len(trackIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(trackIDs) {
+			end = len(trackIDs)
+		}
+
+		batch := trackIDs[start:end]
+		liked, err := in.client.UserHasTracks(batch...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for liked tracks: %w", err)
+		}
+
+		for i, isLiked := range liked {
+			if isLiked {
+				likedTracks[batch[i]] = struct{}{}
+			}
+		}
+
+		progress.add(end - start)
+	}
+
+	return likedTracks, nil
+}
+
+// getAlbumPopularity returns the popularity of each of the given albums. Like
+// ISRCs for tracks, this is only available from the full album endpoint.
+func (in *ingester) getAlbumPopularity(albums []spotify.SimpleAlbum) (map[spotify.ID]int, error) {
+	// This is the maximum number of IDs the albums endpoint accepts.
+	const batchSize = 20
+
+	albumPopularity := make(map[spotify.ID]int, len(albums))
+	progress := startProgress(phaseTracks, "Getting album popularity", len(albums))
+	defer progress.finish()
+	for start := 0; start < len(albums); start += batchSize {
+		end := start + batchSize
+		if end > len(albums) {
+			end = len(albums)
+		}
+
+		batch := make([]spotify.ID, 0, end-start)
+		for _, album := range albums[start:end] {
+			batch = append(batch, album.ID)
+		}
+
+		fullAlbums, err := in.client.GetAlbums(batch...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get full albums: %w", err)
+		}
+
+		for _, album := range fullAlbums {
+			if album != nil {
+				albumPopularity[album.ID] = album.Popularity
+			}
+		}
+
+		progress.add(end - start)
+	}
+
+	return albumPopularity, nil
+}
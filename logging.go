@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// These are the keys of the attributes that show up across many log lines.
+// Sticking to them makes it possible to e.g. follow an album through a run
+// with the JSON logs.
+const (
+	logKeyPhase    = "phase"
+	logKeyArtistID = "artist_id"
+	logKeyAlbumID  = "album_id"
+	logKeyAttempt  = "attempt"
+	logKeyError    = "err"
+)
+
+// These are the phases of a run, for logKeyPhase.
+const (
+	phaseIngest   = "ingest"
+	phaseFilter   = "filter"
+	phaseTracks   = "tracks"
+	phasePlaylist = "playlist"
+	phasePrune    = "prune"
+	phaseHistory  = "history"
+	phaseDigest   = "digest"
+	phaseFeed     = "feed"
+	phaseServe    = "serve"
+	phaseAuth     = "auth"
+	phaseMetrics  = "metrics"
+)
+
+// logFormat is the format the logs are written in.
+type logFormat string
+
+const (
+	logFormatText logFormat = "text"
+	logFormatJSON logFormat = "json"
+)
+
+func parseLogFormat(s string) (logFormat, error) {
+	switch format := logFormat(s); format {
+	case logFormatText, logFormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q, expected one of: %s, %s", s, logFormatText, logFormatJSON)
+	}
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, expected one of: debug, info, warn, error", s)
+	}
+
+	return level, nil
+}
+
+// setupLogging makes slog (and therefore the log package) write to w at the
+// given level and in the given format.
+func setupLogging(w io.Writer, level slog.Level, format logFormat) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch format {
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		handler = slog.NewTextHandler(w, opts)
+	}
+
+	slog.SetDefault(slog.New(&reportingHandler{Handler: handler}))
+}
+
+// fatal logs msg at the error level and exits, like log.Fatal. If a run is in
+// progress, its report is saved first.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+
+	record := slog.NewRecord(time.Now(), slog.LevelError, msg, 0)
+	record.Add(args...)
+	finishReport(errors.New(formatRecord(record)))
+
+	os.Exit(1)
+}
@@ -1,23 +1,151 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
 	start := time.Now()
 
-	cfg, err := getConfig()
+	flag.Usage = usage
+	name, args := splitCommand(os.Args[1:])
+	cfg, err := getConfig(args)
 	if err != nil {
-		log.Fatalf("failed to initialize a configuration: %v", err)
+		fatal("Failed to initialize a configuration", logKeyError, err)
 	}
 
-	log.Printf("Running with configuration: %s", cfg.String())
+	// The command used to come after the flags, e.g. fangirl -playlist
+	// releases serve, which still works.
+	args = flag.Args()
+	if name == "" {
+		name = defaultCommand
+		if len(args) != 0 {
+			name, args = args[0], args[1:]
+		}
+	}
+	cmd, ok := findCommand(name)
+	if !ok {
+		fatal("Unknown command, see fangirl -help", "command", name)
+	}
+
+	setupLogging(setupProgress(cfg.progressMode, os.Stderr), cfg.logLevel, cfg.logFormat)
+	if cmd.needsCredentials() {
+		if err := cfg.resolveCredentials(); err != nil {
+			fatal("Failed to initialize a configuration", logKeyError, err)
+		}
+	}
+	slog.Info("Running with configuration", "command", cmd.name, "config", cfg.String())
+
+	var client *SpotifyClient
+	if cmd.needsClient {
+		client, err = cfg.getSpotifyClient()
+		if err != nil {
+			fatal("Failed to get a Spotify API client", logKeyError, err)
+		}
+		reporter.countCalls(client.Calls)
+	}
+
+	cmd.run(cfg, client, args, start)
+}
+
+func runPlaylist(cfg *config, client *SpotifyClient, start time.Time) {
+	startReport("run", cfg, client, start)
+
+	st, err := loadState()
+	if err != nil {
+		fatal("Failed to load the state", logKeyError, err)
+	}
+
+	if err := syncPlaylistVisibility(client, cfg, st); err != nil {
+		fatal("Failed to update the visibility of playlists", logKeyError, err)
+	}
+
+	w := cfg.window(start)
+	data, err := collectReleases(cfg, client, st, w)
+	if err != nil {
+		fatal("Failed to collect the releases", logKeyError, err)
+	}
+
+	// At this point, we have all the albums we want to exist in our target playlist.
+	for _, album := range data.albums {
+		slog.Info(
+			"Found album",
+			logKeyAlbumID, album.ID,
+			"album", album.Name,
+			"artist", artistNames(album),
+		)
+	}
+	for _, album := range data.upcomingAlbums {
+		slog.Info(
+			"Found upcoming album",
+			logKeyAlbumID, album.ID,
+			"album", album.Name,
+			"artist", artistNames(album),
+			"release_date", album.ReleaseDate,
+		)
+	}
+
+	if cfg.icsPath != "" {
+		if err := writeCalendar(cfg.icsPath, data.albums, data.upcomingAlbums); err != nil {
+			fatal("Failed to write the calendar", logKeyError, err)
+		}
+	}
 
-	client, err := cfg.getSpotifyClient()
+	var numNew int
+	if err := st.update(func(s *localState) {
+		numNew = s.recordReleases(data.albums, start)
+	}); err != nil {
+		fatal("Failed to save the state", logKeyError, err)
+	}
+	slog.Info("Recorded new releases", logKeyPhase, phaseFeed, "releases", numNew)
+
+	playlists, err := makePlaylists(client, cfg, st, data, start)
+	// Even if we failed halfway through, we still want to report the
+	// playlists we did manage to create.
+	for _, playlist := range playlists {
+		reportPlaylist(playlist.ID, playlist.Name, playlistCreated)
+	}
 	if err != nil {
-		log.Fatalf("failed to get a Spotify API client: %v", err)
+		fatal("Failed to create the playlists", logKeyError, err)
+	}
+	// Only announce the releases once their playlists actually exist.
+	sendDigest(cfg, data.albums, w.start, w.last())
+
+	if cfg.feedPath != "" {
+		if err := writeFeed(cfg.feedPath, st); err != nil {
+			fatal("Failed to write the feed", logKeyError, err)
+		}
+	}
+
+	finishRun(cfg, start)
+	end := time.Now()
+
+	slog.Info(
+		"Finished",
+		"releases", len(data.albums),
+		"artists", len(data.artists),
+		"elapsed", end.Sub(start),
+		"api_calls", client.Calls(),
+	)
+}
+
+// collectReleases does all the reading and filtering that goes into figuring
+// out which releases belong in a playlist. It doesn't write anything to
+// Spotify, though it may record the listening history into st.
+func collectReleases(cfg *config, client *SpotifyClient, st *localState, w window) (*data, error) {
+	if cfg.recordHistory {
+		numPlays, err := syncHistory(client, st, w.start)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record the recently played history: %w", err)
+		}
+		slog.Info("Recorded new plays", logKeyPhase, phaseHistory, "plays", numPlays)
 	}
 
 	ingester := ingester{
@@ -27,21 +155,121 @@ func main() {
 
 	data, err := ingester.Ingest()
 	if err != nil {
-		log.Fatalf("failed to ingest data from Spotify: %v", err)
+		return nil, fmt.Errorf("failed to ingest data from Spotify: %w", err)
 	}
 
-	data = filterData(data, cfg.duration)
+	stopFilter := timePhase(phaseFilter)
+	data = filterData(data, w, cfg.precisionPolicy, cfg.includeUpcoming)
+	stopFilter()
 
-	// At this point, we have all the albums we want to exist in our target playlist.
-	for _, album := range data.albums {
-		log.Printf("Album: %q by %s", album.Name, album.Artists[0].Name)
+	if err := ingester.IngestTracks(data); err != nil {
+		return nil, fmt.Errorf("failed to ingest tracks from Spotify: %w", err)
 	}
 
-	if err := makePlaylist(client, cfg, data); err != nil {
-		log.Fatalf("failed to create the playlist: %v", err)
+	if cfg.playedThreshold > 0 {
+		stopFilter := timePhase(phaseFilter)
+		numPlayed := filterPlayedAlbums(data, st.PlayedTracks, cfg.playedThreshold)
+		stopFilter()
+		slog.Info("Skipped releases that were already played", logKeyPhase, phaseFilter, "releases", numPlayed)
 	}
 
-	end := time.Now()
+	return data, nil
+}
+
+// finishRun records a successful one-off run that started at start, writing
+// out the metrics if asked to and then saving its report. Failed runs just
+// exit, leaving the last success timestamp from the run before in the metrics
+// file, since a new file would only have this run's metrics in it and so no
+// last success at all. That means one-off runs never report a failure in
+// fangirl_runs_total, only serve does. The report goes last, so that it fails
+// along with the metrics.
+func finishRun(cfg *config, start time.Time) {
+	recordRun(start, nil)
+	if cfg.metricsFile != "" {
+		if err := writeMetricsFile(cfg.metricsFile); err != nil {
+			fatal("Failed to write the metrics", logKeyPhase, phaseMetrics, logKeyError, err)
+		}
+	}
+	finishReport(nil)
+}
+
+func runSyncHistory(cfg *config, client *SpotifyClient, start time.Time) {
+	startReport("history", cfg, client, start)
+
+	st, err := loadState()
+	if err != nil {
+		fatal("Failed to load the state", logKeyError, err)
+	}
+
+	numPlays, err := syncHistory(client, st, cfg.window(start).start)
+	if err != nil {
+		fatal("Failed to record the recently played history", logKeyError, err)
+	}
+
+	slog.Info("Recorded new plays", logKeyPhase, phaseHistory, "plays", numPlays, "played_tracks", len(st.PlayedTracks))
+	finishRun(cfg, start)
+}
+
+func runPrune(cfg *config, client *SpotifyClient, start time.Time) {
+	startReport("prune", cfg, client, start)
+
+	st, err := loadState()
+	if err != nil {
+		fatal("Failed to load the state", logKeyError, err)
+	}
+
+	playlist, ok := st.findManagedPlaylist(cfg.prunePlaylistID)
+	if !ok {
+		if cfg.prunePlaylistID == "" {
+			fatal("fangirl has not created any playlists to prune")
+		}
+		fatal("Playlist was not created by fangirl, refusing to prune it", "playlist_id", cfg.prunePlaylistID)
+	}
+
+	ingester := ingester{
+		client: client,
+		cfg:    cfg,
+	}
+
+	slog.Info("Getting saved albums for user", logKeyPhase, phaseIngest)
+	stopIngest := timePhase(phaseIngest)
+	savedAlbums, err := ingester.getSavedAlbums()
+	stopIngest()
+	if err != nil {
+		fatal("Failed to get the saved albums", logKeyError, err)
+	}
+	slog.Info("Got saved albums", logKeyPhase, phaseIngest, "albums", len(savedAlbums))
+
+	slog.Info("Pruning playlist", logKeyPhase, phasePrune, "playlist", playlist.Name)
+	reportPlaylist(playlist.ID, playlist.Name, playlistUpdated)
+	removedByReason, err := prunePlaylist(client, playlist.ID, allPruneReasons, savedAlbums, cfg.window(time.Now()), cfg.precisionPolicy)
+	if err != nil {
+		fatal("Failed to prune the playlist", logKeyError, err)
+	}
+
+	slog.Info(
+		"Pruned playlist",
+		logKeyPhase, phasePrune,
+		"liked_tracks", removedByReason[pruneReasonLiked],
+		"saved_album_tracks", removedByReason[pruneReasonSaved],
+		"aged_out_tracks", removedByReason[pruneReasonOld],
+	)
+	finishRun(cfg, start)
+}
+
+func runServe(cfg *config, client *SpotifyClient, _ time.Time) {
+	// The rolling playlist is meant to keep up with new releases, which a
+	// fixed window would never let it do.
+	if !cfg.since.IsZero() || !cfg.until.IsZero() {
+		fatal("-since and -until can't be used with serve")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := serve(ctx, cfg, client); err != nil {
+		fatal("Failed to serve", logKeyError, err)
+	}
 
-	log.Printf("Added %d releases (out of %d artists) in %v", len(data.albums), len(data.artists), end.Sub(start))
+	slog.Info("Shutting down", logKeyPhase, phaseServe)
 }
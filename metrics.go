@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsPath = "/metrics"
+
+// metricKind is the Prometheus type of a metric.
+type metricKind string
+
+const (
+	metricCounter metricKind = "counter"
+	metricGauge   metricKind = "gauge"
+)
+
+// metricFamily is a Prometheus metric along with all of its label values.
+// We only need a handful of counters and gauges, which isn't worth pulling in
+// the Prometheus client library for.
+type metricFamily struct {
+	name       string
+	help       string
+	kind       metricKind
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func newMetricFamily(name string, help string, kind metricKind, labelNames ...string) *metricFamily {
+	f := &metricFamily{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     make(map[string]*metricSeries),
+	}
+	allMetrics = append(allMetrics, f)
+
+	return f
+}
+
+// allMetrics is every metric fangirl has, in the order they are written out.
+var allMetrics []*metricFamily
+
+var (
+	apiRequestsMetric = newMetricFamily(
+		"fangirl_spotify_api_requests_total",
+		"HTTP requests made to Spotify, by endpoint and status code.",
+		metricCounter, "endpoint", "status",
+	)
+	apiRetriesMetric = newMetricFamily(
+		"fangirl_spotify_api_retries_total",
+		"Failed Spotify API calls that were retried.",
+		metricCounter,
+	)
+	rateLimitedMetric = newMetricFamily(
+		"fangirl_spotify_rate_limited_total",
+		"Requests that Spotify rate limited.",
+		metricCounter,
+	)
+	rateLimitWaitMetric = newMetricFamily(
+		"fangirl_spotify_rate_limit_wait_seconds_total",
+		"Time spent waiting for Spotify's rate limit to lift.",
+		metricCounter,
+	)
+	phaseDurationMetric = newMetricFamily(
+		"fangirl_phase_duration_seconds_total",
+		"Time spent in each phase of a run.",
+		metricCounter, "phase",
+	)
+	processedMetric = newMetricFamily(
+		"fangirl_processed_total",
+		"Artists, albums and tracks fetched from Spotify.",
+		metricCounter, "kind",
+	)
+	rejectedMetric = newMetricFamily(
+		"fangirl_rejected_albums_total",
+		"Albums that were left out of playlists, by reason.",
+		metricCounter, "reason",
+	)
+	runsMetric = newMetricFamily(
+		"fangirl_runs_total",
+		"Runs, by whether they succeeded.",
+		metricCounter, "result",
+	)
+	runDurationMetric = newMetricFamily(
+		"fangirl_run_duration_seconds",
+		"How long the last run took.",
+		metricGauge,
+	)
+	lastSuccessMetric = newMetricFamily(
+		"fangirl_last_success_timestamp_seconds",
+		"When the last successful run finished, as a Unix timestamp.",
+		metricGauge,
+	)
+)
+
+// These are the reasons albums get rejected, for rejectedMetric.
+const (
+	rejectReasonDuplicate = "duplicate"
+	rejectReasonBlacklist = "blacklisted"
+	rejectReasonSaved     = "saved"
+	rejectReasonOld       = "before_window"
+	rejectReasonAfter     = "after_window"
+	rejectReasonUpcoming  = "upcoming"
+	rejectReasonPlayed    = "played"
+)
+
+// These are the kinds of things we fetch from Spotify, for processedMetric.
+const (
+	processedArtists = "artists"
+	processedAlbums  = "albums"
+	processedTracks  = "tracks"
+)
+
+func (f *metricFamily) getSeries(labelValues []string) *metricSeries {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.name, len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// add adds v to the series with the given label values.
+func (f *metricFamily) add(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.getSeries(labelValues).value += v
+}
+
+// set sets the series with the given label values to v.
+func (f *metricFamily) set(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.getSeries(labelValues).value = v
+}
+
+// values returns the value of every series, keyed by their label values
+// joined with commas.
+func (f *metricFamily) values() map[string]float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	values := make(map[string]float64, len(f.series))
+	for _, s := range f.series {
+		values[strings.Join(s.labelValues, ",")] = s.value
+	}
+
+	return values
+}
+
+// write writes the metric out in the Prometheus text format.
+func (f *metricFamily) write(w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind); err != nil {
+		return err
+	}
+
+	// Metrics without labels always have a value, even if it's just 0.
+	if len(f.labelNames) == 0 && len(f.series) == 0 {
+		_, err := fmt.Fprintf(w, "%s 0\n", f.name)
+		return err
+	}
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+
+		var labels strings.Builder
+		for i, name := range f.labelNames {
+			if i == 0 {
+				labels.WriteString("{")
+			} else {
+				labels.WriteString(",")
+			}
+			labels.WriteString(fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(s.labelValues[i])))
+			if i == len(f.labelNames)-1 {
+				labels.WriteString("}")
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", f.name, labels.String(), strconv.FormatFloat(s.value, 'g', -1, 64)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// labelValueEscaper escapes label values the way the Prometheus text format
+// wants them.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes every metric out in the Prometheus text format.
+func writeMetrics(w io.Writer) error {
+	for _, f := range allMetrics {
+		if err := f.write(w); err != nil {
+			return fmt.Errorf("failed to write metric %s: %w", f.name, err)
+		}
+	}
+
+	return nil
+}
+
+// writeMetricsFile writes every metric to path, in a way that is safe for the
+// node exporter's textfile collector to read at any time.
+func writeMetricsFile(path string) error {
+	var sb strings.Builder
+	if err := writeMetrics(&sb); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomically(path, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write the metrics: %w", err)
+	}
+
+	return nil
+}
+
+// timePhase starts timing a phase, adding the time spent in it to the metrics
+// once the returned function is called.
+func timePhase(phase string) func() {
+	start := time.Now()
+	return func() {
+		phaseDurationMetric.add(time.Since(start).Seconds(), phase)
+	}
+}
+
+// recordRun records how a run that started at start went.
+func recordRun(start time.Time, err error) {
+	end := time.Now()
+	runDurationMetric.set(end.Sub(start).Seconds())
+	if err != nil {
+		runsMetric.add(1, "failure")
+		return
+	}
+
+	runsMetric.add(1, "success")
+	lastSuccessMetric.set(float64(end.Unix()))
+}
+
+// serveMetrics hosts the metrics on addr until ctx is cancelled.
+func serveMetrics(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+
+	return serveHTTP(ctx, addr, mux, fmt.Sprintf("http://%s%s", addr, metricsPath), phaseMetrics)
+}
+
+// metricsTransport counts the requests that go through it.
+type metricsTransport struct {
+	base http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := endpointLabel(req)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		apiRequestsMetric.add(1, endpoint, "error")
+		return nil, err
+	}
+	apiRequestsMetric.add(1, endpoint, strconv.Itoa(resp.StatusCode))
+
+	// zmb3/spotify waits out the rate limit by itself, for as long as this
+	// says, so this is the only place we get to see it happen.
+	if resp.StatusCode == http.StatusTooManyRequests {
+		rateLimitedMetric.add(1)
+		wait := 5 * time.Second
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		}
+		rateLimitWaitMetric.add(wait.Seconds())
+	}
+
+	return resp, nil
+}
+
+// endpointLabel turns the URL of req into something that can be used as a
+// label, by replacing the IDs in it with placeholders. Otherwise, there'd be a
+// series per artist.
+func endpointLabel(req *http.Request) string {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/v1"), "/"), "/")
+	for i := 1; i < len(segments); i++ {
+		switch segments[i-1] {
+		case "artists", "albums", "playlists", "users":
+			// Whatever comes after these is an ID, except for e.g. the
+			// user's own albums at /me/albums.
+			if i < 2 || segments[i-2] != "me" {
+				segments[i] = "{id}"
+			}
+		}
+	}
+
+	return req.Method + " /" + strings.Join(segments, "/")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricFamilyWrite(t *testing.T) {
+	f := &metricFamily{
+		name:       "fangirl_test_total",
+		help:       "A test metric.",
+		kind:       metricCounter,
+		labelNames: []string{"endpoint", "status"},
+		series:     make(map[string]*metricSeries),
+	}
+	f.add(1, "GET /me", "200")
+	f.add(2, "GET /me", "200")
+	f.add(1, "GET /a\"b\\c\nd", "500")
+	f.set(0.5, "GET /albums", "429")
+
+	var sb strings.Builder
+	require.NoError(t, f.write(&sb))
+	assert.Equal(
+		t,
+		`# HELP fangirl_test_total A test metric.
+# TYPE fangirl_test_total counter
+fangirl_test_total{endpoint="GET /a\"b\\c\nd",status="500"} 1
+fangirl_test_total{endpoint="GET /albums",status="429"} 0.5
+fangirl_test_total{endpoint="GET /me",status="200"} 3
+`,
+		sb.String(),
+	)
+
+	assert.Equal(t, map[string]float64{
+		"GET /me,200":         3,
+		"GET /albums,429":     0.5,
+		"GET /a\"b\\c\nd,500": 1,
+	}, f.values())
+}
+
+func TestMetricFamilyWriteWithoutLabels(t *testing.T) {
+	f := &metricFamily{
+		name:   "fangirl_test_seconds",
+		help:   "A test metric.",
+		kind:   metricGauge,
+		series: make(map[string]*metricSeries),
+	}
+
+	var sb strings.Builder
+	require.NoError(t, f.write(&sb))
+	assert.Equal(t, "# HELP fangirl_test_seconds A test metric.\n# TYPE fangirl_test_seconds gauge\nfangirl_test_seconds 0\n", sb.String())
+}
+
+func TestEndpointLabel(t *testing.T) {
+	testCases := []struct {
+		method   string
+		url      string
+		expected string
+	}{
+		{"GET", "https://api.spotify.com/v1/me/following?type=artist", "GET /me/following"},
+		{"GET", "https://api.spotify.com/v1/artists/0oSGxfWSnnOXhD2fKuz2Gy/albums", "GET /artists/{id}/albums"},
+		{"GET", "https://api.spotify.com/v1/me/albums?offset=50", "GET /me/albums"},
+		{"GET", "https://api.spotify.com/v1/albums?ids=a,b", "GET /albums"},
+		{"POST", "https://api.spotify.com/v1/users/someone/playlists", "POST /users/{id}/playlists"},
+		{"PUT", "https://api.spotify.com/v1/playlists/37i9dQZF1DXcBWIGoYBM5M/images", "PUT /playlists/{id}/images"},
+		{"POST", "https://accounts.spotify.com/api/token", "POST /api/token"},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		assert.Equal(t, tc.expected, endpointLabel(req), tc.url)
+	}
+}
+
+func TestMetricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/me/albums" {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	requestsBefore := apiRequestsMetric.values()
+	rateLimitedBefore := rateLimitedMetric.values()[""]
+	waitBefore := rateLimitWaitMetric.values()[""]
+
+	client := &http.Client{Transport: &metricsTransport{base: http.DefaultTransport}}
+	for _, path := range []string{"/v1/me", "/v1/me", "/v1/me/albums"} {
+		resp, err := client.Get(server.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	requests := apiRequestsMetric.values()
+	assert.Equal(t, 2.0, requests["GET /me,200"]-requestsBefore["GET /me,200"])
+	assert.Equal(t, 1.0, requests["GET /me/albums,429"]-requestsBefore["GET /me/albums,429"])
+	assert.Equal(t, 1.0, rateLimitedMetric.values()[""]-rateLimitedBefore)
+	assert.Equal(t, 3.0, rateLimitWaitMetric.values()[""]-waitBefore)
+}
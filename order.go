@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/zmb3/spotify"
+)
+
+// playlistOrder is the order in which releases are put into a playlist.
+type playlistOrder string
+
+const (
+	// orderNewest puts the most recent releases first.
+	orderNewest playlistOrder = "newest"
+	// orderOldest puts the least recent releases first.
+	orderOldest playlistOrder = "oldest"
+	// orderArtist sorts releases by the name of their primary artist.
+	orderArtist playlistOrder = "artist"
+	// orderType groups albums, then singles, then compilations.
+	orderType playlistOrder = "type"
+	// orderPopularity puts the most popular releases first.
+	orderPopularity playlistOrder = "popularity"
+	// orderInterleave takes one release from each artist in turn, so that no
+	// single prolific artist hogs the start of the playlist.
+	orderInterleave playlistOrder = "interleave"
+)
+
+var playlistOrders = []playlistOrder{
+	orderNewest,
+	orderOldest,
+	orderArtist,
+	orderType,
+	orderPopularity,
+	orderInterleave,
+}
+
+func parsePlaylistOrder(s string) (playlistOrder, error) {
+	for _, order := range playlistOrders {
+		if string(order) == s {
+			return order, nil
+		}
+	}
+
+	orderStrs := make([]string, 0, len(playlistOrders))
+	for _, order := range playlistOrders {
+		orderStrs = append(orderStrs, string(order))
+	}
+
+	return "", fmt.Errorf("unknown order %q, expected one of: %s", s, strings.Join(orderStrs, ", "))
+}
+
+// albumTypeRanks is the order that orderType puts album types in. Anything
+// else goes last.
+var albumTypeRanks = map[string]int{
+	"album":       0,
+	"single":      1,
+	"compilation": 2,
+}
+
+func albumTypeRank(album spotify.SimpleAlbum) int {
+	if rank, ok := albumTypeRanks[strings.ToLower(album.AlbumType)]; ok {
+		return rank
+	}
+
+	return len(albumTypeRanks)
+}
+
+func primaryArtistName(album spotify.SimpleAlbum) string {
+	if len(album.Artists) == 0 {
+		return ""
+	}
+
+	return strings.ToLower(album.Artists[0].Name)
+}
+
+// compareAlbumsNewest orders albums newest first. It never considers two
+// distinct albums equal, which is what makes every ordering built on top of it
+// deterministic.
+func compareAlbumsNewest(a, b spotify.SimpleAlbum) bool {
+	if aRelease, bRelease := a.ReleaseDateTime(), b.ReleaseDateTime(); !aRelease.Equal(bRelease) {
+		return aRelease.After(bRelease)
+	}
+	if aArtist, bArtist := primaryArtistName(a), primaryArtistName(b); aArtist != bArtist {
+		return aArtist < bArtist
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+
+	return a.ID < b.ID
+}
+
+// orderAlbums returns a copy of albums in the given order. popularity is only
+// needed for orderPopularity, and maps album IDs to their popularity.
+func orderAlbums(albums []spotify.SimpleAlbum, order playlistOrder, popularity map[spotify.ID]int) []spotify.SimpleAlbum {
+	ordered := make([]spotify.SimpleAlbum, len(albums))
+	copy(ordered, albums)
+
+	var less func(a, b spotify.SimpleAlbum) bool
+	switch order {
+	case orderOldest:
+		less = func(a, b spotify.SimpleAlbum) bool {
+			if aRelease, bRelease := a.ReleaseDateTime(), b.ReleaseDateTime(); !aRelease.Equal(bRelease) {
+				return aRelease.Before(bRelease)
+			}
+			return compareAlbumsNewest(a, b)
+		}
+	case orderArtist:
+		less = func(a, b spotify.SimpleAlbum) bool {
+			if aArtist, bArtist := primaryArtistName(a), primaryArtistName(b); aArtist != bArtist {
+				return aArtist < bArtist
+			}
+			return compareAlbumsNewest(a, b)
+		}
+	case orderType:
+		less = func(a, b spotify.SimpleAlbum) bool {
+			if aRank, bRank := albumTypeRank(a), albumTypeRank(b); aRank != bRank {
+				return aRank < bRank
+			}
+			return compareAlbumsNewest(a, b)
+		}
+	case orderPopularity:
+		less = func(a, b spotify.SimpleAlbum) bool {
+			if aPopularity, bPopularity := popularity[a.ID], popularity[b.ID]; aPopularity != bPopularity {
+				return aPopularity > bPopularity
+			}
+			return compareAlbumsNewest(a, b)
+		}
+	case orderInterleave:
+		return interleaveArtists(ordered)
+	default:
+		less = compareAlbumsNewest
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return less(ordered[i], ordered[j])
+	})
+
+	return ordered
+}
+
+// interleaveArtists orders albums round-robin by primary artist. Each artist's
+// releases are taken newest first, and the artists with the newest releases go
+// first in each round.
+func interleaveArtists(albums []spotify.SimpleAlbum) []spotify.SimpleAlbum {
+	sort.SliceStable(albums, func(i, j int) bool {
+		return compareAlbumsNewest(albums[i], albums[j])
+	})
+
+	// Since albums is sorted newest first, artists ends up ordered by each
+	// artist's newest release.
+	artists := make([]string, 0)
+	byArtist := make(map[string][]spotify.SimpleAlbum)
+	for _, album := range albums {
+		artist := primaryArtistName(album)
+		if _, ok := byArtist[artist]; !ok {
+			artists = append(artists, artist)
+		}
+		byArtist[artist] = append(byArtist[artist], album)
+	}
+
+	interleaved := make([]spotify.SimpleAlbum, 0, len(albums))
+	for round := 0; len(interleaved) < len(albums); round++ {
+		for _, artist := range artists {
+			if round < len(byArtist[artist]) {
+				interleaved = append(interleaved, byArtist[artist][round])
+			}
+		}
+	}
+
+	return interleaved
+}
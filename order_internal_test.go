@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify"
+)
+
+func TestOrderAlbums(t *testing.T) {
+	makeAlbum := func(id, artist, albumType, releaseDate string) spotify.SimpleAlbum {
+		return spotify.SimpleAlbum{
+			ID:                   spotify.ID(id),
+			Name:                 id,
+			Artists:              []spotify.SimpleArtist{{Name: artist}},
+			AlbumType:            albumType,
+			ReleaseDate:          releaseDate,
+			ReleaseDatePrecision: "day",
+		}
+	}
+
+	a1 := makeAlbum("a1", "Alpha", "album", "2024-03-03")
+	a2 := makeAlbum("a2", "Alpha", "single", "2024-03-01")
+	a3 := makeAlbum("a3", "Alpha", "single", "2024-02-01")
+	b1 := makeAlbum("b1", "beta", "compilation", "2024-03-02")
+	b2 := makeAlbum("b2", "beta", "album", "2024-01-01")
+	c1 := makeAlbum("c1", "Gamma", "single", "2024-03-02")
+
+	albums := []spotify.SimpleAlbum{b2, a3, c1, a1, b1, a2}
+	popularity := map[spotify.ID]int{
+		"a1": 10,
+		"a2": 50,
+		"b1": 50,
+		"c1": 90,
+	}
+
+	testCases := []struct {
+		order    playlistOrder
+		expected []spotify.SimpleAlbum
+	}{
+		{
+			order: orderNewest,
+			// b1 and c1 were released on the same day, so we fall back to the
+			// artist name.
+			expected: []spotify.SimpleAlbum{a1, b1, c1, a2, a3, b2},
+		},
+		{
+			order:    orderOldest,
+			expected: []spotify.SimpleAlbum{b2, a3, a2, b1, c1, a1},
+		},
+		{
+			order:    orderArtist,
+			expected: []spotify.SimpleAlbum{a1, a2, a3, b1, b2, c1},
+		},
+		{
+			order:    orderType,
+			expected: []spotify.SimpleAlbum{a1, b2, c1, a2, a3, b1},
+		},
+		{
+			order: orderPopularity,
+			// a3 and b2 have no known popularity, so they go last.
+			expected: []spotify.SimpleAlbum{c1, b1, a2, a1, a3, b2},
+		},
+		{
+			order:    orderInterleave,
+			expected: []spotify.SimpleAlbum{a1, b1, c1, a2, b2, a3},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(string(tc.order), func(t *testing.T) {
+			assert.Equal(t, tc.expected, orderAlbums(albums, tc.order, popularity))
+
+			// The input order shouldn't matter.
+			reversed := make([]spotify.SimpleAlbum, 0, len(albums))
+			for i := len(albums) - 1; i >= 0; i-- {
+				reversed = append(reversed, albums[i])
+			}
+			assert.Equal(t, tc.expected, orderAlbums(reversed, tc.order, popularity))
+		})
+	}
+
+	// We shouldn't have messed with the slice we were given.
+	assert.Equal(t, []spotify.SimpleAlbum{b2, a3, c1, a1, b1, a2}, albums)
+}
@@ -1,79 +1,355 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/zmb3/spotify"
 )
 
-func makePlaylist(client *SpotifyClient, cfg *config, d *data) error {
-	// So we're ready to potentially make, and append to a target playlist.
+// playlistPlan is a playlist that makePlaylists would create.
+type playlistPlan struct {
+	bucket      string
+	name        string
+	description string
+	albums      []spotify.SimpleAlbum
+	trackIDs    []spotify.ID
+	start       time.Time
+	end         time.Time
+	// duplicates are the collapsed tracks that were kept in this playlist.
+	duplicates []duplicateGroup
+}
+
+// planPlaylists works out the playlists to create for the releases in d,
+// one for each bucket they are split into (see splitAlbums), which is just
+// the one unless splitting is enabled. It doesn't change anything on Spotify.
+func planPlaylists(client *SpotifyClient, cfg *config, d *data, runTime time.Time) (*spotify.PrivateUser, []playlistPlan, error) {
 	currentUser, err := client.CurrentUser()
 	if err != nil {
-		return fmt.Errorf("failed to get the current user: %w", err)
-	}
-
-	sinceTime := time.Now().Add(-1 * cfg.duration)
-	playlistSuffixFormat := "Jan _2, 2006"
-	playlistTimeSuffix := fmt.Sprintf(
-		"%s - %s",
-		sinceTime.Format(playlistSuffixFormat),
-		time.Now().Format(playlistSuffixFormat),
-	)
-	descriptionFormat := "Mon Jan _2, 3:04PM 2006"
-	playlist, err := client.CreatePlaylistForUser(
-		currentUser.ID,
-		fmt.Sprintf("%s (%s)", cfg.playlistName, playlistTimeSuffix),
-		fmt.Sprintf(
-			"Generated by fangirl - releases from %v to %v.",
-			sinceTime.Format(descriptionFormat),
-			time.Now().Format(descriptionFormat),
-		),
-		false,
-	)
+		return nil, nil, fmt.Errorf("failed to get the current user: %w", err)
+	}
+
+	profile := currentUser.DisplayName
+	if profile == "" {
+		profile = currentUser.ID
+	}
+
+	w := cfg.window(runTime)
+	// Tracks are selected across all the releases before they're split up, so
+	// that e.g. a single and its album are collapsed even when they end up in
+	// different playlists.
+	albumTracks, duplicates := selectTracks(cfg, d)
+	buckets := splitAlbums(cfg, d)
+	plans := make([]playlistPlan, 0, len(buckets))
+	for _, b := range buckets {
+		trackIDs := playlistTracks(cfg, b.albums, albumTracks, d.albumPopularity)
+
+		nameTemplate := cfg.nameTemplate
+		if bucketTemplate, ok := cfg.splitNameTemplates[b.key]; ok {
+			nameTemplate = bucketTemplate
+		}
+
+		templateData := playlistTemplateData{
+			Name:    b.name,
+			Bucket:  b.key,
+			Start:   w.start,
+			End:     w.last(),
+			RunTime: runTime,
+			Profile: profile,
+			Albums:  len(b.albums),
+			Tracks:  len(trackIDs),
+			Artists: countArtists(b.albums),
+		}
+		name, err := executePlaylistTemplate(nameTemplate, templateData)
+		if err != nil {
+			return nil, nil, err
+		}
+		description, err := executePlaylistTemplate(cfg.descriptionTemplate, templateData)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		plans = append(plans, playlistPlan{
+			bucket:      b.key,
+			name:        name,
+			description: description,
+			albums:      b.albums,
+			trackIDs:    trackIDs,
+			start:       w.start,
+			end:         w.last(),
+			duplicates:  bucketDuplicates(duplicates, b.albums),
+		})
+	}
+
+	return currentUser, plans, nil
+}
+
+// makePlaylists creates the playlists planned by planPlaylists, recording
+// each of them in st as soon as it exists.
+func makePlaylists(client *SpotifyClient, cfg *config, st *localState, d *data, runTime time.Time) ([]*spotify.FullPlaylist, error) {
+	defer timePhase(phasePlaylist)()
+
+	// So we're ready to potentially make, and append to a target playlist.
+	currentUser, plans, err := planPlaylists(client, cfg, d, runTime)
 	if err != nil {
-		return fmt.Errorf("failed to create the playlist: %w", err)
+		return nil, err
 	}
 
-	for i, album := range d.albums {
-		albumTracksPage, err := client.GetAlbumTracks(album.ID)
+	playlists := make([]*spotify.FullPlaylist, 0, len(plans))
+	for _, plan := range plans {
+		if plan.bucket != "" {
+			slog.Info("Making a playlist for bucket", logKeyPhase, phasePlaylist, "bucket", plan.bucket, "albums", len(plan.albums))
+		}
+
+		playlist, err := makePlaylist(client, cfg, st, currentUser.ID, plan.name, plan.description, plan.trackIDs)
+		if playlist != nil {
+			playlists = append(playlists, playlist)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to get album tracks: %w", err)
-		}
-
-		for {
-			batch := make([]spotify.ID, 0, 100)
-			for _, track := range albumTracksPage.Tracks {
-				batch = append(batch, track.ID)
-				if len(batch) == 100 {
-					if _, err := client.AddTracksToPlaylist(playlist.ID, batch...); err != nil {
-						return fmt.Errorf("failed to add tracks to the playlist: %w", err)
-					}
-					batch = batch[:0]
-				}
-			}
+			return playlists, err
+		}
+
+		// The cover is just cosmetic, so it's not worth failing over.
+		if err := setCover(client, cfg, playlist.ID, plan.albums, plan.start, plan.end); err != nil {
+			slog.Warn("Failed to set the cover of playlist", logKeyPhase, phasePlaylist, "playlist", plan.name, logKeyError, err)
+		}
+	}
+
+	return playlists, nil
+}
+
+// makePlaylist creates a playlist of trackIDs. If the playlist was created
+// but filling it in failed, it is returned along with the error.
+func makePlaylist(
+	client *SpotifyClient,
+	cfg *config,
+	st *localState,
+	userID string,
+	name string,
+	description string,
+	trackIDs []spotify.ID,
+) (*spotify.FullPlaylist, error) {
+	playlist, err := createPlaylist(client, cfg, st, userID, name, description)
+	if playlist == nil {
+		return nil, err
+	}
+	if err != nil {
+		return playlist, err
+	}
+
+	if _, err := addTracksToPlaylist(client, playlist.ID, trackIDs); err != nil {
+		return playlist, err
+	}
+
+	return playlist, nil
+}
+
+// createPlaylist creates an empty playlist with the visibility given by cfg,
+// and records it in st. If the playlist was created but its visibility
+// couldn't be set, it is returned along with the error, and
+// syncPlaylistVisibility will have another go at it on the next run.
+func createPlaylist(
+	client *SpotifyClient,
+	cfg *config,
+	st *localState,
+	userID string,
+	name string,
+	description string,
+) (*spotify.FullPlaylist, error) {
+	playlist, err := client.CreatePlaylistForUser(userID, name, description, cfg.public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the playlist: %w", err)
+	}
 
-			if len(batch) != 0 {
-				// If this happens, it means that we finished the batching loop above
-				// and had some tracks leftover. So let's not forget to add this to the
-				// playlist before we go to the next page of tracks.
-				if _, err := client.AddTracksToPlaylist(playlist.ID, batch...); err != nil {
-					return fmt.Errorf("failed to add tracks to the playlist: %w", err)
-				}
+	// Record the playlist straight away, so that we don't lose track of it
+	// if anything after this fails.
+	if err := st.update(func(s *localState) {
+		s.addManagedPlaylist(playlist, cfg.public, false)
+	}); err != nil {
+		return playlist, fmt.Errorf("failed to save the state: %w", err)
+	}
+
+	if cfg.collaborative {
+		if err := client.ChangePlaylistVisibility(playlist.ID, cfg.public, cfg.collaborative); err != nil {
+			return playlist, fmt.Errorf("failed to make the playlist collaborative: %w", err)
+		}
+		if err := st.update(func(s *localState) {
+			if managed, ok := s.findManagedPlaylist(playlist.ID); ok {
+				managed.Collaborative = true
 			}
+		}); err != nil {
+			return playlist, fmt.Errorf("failed to save the state: %w", err)
+		}
+	}
+
+	return playlist, nil
+}
+
+// syncPlaylistVisibility updates the visibility of the playlists fangirl
+// created before to match cfg, in case it changed since. Playlists that no
+// longer exist are forgotten about.
+func syncPlaylistVisibility(client *SpotifyClient, cfg *config, st *localState) error {
+	changed := make(map[spotify.ID]struct{})
+	gone := make(map[spotify.ID]struct{})
+	for _, playlist := range st.ManagedPlaylists {
+		if playlist.Public == cfg.public && playlist.Collaborative == cfg.collaborative {
+			continue
+		}
 
-			if err := client.NextSimpleTrackPage(albumTracksPage); err == spotify.ErrNoMorePages {
-				break
-			} else if err != nil {
-				return fmt.Errorf("failed to iterate to the next album track page: %w", err)
+		slog.Info(
+			"Changing the visibility of playlist",
+			logKeyPhase, phasePlaylist,
+			"playlist", playlist.Name,
+			"public", cfg.public,
+			"collaborative", cfg.collaborative,
+		)
+		err := client.ChangePlaylistVisibility(playlist.ID, cfg.public, cfg.collaborative)
+		if errors.Is(err, errPlaylistNotFound) {
+			slog.Info("Forgetting about deleted playlist", logKeyPhase, phasePlaylist, "playlist", playlist.Name)
+			gone[playlist.ID] = struct{}{}
+			continue
+		} else if err != nil {
+			// Don't let one bad playlist stop us.
+			slog.Warn("Failed to change the visibility of playlist", logKeyPhase, phasePlaylist, "playlist", playlist.Name, logKeyError, err)
+			continue
+		}
+		changed[playlist.ID] = struct{}{}
+	}
+
+	if len(changed) == 0 && len(gone) == 0 {
+		return nil
+	}
+
+	return st.update(func(s *localState) {
+		for id := range gone {
+			s.removeManagedPlaylist(id)
+		}
+		for i := range s.ManagedPlaylists {
+			if _, ok := changed[s.ManagedPlaylists[i].ID]; ok {
+				s.ManagedPlaylists[i].Public = cfg.public
+				s.ManagedPlaylists[i].Collaborative = cfg.collaborative
 			}
 		}
+	})
+}
 
-		percentageDone := 100 * (float64(i+1) / float64(len(d.albums)))
-		log.Printf("\t(%f%% done) Importing into playlist", percentageDone)
+func setCover(client *SpotifyClient, cfg *config, playlistID spotify.ID, albums []spotify.SimpleAlbum, start time.Time, end time.Time) error {
+	cover, err := makeCover(cfg, albums, start, end)
+	if err != nil {
+		return err
+	}
+	if cover == nil {
+		return nil
+	}
+
+	if err := client.SetPlaylistImage(playlistID, cover); err != nil {
+		return fmt.Errorf("failed to upload the cover: %w", err)
 	}
 
 	return nil
 }
+
+// countArtists returns the number of distinct primary artists of albums.
+func countArtists(albums []spotify.SimpleAlbum) int {
+	artists := make(map[spotify.ID]struct{})
+	for _, album := range albums {
+		if len(album.Artists) != 0 {
+			artists[album.Artists[0].ID] = struct{}{}
+		}
+	}
+
+	return len(artists)
+}
+
+// selectTracks decides which tracks from the albums in d should go into the
+// playlists, leaving out the liked ones and collapsing the duplicates between
+// all of the albums. The collapsed duplicates are reported, and returned.
+func selectTracks(cfg *config, d *data) (map[spotify.ID][]spotify.SimpleTrack, []duplicateGroup) {
+	albumTracks := d.albumTracks
+	if cfg.skipLikedTracks {
+		var numLiked int
+		albumTracks, numLiked = filterLikedTracks(d, cfg.dedupTracks)
+		slog.Info("Skipping tracks that are already liked", logKeyPhase, phasePlaylist, "tracks", numLiked)
+	}
+
+	var duplicates []duplicateGroup
+	if cfg.dedupTracks {
+		albumTracks, duplicates = dedupTracks(d.albums, albumTracks, d.isrcs, cfg.dedupPreference)
+		reportDuplicates(duplicates)
+	}
+
+	return albumTracks, duplicates
+}
+
+// playlistTracks returns the tracks selected by selectTracks from albums, in
+// the order they go into a playlist.
+func playlistTracks(cfg *config, albums []spotify.SimpleAlbum, albumTracks map[spotify.ID][]spotify.SimpleTrack, albumPopularity map[spotify.ID]int) []spotify.ID {
+	trackIDs := make([]spotify.ID, 0)
+	for _, album := range orderAlbums(albums, cfg.order, albumPopularity) {
+		for _, track := range albumTracks[album.ID] {
+			trackIDs = append(trackIDs, track.ID)
+		}
+	}
+
+	return trackIDs
+}
+
+// bucketDuplicates returns the duplicates whose kept track is on one of albums.
+func bucketDuplicates(duplicates []duplicateGroup, albums []spotify.SimpleAlbum) []duplicateGroup {
+	inBucket := make(map[spotify.ID]struct{}, len(albums))
+	for _, album := range albums {
+		inBucket[album.ID] = struct{}{}
+	}
+
+	bucketDuplicates := make([]duplicateGroup, 0)
+	for _, dup := range duplicates {
+		if _, ok := inBucket[dup.kept.album.ID]; ok {
+			bucketDuplicates = append(bucketDuplicates, dup)
+		}
+	}
+
+	return bucketDuplicates
+}
+
+// addTracksToPlaylist adds trackIDs to the end of a playlist, returning how
+// many of them made it in before any error.
+func addTracksToPlaylist(client *SpotifyClient, playlistID spotify.ID, trackIDs []spotify.ID) (int, error) {
+	// The API only lets us add 100 tracks at a time.
+	const batchSize = 100
+	progress := startProgress(phasePlaylist, "Importing into playlist", len(trackIDs))
+	defer progress.finish()
+	for start := 0; start < len(trackIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(trackIDs) {
+			end = len(trackIDs)
+		}
+
+		if _, err := client.AddTracksToPlaylist(playlistID, trackIDs[start:end]...); err != nil {
+			return start, fmt.Errorf("failed to add tracks to the playlist: %w", err)
+		}
+
+		progress.add(end - start)
+	}
+
+	return len(trackIDs), nil
+}
+
+func reportDuplicates(duplicates []duplicateGroup) {
+	for _, dup := range duplicates {
+		for _, dropped := range dup.dropped {
+			slog.Debug(
+				"Collapsed duplicate track",
+				logKeyPhase, phasePlaylist,
+				"track", dup.kept.track.Name,
+				logKeyAlbumID, dup.kept.album.ID,
+				"album", dup.kept.album.Name,
+				"dropped_album_id", dropped.album.ID,
+				"dropped_album", dropped.album.Name,
+			)
+			reportDuplicate(dup.kept.track.Name, dup.kept.album, dropped.album)
+		}
+	}
+	slog.Info("Collapsed duplicated tracks", logKeyPhase, phasePlaylist, "tracks", len(duplicates))
+}
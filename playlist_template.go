@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// defaultNameTemplate is what the playlist names looked like before they
+	// were configurable.
+	defaultNameTemplate = `{{.Name}} ({{.Start.Format "Jan _2, 2006"}} - {{.End.Format "Jan _2, 2006"}})`
+	// defaultDescriptionTemplate is what the playlist descriptions looked like
+	// before they were configurable.
+	defaultDescriptionTemplate = `Generated by fangirl - releases from {{.Start.Format "Mon Jan _2, 3:04PM 2006"}} to {{.End.Format "Mon Jan _2, 3:04PM 2006"}}.`
+)
+
+// playlistTemplateData is what playlist name and description templates have
+// access to.
+type playlistTemplateData struct {
+	// Name is the -playlist name, or the default name of the bucket when
+	// splitting.
+	Name string
+	// Bucket is the bucket the playlist is for, or empty when not splitting.
+	Bucket string
+	// Start and End are the first and last moments of the window of
+	// releases (see window.last).
+	Start time.Time
+	End   time.Time
+	// RunTime is when fangirl started running.
+	RunTime time.Time
+	// Profile is the display name of the Spotify user, or their ID if they
+	// don't have one.
+	Profile string
+	Albums  int
+	Tracks  int
+	Artists int
+}
+
+func parsePlaylistTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the %s template: %w", name, err)
+	}
+
+	// Catch mistakes like {{.Nmae}} now, rather than after we've spent half an
+	// hour talking to Spotify.
+	if _, err := executePlaylistTemplate(tmpl, playlistTemplateData{}); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+func executePlaylistTemplate(tmpl *template.Template, data playlistTemplateData) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("failed to execute the %s template: %w", tmpl.Name(), err)
+	}
+
+	return strings.TrimSpace(sb.String()), nil
+}
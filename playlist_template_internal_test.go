@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlaylistTemplate(t *testing.T) {
+	testCases := []struct {
+		name string
+		text string
+		err  bool
+	}{
+		{"default name", defaultNameTemplate, false},
+		{"default description", defaultDescriptionTemplate, false},
+		{"every field", "{{.Name}} {{.Bucket}} {{.Start}} {{.End}} {{.RunTime}} {{.Profile}} {{.Albums}} {{.Tracks}} {{.Artists}}", false},
+		{"plain text", "New releases", false},
+		{"syntax error", "{{.Name", true},
+		{"typo", "{{.Nmae}}", true},
+		{"bad function", "{{.Name | nope}}", true},
+	}
+
+	for _, tc := range testCases {
+		_, err := parsePlaylistTemplate("name", tc.text)
+		if tc.err {
+			assert.Error(t, err, tc.name)
+		} else {
+			assert.NoError(t, err, tc.name)
+		}
+	}
+}
+
+func TestExecutePlaylistTemplate(t *testing.T) {
+	data := playlistTemplateData{
+		Name:    "fangirl",
+		Bucket:  "singles",
+		Start:   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		End:     time.Date(2024, 2, 29, 15, 4, 0, 0, time.UTC),
+		RunTime: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC),
+		Profile: "Someone",
+		Albums:  3,
+		Tracks:  20,
+		Artists: 2,
+	}
+
+	testCases := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"default name", defaultNameTemplate, "fangirl (Feb  1, 2024 - Feb 29, 2024)"},
+		{"default description", defaultDescriptionTemplate, "Generated by fangirl - releases from Thu Feb  1, 12:00AM 2024 to Thu Feb 29, 3:04PM 2024."},
+		{"counts", "{{.Albums}} releases, {{.Tracks}} tracks by {{.Artists}} artists for {{.Profile}}", "3 releases, 20 tracks by 2 artists for Someone"},
+		{"bucket", "{{.Name}} [{{.Bucket}}]", "fangirl [singles]"},
+		{"surrounding whitespace", "  {{.Name}}\n", "fangirl"},
+	}
+
+	for _, tc := range testCases {
+		tmpl, err := parsePlaylistTemplate("name", tc.text)
+		require.NoError(t, err, tc.name)
+
+		text, err := executePlaylistTemplate(tmpl, data)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, text, tc.name)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressMode is how progress gets reported.
+type progressMode string
+
+const (
+	// progressAuto draws a bar when stderr is a terminal, and logs otherwise.
+	progressAuto progressMode = "auto"
+	// progressBar draws a progress bar on stderr.
+	progressBar progressMode = "bar"
+	// progressLog logs a summary of the progress every so often.
+	progressLog progressMode = "log"
+	// progressNone doesn't report progress at all.
+	progressNone progressMode = "none"
+)
+
+const (
+	// progressLogInterval is how often we log the progress when not drawing a
+	// bar. This is long enough to not flood cron mail, but short enough to
+	// tell that fangirl isn't stuck.
+	progressLogInterval = 30 * time.Second
+	// progressBarInterval is how often we redraw the bar.
+	progressBarInterval = 100 * time.Millisecond
+	progressBarWidth    = 30
+)
+
+func parseProgressMode(s string) (progressMode, error) {
+	switch mode := progressMode(s); mode {
+	case progressAuto, progressBar, progressLog, progressNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf(
+			"unknown progress mode %q, expected one of: %s, %s, %s, %s",
+			s, progressAuto, progressBar, progressLog, progressNone,
+		)
+	}
+}
+
+// progressReporter is where progress trackers report to. There is only ever
+// one of these, set up by setupProgress, since progress is tracked all over
+// the place and there is only the one terminal to draw on.
+type progressReporter struct {
+	mu   sync.Mutex
+	mode progressMode
+	out  io.Writer
+	// calls returns the number of API calls made so far, for working out the
+	// rate of calls.
+	calls func() int64
+	// drawn is whether there is a bar on the current line of out.
+	drawn bool
+}
+
+var reporter = &progressReporter{
+	mode:  progressNone,
+	out:   os.Stderr,
+	calls: func() int64 { return 0 },
+}
+
+// setupProgress decides how progress is reported from here on. The returned
+// writer should be used for anything else that goes to out, so that it doesn't
+// end up tacked onto the end of a bar.
+func setupProgress(mode progressMode, out *os.File) io.Writer {
+	if mode == progressAuto {
+		mode = progressLog
+		if info, err := out.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			mode = progressBar
+		}
+	}
+
+	reporter = &progressReporter{
+		mode:  mode,
+		out:   out,
+		calls: func() int64 { return 0 },
+	}
+
+	return reporter
+}
+
+// countCalls makes the reporter get the number of API calls made so far from
+// calls.
+func (r *progressReporter) countCalls(calls func() int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = calls
+}
+
+// Write writes p to the reporter's output, clearing any bar first. The bar
+// comes back the next time there is progress.
+func (r *progressReporter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clear()
+	return r.out.Write(p)
+}
+
+// draw replaces whatever bar is on the current line with line.
+func (r *progressReporter) draw(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// \r takes us back to the start of the line, and \033[K clears whatever
+	// was left over from last time.
+	fmt.Fprintf(r.out, "\r\033[K%s", line)
+	r.drawn = true
+}
+
+// done leaves the current bar where it is, so that the next thing written
+// goes on its own line.
+func (r *progressReporter) done() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.drawn {
+		fmt.Fprintln(r.out)
+		r.drawn = false
+	}
+}
+
+func (r *progressReporter) clear() {
+	if r.drawn {
+		fmt.Fprint(r.out, "\r\033[K")
+		r.drawn = false
+	}
+}
+
+func (r *progressReporter) callCount() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.calls()
+}
+
+// progressTracker tracks the progress of a single phase of a run, e.g.
+// fetching the albums of every followed artist.
+type progressTracker struct {
+	mu sync.Mutex
+
+	reporter    *progressReporter
+	description string
+	phase       string
+	done        int
+	total       int
+	startedAt   time.Time
+	startCalls  int64
+	reportedAt  time.Time
+	// now is only here so that tests can control time.
+	now func() time.Time
+}
+
+// startProgress starts tracking the progress of something that involves
+// total steps. The total can be changed later, for when it isn't known up
+// front.
+func startProgress(phase string, description string, total int) *progressTracker {
+	now := time.Now()
+	return &progressTracker{
+		reporter:    reporter,
+		description: description,
+		phase:       phase,
+		total:       total,
+		startedAt:   now,
+		startCalls:  reporter.callCount(),
+		reportedAt:  now,
+		now:         time.Now,
+	}
+}
+
+func (p *progressTracker) setTotal(total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.total = total
+}
+
+// add records that n more steps are done.
+func (p *progressTracker) add(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done += n
+	now := p.now()
+	switch p.reporter.mode {
+	case progressBar:
+		if now.Sub(p.reportedAt) >= progressBarInterval || p.done >= p.total {
+			p.drawBar(now)
+			p.reportedAt = now
+		}
+	case progressLog:
+		if now.Sub(p.reportedAt) >= progressLogInterval {
+			p.logSummary(now)
+			p.reportedAt = now
+		}
+	}
+}
+
+// finish stops tracking the progress, leaving the terminal ready for
+// whatever's next.
+func (p *progressTracker) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.reporter.mode == progressBar {
+		p.drawBar(p.now())
+		p.reporter.done()
+	}
+}
+
+// stats returns the fraction of the steps that are done, the API calls per
+// second, and the estimated time until all of the steps are done, if there's
+// enough to go on.
+func (p *progressTracker) stats(now time.Time) (float64, float64, time.Duration, bool) {
+	elapsed := now.Sub(p.startedAt)
+
+	fraction := 0.0
+	if p.total > 0 {
+		fraction = float64(p.done) / float64(p.total)
+		if fraction > 1 {
+			fraction = 1
+		}
+	}
+
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.reporter.callCount()-p.startCalls) / elapsed.Seconds()
+	}
+
+	if p.done == 0 || p.total == 0 {
+		return fraction, rate, 0, false
+	}
+	remaining := p.total - p.done
+	if remaining < 0 {
+		remaining = 0
+	}
+	eta := time.Duration(float64(elapsed) / float64(p.done) * float64(remaining))
+
+	return fraction, rate, eta, true
+}
+
+func (p *progressTracker) drawBar(now time.Time) {
+	fraction, rate, eta, ok := p.stats(now)
+
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	etaStr := "?"
+	if ok {
+		etaStr = eta.Round(time.Second).String()
+	}
+
+	p.reporter.draw(fmt.Sprintf(
+		"[%s] %3.0f%% %s (%d/%d, %.1f calls/s, ETA %s)",
+		bar, 100*fraction, p.description, p.done, p.total, rate, etaStr,
+	))
+}
+
+func (p *progressTracker) logSummary(now time.Time) {
+	fraction, rate, eta, ok := p.stats(now)
+
+	args := []any{
+		logKeyPhase, p.phase,
+		"done", p.done,
+		"total", p.total,
+		"percent", fmt.Sprintf("%.1f", 100*fraction),
+		"calls_per_second", fmt.Sprintf("%.1f", rate),
+	}
+	if ok {
+		args = append(args, "eta", eta.Round(time.Second))
+	}
+	slog.Info(p.description, args...)
+}
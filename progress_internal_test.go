@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressStats(t *testing.T) {
+	start := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	calls := int64(10)
+	p := &progressTracker{
+		reporter: &progressReporter{
+			mode:  progressNone,
+			calls: func() int64 { return calls },
+		},
+		total:      100,
+		startedAt:  start,
+		startCalls: calls,
+	}
+
+	_, _, _, ok := p.stats(start)
+	assert.False(t, ok, "there is no ETA before anything is done")
+
+	p.done = 25
+	calls += 50
+	fraction, rate, eta, ok := p.stats(start.Add(10 * time.Second))
+	require.True(t, ok)
+	assert.Equal(t, 0.25, fraction)
+	assert.Equal(t, 5.0, rate)
+	// A quarter took 10s, so the other three quarters should take 30s.
+	assert.Equal(t, 30*time.Second, eta)
+
+	// The total can be an underestimate.
+	p.done = 150
+	fraction, _, eta, ok = p.stats(start.Add(20 * time.Second))
+	require.True(t, ok)
+	assert.Equal(t, 1.0, fraction)
+	assert.Equal(t, time.Duration(0), eta)
+}
+
+func TestProgressBar(t *testing.T) {
+	var out bytes.Buffer
+	r := &progressReporter{
+		mode:  progressBar,
+		out:   &out,
+		calls: func() int64 { return 0 },
+	}
+
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	p := &progressTracker{
+		reporter:    r,
+		description: "Getting albums",
+		total:       4,
+		startedAt:   now,
+		reportedAt:  now,
+		now:         func() time.Time { return now },
+	}
+
+	// Too soon after the last draw to redraw.
+	p.add(1)
+	assert.Empty(t, out.String())
+
+	now = now.Add(time.Second)
+	p.add(1)
+	assert.Contains(t, out.String(), "\r\033[K[===============               ]  50% Getting albums (2/4")
+	assert.Contains(t, out.String(), "ETA 1s")
+
+	// Logs clear the bar rather than getting tacked onto it.
+	out.Reset()
+	r.Write([]byte("log line\n"))
+	assert.Equal(t, "\r\033[Klog line\n", out.String())
+
+	out.Reset()
+	p.add(2)
+	p.finish()
+	assert.Contains(t, out.String(), "100% Getting albums (4/4")
+	assert.Equal(t, byte('\n'), out.Bytes()[out.Len()-1])
+
+	// Nothing is left to clear once the bar is finished.
+	out.Reset()
+	r.Write([]byte("log line\n"))
+	assert.Equal(t, "log line\n", out.String())
+}
+
+func TestSetupProgressAuto(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "progress")
+	require.NoError(t, err)
+	defer f.Close()
+
+	setupProgress(progressAuto, f)
+	defer setupProgress(progressNone, os.Stderr)
+
+	assert.Equal(t, progressLog, reporter.mode, "a file isn't a terminal")
+}
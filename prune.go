@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/zmb3/spotify"
+)
+
+// pruneReason is why a track was removed from a managed playlist.
+type pruneReason string
+
+const (
+	pruneReasonLiked pruneReason = "liked"
+	pruneReasonSaved pruneReason = "album saved"
+	pruneReasonOld   pruneReason = "too old"
+)
+
+// allPruneReasons are all the reasons prunePlaylist can remove tracks for.
+var allPruneReasons = []pruneReason{pruneReasonLiked, pruneReasonSaved, pruneReasonOld}
+
+// prunePlaylist removes the tracks from a fangirl-managed playlist that no
+// longer need to be there: tracks that are now in the user's Liked Songs,
+// tracks from albums that are now saved, and tracks from releases that have
+// fallen out of the window. The idea is that the playlist can then be treated
+// as an inbox, rather than a snapshot. Only tracks that are there for one of
+// reasons are removed. It returns the number of tracks removed for each reason.
+func prunePlaylist(
+	client *SpotifyClient,
+	playlistID spotify.ID,
+	reasons []pruneReason,
+	savedAlbums map[string]spotify.SavedAlbum,
+	w window,
+	policy precisionPolicy,
+) (map[pruneReason]int, error) {
+	defer timePhase(phasePrune)()
+
+	playlistTracksPage, err := client.GetPlaylistTracks(playlistID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the playlist tracks: %w", err)
+	}
+
+	tracks := make([]spotify.FullTrack, 0, playlistTracksPage.Total)
+	for {
+		for _, playlistTrack := range playlistTracksPage.Tracks {
+			// Local files don't have IDs, and fangirl never adds them anyways.
+			if playlistTrack.IsLocal {
+				continue
+			}
+			tracks = append(tracks, playlistTrack.Track)
+		}
+
+		if err := client.NextPlaylistTrackPage(playlistTracksPage); err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to iterate to the next playlist track page: %w", err)
+		}
+	}
+
+	enabled := make(map[pruneReason]bool, len(reasons))
+	for _, reason := range reasons {
+		enabled[reason] = true
+	}
+
+	toRemove := make(map[spotify.ID]pruneReason)
+	for _, track := range tracks {
+		if _, ok := savedAlbums[track.Album.ID.String()]; ok && enabled[pruneReasonSaved] {
+			toRemove[track.ID] = pruneReasonSaved
+		} else if placement, _ := placeRelease(track.Album, w, policy); placement == releasedBefore && enabled[pruneReasonOld] {
+			toRemove[track.ID] = pruneReasonOld
+		}
+	}
+
+	// This is the maximum number of IDs the contains endpoint accepts.
+	const likedBatchSize = 50
+	for start := 0; start < len(tracks) && enabled[pruneReasonLiked]; start += likedBatchSize {
+		end := start + likedBatchSize
+		if end > len(tracks) {
+			end = len(tracks)
+		}
+
+		batch := make([]spotify.ID, 0, end-start)
+		for _, track := range tracks[start:end] {
+			batch = append(batch, track.ID)
+		}
+
+		liked, err := client.UserHasTracks(batch...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for liked tracks: %w", err)
+		}
+
+		for i, isLiked := range liked {
+			if _, ok := toRemove[batch[i]]; isLiked && !ok {
+				toRemove[batch[i]] = pruneReasonLiked
+			}
+		}
+	}
+
+	removedByReason := make(map[pruneReason]int)
+	trackIDs := make([]spotify.ID, 0, len(toRemove))
+	for _, track := range tracks {
+		reason, ok := toRemove[track.ID]
+		if !ok {
+			continue
+		}
+
+		slog.Debug("Pruning track", logKeyPhase, phasePrune, logKeyAlbumID, track.Album.ID, "track", track.Name, "reason", reason)
+		removedByReason[reason]++
+		trackIDs = append(trackIDs, track.ID)
+		// Removing a track removes every occurrence of it, so make sure we
+		// don't try to remove it twice.
+		delete(toRemove, track.ID)
+	}
+
+	// The API only lets us remove 100 tracks at a time.
+	const removeBatchSize = 100
+	for start := 0; start < len(trackIDs); start += removeBatchSize {
+		end := start + removeBatchSize
+		if end > len(trackIDs) {
+			end = len(trackIDs)
+		}
+
+		if _, err := client.RemoveTracksFromPlaylist(playlistID, trackIDs[start:end]...); err != nil {
+			return nil, fmt.Errorf("failed to remove tracks from the playlist: %w", err)
+		}
+	}
+
+	return removedByReason, nil
+}
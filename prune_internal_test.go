@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestPrunePlaylist(t *testing.T) {
+	w := window{
+		start: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		end:   time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	testCases := []struct {
+		name        string
+		trackID     spotify.ID
+		releaseDate string
+		precision   string
+		local       bool
+		savedAlbum  bool
+		liked       bool
+		expected    pruneReason
+	}{
+		{name: "recent", trackID: "keep", releaseDate: "2024-03-10", precision: "day"},
+		{name: "too old", trackID: "old", releaseDate: "2024-02-20", precision: "day", expected: pruneReasonOld},
+		{name: "imprecise but maybe recent", trackID: "month", releaseDate: "2024-03", precision: "month"},
+		{name: "album saved", trackID: "saved", releaseDate: "2024-03-10", precision: "day", savedAlbum: true, expected: pruneReasonSaved},
+		{name: "liked", trackID: "liked", releaseDate: "2024-03-10", precision: "day", liked: true, expected: pruneReasonLiked},
+		{name: "saved wins over liked", trackID: "both", releaseDate: "2024-03-10", precision: "day", savedAlbum: true, liked: true, expected: pruneReasonSaved},
+		{name: "local file", trackID: "", releaseDate: "2020-01-01", precision: "day", local: true},
+	}
+
+	items := make([]map[string]interface{}, 0, len(testCases))
+	savedAlbums := make(map[string]spotify.SavedAlbum)
+	liked := make(map[string]bool)
+	expectedRemoved := make([]string, 0)
+	expectedByReason := make(map[pruneReason]int)
+	for _, tc := range testCases {
+		albumID := "album-" + string(tc.trackID)
+		items = append(items, map[string]interface{}{
+			"is_local": tc.local,
+			"track": map[string]interface{}{
+				"id":   tc.trackID,
+				"name": tc.name,
+				"album": map[string]interface{}{
+					"id":                     albumID,
+					"release_date":           tc.releaseDate,
+					"release_date_precision": tc.precision,
+				},
+			},
+		})
+		if tc.savedAlbum {
+			savedAlbums[albumID] = spotify.SavedAlbum{}
+		}
+		liked[string(tc.trackID)] = tc.liked
+		if tc.expected != "" {
+			expectedRemoved = append(expectedRemoved, "spotify:track:"+string(tc.trackID))
+			expectedByReason[tc.expected]++
+		}
+	}
+
+	// Removing a track removes every copy of it, so a track that's in the
+	// playlist twice should only be removed once.
+	items = append(items, items[1])
+
+	var removed []string
+	likedChecks := 0
+	client := newTestSpotifyClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/playlists/playlist/tracks":
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "total": len(items)})
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/me/tracks/contains":
+			likedChecks++
+			result := make([]bool, 0)
+			for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+				result = append(result, liked[id])
+			}
+			json.NewEncoder(w).Encode(result)
+		case r.Method == http.MethodDelete && r.URL.Path == "/v1/playlists/playlist/tracks":
+			var body struct {
+				Tracks []struct {
+					URI string `json:"uri"`
+				} `json:"tracks"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			for _, track := range body.Tracks {
+				removed = append(removed, track.URI)
+			}
+			w.Write([]byte(`{"snapshot_id": "snapshot"}`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	removedByReason, err := prunePlaylist(client, "playlist", allPruneReasons, savedAlbums, w, precisionInclude)
+	require.NoError(t, err)
+	assert.Equal(t, expectedByReason, removedByReason)
+	assert.Equal(t, expectedRemoved, removed)
+
+	// Only aging out releases leaves everything else alone, without even
+	// looking for liked tracks.
+	removed, likedChecks = nil, 0
+	removedByReason, err = prunePlaylist(client, "playlist", []pruneReason{pruneReasonOld}, savedAlbums, w, precisionInclude)
+	require.NoError(t, err)
+	assert.Equal(t, map[pruneReason]int{pruneReasonOld: 1}, removedByReason)
+	assert.Equal(t, []string{"spotify:track:old"}, removed)
+	assert.Zero(t, likedChecks)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// maxRunReports is how many runs we keep reports for. Past this, the oldest
+// ones are deleted.
+const maxRunReports = 100
+
+// runReportTimeFormat is how reports are named. It sorts in time order, and
+// doesn't have any colons in it, which some filesystems don't like.
+const runReportTimeFormat = "20060102T150405Z"
+
+// runReport is a summary of a single run, saved for later inspection.
+type runReport struct {
+	Command    string    `json:"command"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Succeeded  bool      `json:"succeeded"`
+	Error      string    `json:"error,omitempty"`
+	// Config is the configuration the run used, with the secrets left out.
+	Config string `json:"config"`
+	// PhaseSeconds is how long the run spent in each phase.
+	PhaseSeconds map[string]float64 `json:"phaseSeconds"`
+	// APICalls is how many Spotify API calls the run made, including
+	// retries.
+	APICalls int64 `json:"apiCalls"`
+	// APIRequests counts the HTTP requests to Spotify by endpoint, then by
+	// status code. Unlike APICalls, this includes the requests zmb3/spotify
+	// makes by itself when rate limited.
+	APIRequests          map[string]map[string]int `json:"apiRequests"`
+	Retries              int                       `json:"retries"`
+	RateLimited          int                       `json:"rateLimited"`
+	RateLimitWaitSeconds float64                   `json:"rateLimitWaitSeconds"`
+	// Processed counts the artists, albums and tracks fetched from Spotify.
+	Processed map[string]int `json:"processed"`
+	// Rejected counts the albums that were left out, by reason.
+	Rejected  map[string]int      `json:"rejected"`
+	Playlists []runReportPlaylist `json:"playlists"`
+	// Duplicates are the tracks that were left out because they're also on
+	// another release, see dedupTracks.
+	Duplicates []runReportDuplicate `json:"duplicates"`
+	Warnings   []string             `json:"warnings"`
+
+	client *SpotifyClient
+	// before and startCalls are what the metrics and call count were at the
+	// start of the run, so that we only report on this run.
+	before     map[*metricFamily]metricValues
+	startCalls int64
+}
+
+// metricValues are the values of a metric family, as returned by values.
+type metricValues = map[string]float64
+
+// runReportPlaylist is a playlist that a run touched.
+type runReportPlaylist struct {
+	ID     spotify.ID `json:"id"`
+	Name   string     `json:"name"`
+	URL    string     `json:"url"`
+	Action string     `json:"action"`
+}
+
+// runReportDuplicate is a track that was only kept from one of the releases
+// it's on.
+type runReportDuplicate struct {
+	Track          string     `json:"track"`
+	KeptAlbumID    spotify.ID `json:"keptAlbumId"`
+	KeptAlbum      string     `json:"keptAlbum"`
+	DroppedAlbumID spotify.ID `json:"droppedAlbumId"`
+	DroppedAlbum   string     `json:"droppedAlbum"`
+}
+
+// These are the things a run can do to a playlist, for runReportPlaylist.
+const (
+	playlistCreated = "created"
+	playlistUpdated = "updated"
+)
+
+var (
+	// reportMu guards currentReport, which is the report of the run in
+	// progress, if any. Runs don't overlap, but logs can come from anywhere.
+	reportMu      sync.Mutex
+	currentReport *runReport
+)
+
+// startReport starts reporting on a run of command that started at start.
+// Everything the metrics count from here on goes into the report.
+func startReport(command string, cfg *config, client *SpotifyClient, start time.Time) {
+	before := make(map[*metricFamily]metricValues, len(allMetrics))
+	for _, f := range allMetrics {
+		before[f] = f.values()
+	}
+
+	reportMu.Lock()
+	defer reportMu.Unlock()
+
+	currentReport = &runReport{
+		Command:    command,
+		StartedAt:  start,
+		Config:     cfg.String(),
+		Playlists:  make([]runReportPlaylist, 0),
+		Duplicates: make([]runReportDuplicate, 0),
+		Warnings:   make([]string, 0),
+		client:     client,
+		before:     before,
+		startCalls: client.Calls(),
+	}
+}
+
+// reportPlaylist records that the current run did something to a playlist.
+func reportPlaylist(id spotify.ID, name string, action string) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+
+	if currentReport == nil {
+		return
+	}
+	for _, playlist := range currentReport.Playlists {
+		if playlist.ID == id {
+			return
+		}
+	}
+
+	currentReport.Playlists = append(currentReport.Playlists, runReportPlaylist{
+		ID:     id,
+		Name:   name,
+		URL:    playlistURL(id),
+		Action: action,
+	})
+}
+
+// reportDuplicate records that the current run kept track from the kept album,
+// and left out its copy on the dropped one.
+func reportDuplicate(track string, kept spotify.SimpleAlbum, dropped spotify.SimpleAlbum) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+
+	if currentReport != nil {
+		currentReport.Duplicates = append(currentReport.Duplicates, runReportDuplicate{
+			Track:          track,
+			KeptAlbumID:    kept.ID,
+			KeptAlbum:      kept.Name,
+			DroppedAlbumID: dropped.ID,
+			DroppedAlbum:   dropped.Name,
+		})
+	}
+}
+
+// reportWarning records a warning in the current run's report.
+func reportWarning(warning string) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+
+	if currentReport != nil {
+		currentReport.Warnings = append(currentReport.Warnings, warning)
+	}
+}
+
+// finishReport finishes the current run's report, and saves it. err is why the
+// run failed, if it did.
+func finishReport(err error) {
+	reportMu.Lock()
+	r := currentReport
+	currentReport = nil
+	reportMu.Unlock()
+
+	if r == nil {
+		return
+	}
+
+	r.FinishedAt = time.Now()
+	r.Succeeded = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.APICalls = r.client.Calls() - r.startCalls
+
+	delta := func(f *metricFamily) metricValues {
+		values := f.values()
+		for key, value := range r.before[f] {
+			values[key] -= value
+			if values[key] == 0 {
+				delete(values, key)
+			}
+		}
+		return values
+	}
+	toInts := func(values metricValues) map[string]int {
+		ints := make(map[string]int, len(values))
+		for key, value := range values {
+			ints[key] = int(value)
+		}
+		return ints
+	}
+
+	r.PhaseSeconds = delta(phaseDurationMetric)
+	r.APIRequests = make(map[string]map[string]int)
+	for key, count := range toInts(delta(apiRequestsMetric)) {
+		// Status codes never have commas in them, but endpoints might.
+		i := strings.LastIndex(key, ",")
+		endpoint, status := key[:i], key[i+1:]
+		if r.APIRequests[endpoint] == nil {
+			r.APIRequests[endpoint] = make(map[string]int)
+		}
+		r.APIRequests[endpoint][status] = count
+	}
+	r.Retries = toInts(delta(apiRetriesMetric))[""]
+	r.RateLimited = toInts(delta(rateLimitedMetric))[""]
+	r.RateLimitWaitSeconds = delta(rateLimitWaitMetric)[""]
+	r.Processed = toInts(delta(processedMetric))
+	r.Rejected = toInts(delta(rejectedMetric))
+
+	path, err := r.save()
+	if err != nil {
+		slog.Error("Failed to save the run report", logKeyError, err)
+		return
+	}
+	slog.Info("Saved the run report", "path", path)
+}
+
+// latestRunReport returns the report of the most recent run, along with the
+// path of its text version, or nil if there hasn't been a run yet.
+func latestRunReport() (*runReport, string, error) {
+	runsDir, ok := getRunsDir()
+	if !ok {
+		return nil, "", errors.New("failed to find the cache dir for the run reports")
+	}
+
+	entries, err := os.ReadDir(runsDir)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("failed to list the run reports: %w", err)
+	}
+
+	// os.ReadDir sorts by name, which puts the most recent report last.
+	for i := len(entries) - 1; i >= 0; i-- {
+		name, ok := strings.CutSuffix(entries[i].Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		reportBytes, err := os.ReadFile(filepath.Join(runsDir, entries[i].Name()))
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read the run report: %w", err)
+		}
+		var report runReport
+		if err := json.Unmarshal(reportBytes, &report); err != nil {
+			return nil, "", fmt.Errorf("failed to unmarshal the run report: %w", err)
+		}
+
+		return &report, filepath.Join(runsDir, name+".txt"), nil
+	}
+
+	return nil, "", nil
+}
+
+func getRunsDir() (string, bool) {
+	fangirlCacheDir, ok := getCacheDir()
+	if !ok {
+		return "", false
+	}
+
+	return filepath.Join(fangirlCacheDir, "runs"), true
+}
+
+// save writes the report into the runs directory as both JSON and text,
+// returning the path of the text one, and deletes the oldest reports if there
+// are too many of them.
+func (r *runReport) save() (string, error) {
+	runsDir, ok := getRunsDir()
+	if !ok {
+		return "", errors.New("failed to find the cache dir for the run reports")
+	}
+	if err := os.MkdirAll(runsDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create the runs directory: %w", err)
+	}
+
+	reportBytes, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal the run report: %w", err)
+	}
+
+	name := fmt.Sprintf("%s-%s", r.StartedAt.UTC().Format(runReportTimeFormat), r.Command)
+	// The reports include the configuration, which can say a fair bit about
+	// the user, so they're private like the state.
+	if err := writeFileAtomically(filepath.Join(runsDir, name+".json"), reportBytes, 0600); err != nil {
+		return "", fmt.Errorf("failed to write the run report: %w", err)
+	}
+	textPath := filepath.Join(runsDir, name+".txt")
+	if err := writeFileAtomically(textPath, []byte(r.String()), 0600); err != nil {
+		return "", fmt.Errorf("failed to write the run report: %w", err)
+	}
+
+	if err := pruneRunReports(runsDir, maxRunReports); err != nil {
+		return "", err
+	}
+
+	return textPath, nil
+}
+
+// pruneRunReports deletes all but the newest keep runs' reports in runsDir.
+func pruneRunReports(runsDir string, keep int) error {
+	entries, err := os.ReadDir(runsDir)
+	if err != nil {
+		return fmt.Errorf("failed to list the run reports: %w", err)
+	}
+
+	runs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			runs = append(runs, name)
+		}
+	}
+	if len(runs) <= keep {
+		return nil
+	}
+
+	// The names start with the time, so this puts the oldest first.
+	sort.Strings(runs)
+	for _, name := range runs[:len(runs)-keep] {
+		for _, ext := range []string{".json", ".txt"} {
+			if err := os.Remove(filepath.Join(runsDir, name+ext)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete an old run report: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// String renders the report for humans.
+func (r *runReport) String() string {
+	var sb strings.Builder
+
+	result := "succeeded"
+	if !r.Succeeded {
+		result = "failed: " + r.Error
+	}
+	sb.WriteString(fmt.Sprintf("fangirl %s %s\n", r.Command, result))
+	sb.WriteString(fmt.Sprintf("Started:  %s\n", r.StartedAt.Format(time.RFC3339)))
+	sb.WriteString(fmt.Sprintf("Finished: %s (%v)\n", r.FinishedAt.Format(time.RFC3339), r.FinishedAt.Sub(r.StartedAt).Round(time.Millisecond)))
+	sb.WriteString(fmt.Sprintf("Config:   %s\n", r.Config))
+
+	sb.WriteString("\nPhases:\n")
+	for _, phase := range sortedKeys(r.PhaseSeconds) {
+		duration := time.Duration(r.PhaseSeconds[phase] * float64(time.Second))
+		sb.WriteString(fmt.Sprintf("  %-10s %v\n", phase, duration.Round(time.Millisecond)))
+	}
+
+	sb.WriteString(fmt.Sprintf("\nSpotify API: %d calls, %d retries, rate limited %d times for %v\n",
+		r.APICalls, r.Retries, r.RateLimited, time.Duration(r.RateLimitWaitSeconds*float64(time.Second))))
+	for _, endpoint := range sortedKeys(r.APIRequests) {
+		statuses := make([]string, 0, len(r.APIRequests[endpoint]))
+		for _, status := range sortedKeys(r.APIRequests[endpoint]) {
+			statuses = append(statuses, fmt.Sprintf("%s: %d", status, r.APIRequests[endpoint][status]))
+		}
+		sb.WriteString(fmt.Sprintf("  %s (%s)\n", endpoint, strings.Join(statuses, ", ")))
+	}
+
+	sb.WriteString("\nProcessed:\n")
+	for _, kind := range sortedKeys(r.Processed) {
+		sb.WriteString(fmt.Sprintf("  %-13s %d\n", kind, r.Processed[kind]))
+	}
+
+	sb.WriteString("\nRejected albums:\n")
+	for _, reason := range sortedKeys(r.Rejected) {
+		sb.WriteString(fmt.Sprintf("  %-13s %d\n", reason, r.Rejected[reason]))
+	}
+
+	sb.WriteString("\nPlaylists:\n")
+	for _, playlist := range r.Playlists {
+		sb.WriteString(fmt.Sprintf("  %s %q %s\n", playlist.Action, playlist.Name, playlist.URL))
+	}
+
+	sb.WriteString("\nDuplicates:\n")
+	for _, dup := range r.Duplicates {
+		sb.WriteString(fmt.Sprintf("  %q kept from %q, dropped from %q\n", dup.Track, dup.KeptAlbum, dup.DroppedAlbum))
+	}
+
+	sb.WriteString("\nWarnings:\n")
+	for _, warning := range r.Warnings {
+		sb.WriteString(fmt.Sprintf("  %s\n", warning))
+	}
+
+	return sb.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func playlistURL(id spotify.ID) string {
+	return "https://open.spotify.com/playlist/" + string(id)
+}
+
+// reportingHandler is a slog.Handler that also records the warnings and
+// errors that go through it in the current run's report.
+type reportingHandler struct {
+	slog.Handler
+}
+
+func (h *reportingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		reportWarning(r.Level.String() + " " + formatRecord(r))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *reportingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &reportingHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *reportingHandler) WithGroup(name string) slog.Handler {
+	return &reportingHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// formatRecord formats the message and attributes of r as a single line, like
+// the text handler does.
+func formatRecord(r slog.Record) string {
+	var sb strings.Builder
+	sb.WriteString(r.Message)
+	r.Attrs(func(attr slog.Attr) bool {
+		sb.WriteString(fmt.Sprintf(" %s=%v", attr.Key, attr.Value))
+		return true
+	})
+
+	return sb.String()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestRunReport(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	// Anything from before the run shouldn't show up in its report.
+	rejectedMetric.add(5, rejectReasonSaved)
+
+	client := NewSpotifyClient(&http.Client{}, 0, 0)
+	start := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	cfg := &config{
+		playlistName:        "fangirl",
+		nameTemplate:        template.Must(template.New("name").Parse("{{.Name}}")),
+		descriptionTemplate: template.Must(template.New("description").Parse("")),
+	}
+	startReport("run", cfg, client, start)
+
+	rejectedMetric.add(2, rejectReasonSaved)
+	rejectedMetric.add(1, rejectReasonPlayed)
+	apiRequestsMetric.add(3, "GET /me", "200")
+	apiRetriesMetric.add(1)
+	reportPlaylist("abc", "fangirl", playlistCreated)
+	reportPlaylist("abc", "fangirl", playlistUpdated)
+	reportDuplicate("Hit", spotify.SimpleAlbum{ID: "album", Name: "Album"}, spotify.SimpleAlbum{ID: "single", Name: "Single"})
+	reportWarning("WARN Request failed")
+
+	finishReport(errors.New("oh no"))
+
+	runsDir, ok := getRunsDir()
+	require.True(t, ok)
+	reportBytes, err := os.ReadFile(filepath.Join(runsDir, "20240315T120000Z-run.json"))
+	require.NoError(t, err)
+
+	var report runReport
+	require.NoError(t, json.Unmarshal(reportBytes, &report))
+	assert.Equal(t, "run", report.Command)
+	assert.False(t, report.Succeeded)
+	assert.Equal(t, "oh no", report.Error)
+	assert.Equal(t, map[string]int{rejectReasonSaved: 2, rejectReasonPlayed: 1}, report.Rejected)
+	assert.Equal(t, map[string]map[string]int{"GET /me": {"200": 3}}, report.APIRequests)
+	assert.Equal(t, 1, report.Retries)
+	assert.Equal(t, []runReportPlaylist{{
+		ID:     "abc",
+		Name:   "fangirl",
+		URL:    "https://open.spotify.com/playlist/abc",
+		Action: playlistCreated,
+	}}, report.Playlists)
+	assert.Equal(t, []runReportDuplicate{{
+		Track:          "Hit",
+		KeptAlbumID:    "album",
+		KeptAlbum:      "Album",
+		DroppedAlbumID: "single",
+		DroppedAlbum:   "Single",
+	}}, report.Duplicates)
+	assert.Equal(t, []string{"WARN Request failed"}, report.Warnings)
+
+	text, err := os.ReadFile(filepath.Join(runsDir, "20240315T120000Z-run.txt"))
+	require.NoError(t, err)
+	assert.Contains(t, string(text), "fangirl run failed: oh no\n")
+	assert.Contains(t, string(text), "  GET /me (200: 3)\n")
+	assert.Contains(t, string(text), `  created "fangirl" https://open.spotify.com/playlist/abc`)
+	assert.Contains(t, string(text), `  "Hit" kept from "Album", dropped from "Single"`)
+
+	// Once the run is over, nothing else goes into its report.
+	reportWarning("WARN Too late")
+	assert.Nil(t, currentReport)
+}
+
+func TestPruneRunReports(t *testing.T) {
+	runsDir := t.TempDir()
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("2024031%dT120000Z-run", i)
+		require.NoError(t, os.WriteFile(filepath.Join(runsDir, name+".json"), nil, 0600))
+		require.NoError(t, os.WriteFile(filepath.Join(runsDir, name+".txt"), nil, 0600))
+	}
+
+	require.NoError(t, pruneRunReports(runsDir, 2))
+
+	entries, err := os.ReadDir(runsDir)
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{
+		"20240314T120000Z-run.json",
+		"20240314T120000Z-run.txt",
+		"20240315T120000Z-run.json",
+		"20240315T120000Z-run.txt",
+	}, names)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// serveState is what the serve command needs to remember across restarts.
+type serveState struct {
+	// RollingPlaylistID is the ID of the single playlist that serve keeps up
+	// to date, or empty if it hasn't been created yet.
+	RollingPlaylistID spotify.ID `json:"rollingPlaylistID"`
+	// AddedAlbums maps the IDs of the albums that have been added to the
+	// rolling playlist to when they were added. We never add an album twice,
+	// so that tracks the user removed by hand don't come back.
+	AddedAlbums map[spotify.ID]time.Time `json:"addedAlbums"`
+	LastRunAt   time.Time                `json:"lastRunAt"`
+	// NextRunAt is persisted (jitter and all) so that restarting fangirl
+	// doesn't cause an extra run.
+	NextRunAt time.Time `json:"nextRunAt"`
+}
+
+// nextRunAt picks the time of the run after one that happened at lastRun. The
+// jitter is there so that a bunch of fangirl instances (or one that is
+// restarted on a fixed schedule) don't all hit Spotify at the same time.
+func nextRunAt(lastRun time.Time, interval time.Duration, jitter time.Duration, rng *rand.Rand) time.Time {
+	next := lastRun.Add(interval)
+	if jitter > 0 {
+		next = next.Add(time.Duration(rng.Int63n(int64(jitter))))
+	}
+
+	return next
+}
+
+// serve runs forever (or until ctx is cancelled), periodically appending new
+// releases to a single rolling playlist and aging out the old ones.
+func serve(ctx context.Context, cfg *config, client *SpotifyClient) error {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	serverErrs := make(chan error, 2)
+	if cfg.feedAddr != "" {
+		go func() {
+			serverErrs <- serveFeed(ctx, cfg.feedAddr)
+		}()
+	}
+	if cfg.metricsAddr != "" {
+		go func() {
+			serverErrs <- serveMetrics(ctx, cfg.metricsAddr)
+		}()
+	}
+
+	for {
+		// We reload the state every time around, since other invocations (e.g.
+		// history from a cronjob) may have changed it while we slept.
+		st, err := loadState()
+		if err != nil {
+			return fmt.Errorf("failed to load the state: %w", err)
+		}
+
+		if st.Serve.NextRunAt.IsZero() {
+			next := time.Now()
+			if !st.Serve.LastRunAt.IsZero() {
+				next = nextRunAt(st.Serve.LastRunAt, cfg.serveInterval, cfg.serveJitter, rng)
+			}
+			if err := st.update(func(s *localState) {
+				s.Serve.NextRunAt = next
+			}); err != nil {
+				return fmt.Errorf("failed to save the state: %w", err)
+			}
+		}
+
+		if wait := time.Until(st.Serve.NextRunAt); wait > 0 {
+			slog.Info("Waiting for the next run", logKeyPhase, phaseServe, "next_run_at", st.Serve.NextRunAt)
+			select {
+			case <-ctx.Done():
+				return nil
+			case err := <-serverErrs:
+				return err
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		slog.Info("Starting a scheduled run", logKeyPhase, phaseServe)
+		start := time.Now()
+		startReport("serve", cfg, client, start)
+		err = updateRollingPlaylist(cfg, client, st)
+		if err != nil {
+			// There's no one around to see us die, so we may as well just try
+			// again next time.
+			slog.Error("Scheduled run failed", logKeyPhase, phaseServe, logKeyError, err)
+		} else {
+			slog.Info("Finished a scheduled run", logKeyPhase, phaseServe, "elapsed", time.Since(start))
+		}
+		recordRun(start, err)
+		if cfg.metricsFile != "" {
+			if err := writeMetricsFile(cfg.metricsFile); err != nil {
+				slog.Error("Failed to write the metrics", logKeyPhase, phaseMetrics, logKeyError, err)
+			}
+		}
+		finishReport(err)
+
+		next := nextRunAt(start, cfg.serveInterval, cfg.serveJitter, rng)
+		if err := st.update(func(s *localState) {
+			s.Serve.LastRunAt = start
+			s.Serve.NextRunAt = next
+		}); err != nil {
+			return fmt.Errorf("failed to save the state: %w", err)
+		}
+	}
+}
+
+func updateRollingPlaylist(cfg *config, client *SpotifyClient, st *localState) error {
+	if err := syncPlaylistVisibility(client, cfg, st); err != nil {
+		return fmt.Errorf("failed to update the visibility of playlists: %w", err)
+	}
+
+	w := cfg.window(time.Now())
+	d, err := collectReleases(cfg, client, st, w)
+	if err != nil {
+		return err
+	}
+
+	playlistID, err := ensureRollingPlaylist(cfg, client, st)
+	if err != nil {
+		return err
+	}
+
+	if cfg.icsPath != "" {
+		if err := writeCalendar(cfg.icsPath, d.albums, d.upcomingAlbums); err != nil {
+			return err
+		}
+	}
+
+	inWindow := make(map[spotify.ID]struct{}, len(d.albums))
+	newAlbums := make([]spotify.SimpleAlbum, 0, len(d.albums))
+	for _, album := range d.albums {
+		inWindow[album.ID] = struct{}{}
+		if _, ok := st.Serve.AddedAlbums[album.ID]; !ok {
+			newAlbums = append(newAlbums, album)
+		}
+	}
+	d.albums = newAlbums
+
+	// The releases are recorded before they're added, so that a crash or a
+	// failure to save the state afterwards can't get them added twice. If
+	// adding them fails outright, they're forgotten again so that the next run
+	// has another go, but once some of them are in, they stay recorded.
+	if err := st.update(func(s *localState) {
+		for _, album := range newAlbums {
+			s.Serve.AddedAlbums[album.ID] = w.end
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to save the state: %w", err)
+	}
+
+	stopPlaylist := timePhase(phasePlaylist)
+	albumTracks, _ := selectTracks(cfg, d)
+	added, err := addTracksToPlaylist(client, playlistID, playlistTracks(cfg, d.albums, albumTracks, d.albumPopularity))
+	stopPlaylist()
+	if err != nil {
+		if added == 0 {
+			if err := st.update(func(s *localState) {
+				for _, album := range newAlbums {
+					delete(s.Serve.AddedAlbums, album.ID)
+				}
+			}); err != nil {
+				slog.Error("Failed to forget the releases that couldn't be added", logKeyPhase, phaseServe, logKeyError, err)
+			}
+		}
+		return err
+	}
+	reportPlaylist(playlistID, cfg.playlistName, playlistUpdated)
+
+	for _, album := range newAlbums {
+		slog.Info(
+			"Added album",
+			logKeyPhase, phaseServe,
+			logKeyAlbumID, album.ID,
+			"album", album.Name,
+			"artist", artistNames(album),
+		)
+	}
+
+	// Only tell people about what they haven't heard about from us yet.
+	sendDigest(cfg, newAlbums, w.start, w.last())
+
+	if err := st.update(func(s *localState) {
+		s.recordReleases(newAlbums, w.end)
+	}); err != nil {
+		return fmt.Errorf("failed to save the state: %w", err)
+	}
+	if cfg.feedPath != "" {
+		if err := writeFeed(cfg.feedPath, st); err != nil {
+			return err
+		}
+	}
+
+	// Unlike prune, serve only ages out old releases. The rest is up to the
+	// user.
+	removedByReason, err := prunePlaylist(client, playlistID, []pruneReason{pruneReasonOld}, nil, w, cfg.precisionPolicy)
+	if err != nil {
+		return fmt.Errorf("failed to prune the rolling playlist: %w", err)
+	}
+
+	// Anything added before the start of the window must have been released
+	// before then too, so it won't be fetched again and we can forget about
+	// it. That is, unless its release date is so imprecise that it's still
+	// considered to be in the window.
+	if err := st.update(func(s *localState) {
+		for albumID, addedAt := range s.Serve.AddedAlbums {
+			if _, ok := inWindow[albumID]; !ok && addedAt.Before(w.start) {
+				delete(s.Serve.AddedAlbums, albumID)
+			}
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to save the state: %w", err)
+	}
+
+	slog.Info(
+		"Updated the rolling playlist",
+		logKeyPhase, phaseServe,
+		"added_albums", len(newAlbums),
+		"aged_out_tracks", removedByReason[pruneReasonOld],
+	)
+
+	return nil
+}
+
+// serveHTTP serves handler on addr until ctx is cancelled. url and phase are
+// just for logging.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler, url string, phase string) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving", logKeyPhase, phase, "url", url)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve %s: %w", url, err)
+	}
+
+	return nil
+}
+
+// ensureRollingPlaylist returns the ID of the rolling playlist, creating it if
+// it doesn't exist yet.
+func ensureRollingPlaylist(cfg *config, client *SpotifyClient, st *localState) (spotify.ID, error) {
+	if st.Serve.RollingPlaylistID != "" {
+		return st.Serve.RollingPlaylistID, nil
+	}
+
+	currentUser, err := client.CurrentUser()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the current user: %w", err)
+	}
+
+	// Unlike the one-off playlists, this one covers a different window every
+	// time it is updated, so we just use the name as is.
+	playlist, err := createPlaylist(
+		client,
+		cfg,
+		st,
+		currentUser.ID,
+		cfg.playlistName,
+		fmt.Sprintf("Maintained by fangirl - releases from the last %v.", cfg.duration),
+	)
+	if playlist != nil {
+		reportPlaylist(playlist.ID, playlist.Name, playlistCreated)
+		// Even if we couldn't make it collaborative, it's still the rolling
+		// playlist.
+		if err := st.update(func(s *localState) {
+			s.Serve.RollingPlaylistID = playlist.ID
+		}); err != nil {
+			return "", fmt.Errorf("failed to save the state: %w", err)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create the rolling playlist: %w", err)
+	}
+
+	return playlist.ID, nil
+}
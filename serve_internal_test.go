@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextRunAt(t *testing.T) {
+	lastRun := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	rng := rand.New(rand.NewSource(1))
+
+	testCases := []struct {
+		name     string
+		interval time.Duration
+		jitter   time.Duration
+	}{
+		{"no jitter", 24 * time.Hour, 0},
+		{"jitter", 24 * time.Hour, 15 * time.Minute},
+		{"jitter longer than the interval", time.Hour, 2 * time.Hour},
+		{"tiny jitter", time.Hour, time.Nanosecond},
+	}
+
+	for _, tc := range testCases {
+		earliest, latest := lastRun.Add(tc.interval), lastRun.Add(tc.interval+tc.jitter)
+		for i := 0; i < 1000; i++ {
+			next := nextRunAt(lastRun, tc.interval, tc.jitter, rng)
+			assert.False(t, next.Before(earliest), tc.name)
+			if tc.jitter == 0 {
+				assert.Equal(t, earliest, next, tc.name)
+			} else {
+				// The jitter is anywhere from none up to, but not
+				// including, the whole of it.
+				assert.True(t, next.Before(latest), tc.name)
+			}
+		}
+	}
+}
+
+func TestNextRunAtSpreadsRuns(t *testing.T) {
+	lastRun := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	rng := rand.New(rand.NewSource(1))
+
+	seen := make(map[time.Time]struct{})
+	for i := 0; i < 100; i++ {
+		seen[nextRunAt(lastRun, time.Hour, time.Hour, rng)] = struct{}{}
+	}
+	assert.Greater(t, len(seen), 90)
+}
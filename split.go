@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/zmb3/spotify"
+)
+
+// splitMode decides how releases get divided up between playlists.
+type splitMode string
+
+const (
+	// splitNone puts everything into one playlist.
+	splitNone splitMode = "none"
+	// splitType makes a playlist per album type (albums, singles and
+	// compilations).
+	splitType splitMode = "type"
+	// splitGenre makes a playlist per primary artist genre.
+	splitGenre splitMode = "genre"
+	// splitMapping makes a playlist per bucket in a user-defined mapping of
+	// artists to buckets.
+	splitMapping splitMode = "mapping"
+)
+
+// otherBucket is where releases go when we can't figure out which bucket they
+// belong to, e.g. because the artist has no genres.
+const otherBucket = "other"
+
+func parseSplitMode(s string) (splitMode, error) {
+	switch mode := splitMode(s); mode {
+	case splitNone, splitType, splitGenre, splitMapping:
+		return mode, nil
+	default:
+		return "", fmt.Errorf(
+			"unknown split mode %q, expected one of: %s, %s, %s, %s",
+			s, splitNone, splitType, splitGenre, splitMapping,
+		)
+	}
+}
+
+// bucketTemplates maps buckets to the name templates of their playlists. It
+// implements flag.Value, so that it can be given as a repeated bucket=template
+// flag.
+type bucketTemplates map[string]string
+
+func (bn bucketTemplates) String() string {
+	pairs := make([]string, 0, len(bn))
+	for bucket, text := range bn {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", bucket, text))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ", ")
+}
+
+func (bn bucketTemplates) Set(s string) error {
+	bucket, text, ok := strings.Cut(s, "=")
+	if !ok || bucket == "" || text == "" {
+		return fmt.Errorf("expected a bucket=template pair, got %q", s)
+	}
+	bn[bucket] = text
+
+	return nil
+}
+
+// bucket is a set of albums that go into the same playlist.
+type bucket struct {
+	key string
+	// name is what the playlist would be called if not for the name
+	// templates, i.e. the playlist's .Name in those templates.
+	name   string
+	albums []spotify.SimpleAlbum
+}
+
+// splitAlbums divides the albums in d up into buckets according to
+// cfg.splitMode. The buckets are sorted by key, so that the playlists are
+// always created in the same order.
+func splitAlbums(cfg *config, d *data) []bucket {
+	if cfg.splitMode == splitNone {
+		return []bucket{{
+			name:   cfg.playlistName,
+			albums: d.albums,
+		}}
+	}
+
+	keys := make([]string, 0)
+	albumsByKey := make(map[string][]spotify.SimpleAlbum)
+	for _, album := range d.albums {
+		key := bucketKey(cfg, d, album)
+		if _, ok := albumsByKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		albumsByKey[key] = append(albumsByKey[key], album)
+	}
+	sort.Strings(keys)
+
+	buckets := make([]bucket, 0, len(keys))
+	for _, key := range keys {
+		buckets = append(buckets, bucket{
+			key:    key,
+			name:   fmt.Sprintf("%s - %s", cfg.playlistName, key),
+			albums: albumsByKey[key],
+		})
+	}
+
+	return buckets
+}
+
+func bucketKey(cfg *config, d *data, album spotify.SimpleAlbum) string {
+	switch cfg.splitMode {
+	case splitType:
+		switch strings.ToLower(album.AlbumType) {
+		case "album":
+			return "albums"
+		case "single":
+			return "singles"
+		case "compilation":
+			return "compilations"
+		}
+	case splitGenre:
+		// The first artist isn't necessarily one that is followed (e.g. for
+		// compilations), so go with the first one we know the genres of.
+		for _, artist := range album.Artists {
+			if genres := d.artistGenres[artist.ID]; len(genres) != 0 {
+				return genres[0]
+			}
+		}
+	case splitMapping:
+		for _, artist := range album.Artists {
+			if key, ok := cfg.artistBuckets[artist.Name]; ok {
+				return key
+			}
+		}
+	}
+
+	return otherBucket
+}
+
+// getArtistBuckets reads a mapping file, where every line looks like
+// "Artist Name = bucket". Empty lines and lines starting with a # are ignored.
+func getArtistBuckets(mappingFile string) (map[string]string, error) {
+	fileContents, err := ioutil.ReadFile(mappingFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mapping file: %w", err)
+	}
+
+	artistBuckets := make(map[string]string)
+	for i, line := range strings.Split(string(fileContents), "\n") {
+		trimmedLine := strings.TrimSpace(line)
+		if len(trimmedLine) == 0 || strings.HasPrefix(trimmedLine, "#") {
+			continue
+		}
+
+		artist, key, ok := strings.Cut(trimmedLine, "=")
+		artist, key = strings.TrimSpace(artist), strings.TrimSpace(key)
+		if !ok || artist == "" || key == "" {
+			return nil, fmt.Errorf("line %d of the mapping file is not of the form 'Artist Name = bucket': %q", i+1, line)
+		}
+		artistBuckets[artist] = key
+	}
+
+	return artistBuckets, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestBucketKey(t *testing.T) {
+	followed := spotify.SimpleArtist{ID: "followed", Name: "Followed"}
+	genreless := spotify.SimpleArtist{ID: "genreless", Name: "Genreless"}
+	mapped := spotify.SimpleArtist{ID: "mapped", Name: "Mapped"}
+
+	d := &data{
+		artistGenres: map[spotify.ID][]string{
+			"followed": {"shoegaze", "dream pop"},
+			"mapped":   {"jazz"},
+		},
+	}
+	artistBuckets := map[string]string{"Mapped": "favourites"}
+
+	testCases := []struct {
+		name     string
+		mode     splitMode
+		album    spotify.SimpleAlbum
+		expected string
+	}{
+		{"album", splitType, spotify.SimpleAlbum{AlbumType: "album"}, "albums"},
+		{"single", splitType, spotify.SimpleAlbum{AlbumType: "single"}, "singles"},
+		{"compilation", splitType, spotify.SimpleAlbum{AlbumType: "Compilation"}, "compilations"},
+		{"unknown type", splitType, spotify.SimpleAlbum{AlbumType: "appears_on"}, otherBucket},
+		{"first genre", splitGenre, spotify.SimpleAlbum{Artists: []spotify.SimpleArtist{followed}}, "shoegaze"},
+		{"first artist with genres", splitGenre, spotify.SimpleAlbum{Artists: []spotify.SimpleArtist{genreless, mapped}}, "jazz"},
+		{"no genres", splitGenre, spotify.SimpleAlbum{Artists: []spotify.SimpleArtist{genreless}}, otherBucket},
+		{"no artists", splitGenre, spotify.SimpleAlbum{}, otherBucket},
+		{"mapped artist", splitMapping, spotify.SimpleAlbum{Artists: []spotify.SimpleArtist{genreless, mapped}}, "favourites"},
+		{"unmapped artist", splitMapping, spotify.SimpleAlbum{Artists: []spotify.SimpleArtist{followed}}, otherBucket},
+	}
+
+	for _, tc := range testCases {
+		cfg := &config{splitMode: tc.mode, artistBuckets: artistBuckets}
+		assert.Equal(t, tc.expected, bucketKey(cfg, d, tc.album), tc.name)
+	}
+}
+
+func TestSplitAlbums(t *testing.T) {
+	d := &data{
+		albums: []spotify.SimpleAlbum{
+			{ID: "a", AlbumType: "single"},
+			{ID: "b", AlbumType: "album"},
+			{ID: "c", AlbumType: "single"},
+		},
+	}
+
+	buckets := splitAlbums(&config{playlistName: "fangirl", splitMode: splitType}, d)
+	assert.Equal(t, []bucket{
+		{key: "albums", name: "fangirl - albums", albums: []spotify.SimpleAlbum{d.albums[1]}},
+		{key: "singles", name: "fangirl - singles", albums: []spotify.SimpleAlbum{d.albums[0], d.albums[2]}},
+	}, buckets)
+
+	buckets = splitAlbums(&config{playlistName: "fangirl", splitMode: splitNone}, d)
+	assert.Equal(t, []bucket{{name: "fangirl", albums: d.albums}}, buckets)
+}
+
+func TestPlanPlaylistsDedupsAcrossBuckets(t *testing.T) {
+	client := newTestSpotifyClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "me"}`))
+	}))
+
+	single := spotify.SimpleAlbum{ID: "single", Name: "Single", AlbumType: "single"}
+	album := spotify.SimpleAlbum{ID: "album", Name: "Album", AlbumType: "album"}
+	d := &data{
+		albums: []spotify.SimpleAlbum{single, album},
+		albumTracks: map[spotify.ID][]spotify.SimpleTrack{
+			single.ID: {{ID: "s1", Name: "Hit", Duration: 180000}},
+			album.ID:  {{ID: "a1", Name: "Intro", Duration: 60000}, {ID: "a2", Name: "Hit", Duration: 180000}},
+		},
+		isrcs: map[spotify.ID]string{},
+	}
+	cfg := &config{
+		playlistName:        "fangirl",
+		nameTemplate:        template.Must(template.New("name").Parse("{{.Name}}")),
+		descriptionTemplate: template.Must(template.New("description").Parse("")),
+		splitMode:           splitType,
+		dedupTracks:         true,
+		dedupPreference:     preferComplete,
+	}
+
+	_, plans, err := planPlaylists(client, cfg, d, time.Now())
+	require.NoError(t, err)
+	require.Len(t, plans, 2)
+
+	// The single's copy of the track is dropped, even though it's going into
+	// a different playlist from the album's.
+	assert.Equal(t, "fangirl - albums", plans[0].name)
+	assert.Equal(t, []spotify.ID{"a1", "a2"}, plans[0].trackIDs)
+	require.Len(t, plans[0].duplicates, 1)
+	assert.Equal(t, album.ID, plans[0].duplicates[0].kept.album.ID)
+	assert.Equal(t, "fangirl - singles", plans[1].name)
+	assert.Empty(t, plans[1].trackIDs)
+	assert.Empty(t, plans[1].duplicates)
+}
+
+func TestGetArtistBuckets(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		expected map[string]string
+		err      bool
+	}{
+		{
+			name:     "comments and blank lines",
+			contents: "# My favourites\n\nArtist Name = favourites\n  Other = = weird  \n",
+			expected: map[string]string{"Artist Name": "favourites", "Other": "= weird"},
+		},
+		{
+			name:     "later lines win",
+			contents: "Artist = one\nArtist = two\n",
+			expected: map[string]string{"Artist": "two"},
+		},
+		{name: "no equals sign", contents: "Artist Name\n", err: true},
+		{name: "no bucket", contents: "Artist Name =\n", err: true},
+		{name: "no artist", contents: "= bucket\n", err: true},
+	}
+
+	for _, tc := range testCases {
+		mappingFile := filepath.Join(t.TempDir(), "mapping")
+		require.NoError(t, os.WriteFile(mappingFile, []byte(tc.contents), 0600))
+
+		artistBuckets, err := getArtistBuckets(mappingFile)
+		if tc.err {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, artistBuckets, tc.name)
+	}
+
+	_, err := getArtistBuckets(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestBucketTemplatesSet(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected bucketTemplates
+		err      bool
+	}{
+		{"singles={{.Name}} singles", bucketTemplates{"singles": "{{.Name}} singles"}, false},
+		{"a=b=c", bucketTemplates{"a": "b=c"}, false},
+		{"singles", bucketTemplates{}, true},
+		{"=template", bucketTemplates{}, true},
+		{"singles=", bucketTemplates{}, true},
+	}
+
+	for _, tc := range testCases {
+		templates := bucketTemplates{}
+		err := templates.Set(tc.value)
+		if tc.err {
+			assert.Error(t, err, tc.value)
+		} else {
+			assert.NoError(t, err, tc.value)
+		}
+		assert.Equal(t, tc.expected, templates, tc.value)
+	}
+
+	templates := bucketTemplates{}
+	require.NoError(t, templates.Set("singles=S"))
+	require.NoError(t, templates.Set("albums=A"))
+	assert.Equal(t, "albums=A, singles=S", templates.String())
+}
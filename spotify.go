@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/zmb3/spotify"
 )
 
+// spotifyAPIBaseURL is the base URL of Spotify's Web API, for the few requests
+// that zmb3/spotify doesn't support.
+const spotifyAPIBaseURL = "https://api.spotify.com/v1/"
+
 // SpotifyClient is a wrapper around spotify.Client that adds retry logic.
 // Note that spotify.Client has an AutoRetry flag that one can set
 // true, and this struct does indeed set that flag, but this only
@@ -19,20 +29,39 @@ import (
 // execution times are so long (increasing the likelihood that it runs
 // into a failure of Spotify's API, even if its SLA is great!).
 type SpotifyClient struct {
-	client     *spotify.Client
+	client *spotify.Client
+	// http is the client's underlying HTTP client, for the few requests that
+	// zmb3/spotify doesn't support.
+	http       *http.Client
 	maxTries   uint
 	retryDelay time.Duration
+	// calls is the number of requests we've made to Spotify, retries and
+	// all.
+	calls atomic.Int64
 }
 
-func NewSpotifyClient(client *spotify.Client, maxTries uint, retryDelay time.Duration) *SpotifyClient {
+// NewSpotifyClient makes a client that talks to Spotify through httpClient,
+// which has to take care of the authentication.
+func NewSpotifyClient(httpClient *http.Client, maxTries uint, retryDelay time.Duration) *SpotifyClient {
+	client := spotify.NewClient(httpClient)
 	client.AutoRetry = true
 	return &SpotifyClient{
-		client:     client,
+		client:     &client,
+		http:       httpClient,
 		maxTries:   maxTries,
 		retryDelay: retryDelay,
 	}
 }
 
+func (sc *SpotifyClient) countCall() {
+	sc.calls.Add(1)
+}
+
+// Calls returns the number of requests made to Spotify so far.
+func (sc *SpotifyClient) Calls() int64 {
+	return sc.calls.Load()
+}
+
 func errIsOneOf(err error, errs ...error) bool {
 	for _, e := range errs {
 		if errors.Is(err, e) {
@@ -43,11 +72,20 @@ func errIsOneOf(err error, errs ...error) bool {
 	return false
 }
 
-func wrapInRetry(fun func() error, maxTries uint, retryDelay time.Duration, allowedErrs ...error) (err error) {
+// retry calls fun until it succeeds or fails with one of allowedErrs, at most
+// maxTries+1 times, waiting retryDelay in between. failed is called with
+// every other failure, and whether there's going to be another attempt.
+func retry(
+	fun func() error,
+	maxTries uint,
+	retryDelay time.Duration,
+	failed func(attempt uint, retrying bool, err error),
+	allowedErrs ...error,
+) (err error) {
 	for i := uint(0); i <= maxTries; i++ {
 		err = fun()
 		if err != nil && !errIsOneOf(err, allowedErrs...) {
-			log.Printf("errored for the %dth time: %v", i+1, err)
+			failed(i+1, i < maxTries, err)
 			if i < maxTries { // Don't wait an extra amount at the end when we've hit the maxTries.
 				time.Sleep(retryDelay)
 			}
@@ -60,6 +98,16 @@ func wrapInRetry(fun func() error, maxTries uint, retryDelay time.Duration, allo
 	return err
 }
 
+// wrapInRetry retries a call to Spotify, see retry.
+func wrapInRetry(fun func() error, maxTries uint, retryDelay time.Duration, allowedErrs ...error) error {
+	return retry(fun, maxTries, retryDelay, func(attempt uint, retrying bool, err error) {
+		slog.Warn("Request failed", logKeyAttempt, attempt, "max_attempts", maxTries+1, logKeyError, err)
+		if retrying {
+			apiRetriesMetric.add(1)
+		}
+	}, allowedErrs...)
+}
+
 func wrapInRetryWithRet[T any](
 	fun func() (T, error),
 	maxTries uint,
@@ -76,42 +124,153 @@ func wrapInRetryWithRet[T any](
 
 func (sc *SpotifyClient) CurrentUsersFollowedArtistsOpt(limit int, after string) (*spotify.FullArtistCursorPage, error) {
 	return wrapInRetryWithRet(func() (*spotify.FullArtistCursorPage, error) {
+		sc.countCall()
 		return sc.client.CurrentUsersFollowedArtistsOpt(limit, after)
 	}, sc.maxTries, sc.retryDelay)
 }
 
 func (sc *SpotifyClient) GetArtistAlbumsOpt(artistID spotify.ID, options *spotify.Options, ts ...spotify.AlbumType) (*spotify.SimpleAlbumPage, error) {
 	return wrapInRetryWithRet(func() (*spotify.SimpleAlbumPage, error) {
+		sc.countCall()
 		return sc.client.GetArtistAlbumsOpt(artistID, options, ts...)
 	}, sc.maxTries, sc.retryDelay)
 }
 
 func (sc *SpotifyClient) CurrentUsersAlbums() (*spotify.SavedAlbumPage, error) {
 	return wrapInRetryWithRet(func() (*spotify.SavedAlbumPage, error) {
+		sc.countCall()
 		return sc.client.CurrentUsersAlbums()
 	}, sc.maxTries, sc.retryDelay)
 }
 
 func (sc *SpotifyClient) CreatePlaylistForUser(userID string, playlistName string, description string, public bool) (*spotify.FullPlaylist, error) {
 	return wrapInRetryWithRet(func() (*spotify.FullPlaylist, error) {
+		sc.countCall()
 		return sc.client.CreatePlaylistForUser(userID, playlistName, description, public)
 	}, sc.maxTries, sc.retryDelay)
 }
 
 func (sc *SpotifyClient) GetAlbumTracks(id spotify.ID) (*spotify.SimpleTrackPage, error) {
 	return wrapInRetryWithRet(func() (*spotify.SimpleTrackPage, error) {
+		sc.countCall()
 		return sc.client.GetAlbumTracks(id)
 	}, sc.maxTries, sc.retryDelay)
 }
 
+func (sc *SpotifyClient) GetAlbums(ids ...spotify.ID) ([]*spotify.FullAlbum, error) {
+	return wrapInRetryWithRet(func() ([]*spotify.FullAlbum, error) {
+		sc.countCall()
+		return sc.client.GetAlbums(ids...)
+	}, sc.maxTries, sc.retryDelay)
+}
+
+func (sc *SpotifyClient) GetTracks(ids ...spotify.ID) ([]*spotify.FullTrack, error) {
+	return wrapInRetryWithRet(func() ([]*spotify.FullTrack, error) {
+		sc.countCall()
+		return sc.client.GetTracks(ids...)
+	}, sc.maxTries, sc.retryDelay)
+}
+
+func (sc *SpotifyClient) UserHasTracks(ids ...spotify.ID) ([]bool, error) {
+	return wrapInRetryWithRet(func() ([]bool, error) {
+		sc.countCall()
+		return sc.client.UserHasTracks(ids...)
+	}, sc.maxTries, sc.retryDelay)
+}
+
 func (sc *SpotifyClient) AddTracksToPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
 	return wrapInRetryWithRet(func() (string, error) {
+		sc.countCall()
 		return sc.client.AddTracksToPlaylist(playlistID, trackIDs...)
 	}, sc.maxTries, sc.retryDelay)
 }
 
+func (sc *SpotifyClient) PlayerRecentlyPlayedOpt(opt *spotify.RecentlyPlayedOptions) ([]spotify.RecentlyPlayedItem, error) {
+	return wrapInRetryWithRet(func() ([]spotify.RecentlyPlayedItem, error) {
+		sc.countCall()
+		return sc.client.PlayerRecentlyPlayedOpt(opt)
+	}, sc.maxTries, sc.retryDelay)
+}
+
+func (sc *SpotifyClient) GetPlaylistTracks(playlistID spotify.ID) (*spotify.PlaylistTrackPage, error) {
+	return wrapInRetryWithRet(func() (*spotify.PlaylistTrackPage, error) {
+		sc.countCall()
+		return sc.client.GetPlaylistTracks(playlistID)
+	}, sc.maxTries, sc.retryDelay)
+}
+
+func (sc *SpotifyClient) RemoveTracksFromPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	return wrapInRetryWithRet(func() (string, error) {
+		sc.countCall()
+		return sc.client.RemoveTracksFromPlaylist(playlistID, trackIDs...)
+	}, sc.maxTries, sc.retryDelay)
+}
+
+// SetPlaylistImage takes the image as bytes rather than an io.Reader like
+// spotify.Client#SetPlaylistImage does, since a reader can't be re-read when
+// retrying.
+func (sc *SpotifyClient) SetPlaylistImage(playlistID spotify.ID, img []byte) error {
+	return wrapInRetry(func() error {
+		sc.countCall()
+		return sc.client.SetPlaylistImage(playlistID, bytes.NewReader(img))
+	}, sc.maxTries, sc.retryDelay)
+}
+
+// errPlaylistNotFound means the playlist doesn't exist (anymore), e.g.
+// because the user deleted it.
+var errPlaylistNotFound = errors.New("playlist not found")
+
+// ChangePlaylistVisibility sets whether a playlist is public and whether it is
+// collaborative. zmb3/spotify has no way of setting the latter, so this talks
+// to the API directly. If the playlist doesn't exist, it returns
+// errPlaylistNotFound without retrying.
+func (sc *SpotifyClient) ChangePlaylistVisibility(playlistID spotify.ID, public bool, collaborative bool) error {
+	return wrapInRetry(func() error {
+		sc.countCall()
+		return sc.changePlaylistVisibility(playlistID, public, collaborative)
+	}, sc.maxTries, sc.retryDelay, errPlaylistNotFound)
+}
+
+func (sc *SpotifyClient) changePlaylistVisibility(playlistID spotify.ID, public bool, collaborative bool) error {
+	body, err := json.Marshal(struct {
+		Public        bool `json:"public"`
+		Collaborative bool `json:"collaborative"`
+	}{
+		Public:        public,
+		Collaborative: collaborative,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal the playlist details: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, spotifyAPIBaseURL+"playlists/"+string(playlistID), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create the request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := sc.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", errPlaylistNotFound, playlistID)
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return spotify.Error{
+			Message: fmt.Sprintf("spotify: HTTP %d: %s", resp.StatusCode, respBody),
+			Status:  resp.StatusCode,
+		}
+	}
+
+	return nil
+}
+
 func (sc *SpotifyClient) CurrentUser() (*spotify.PrivateUser, error) {
 	return wrapInRetryWithRet(func() (*spotify.PrivateUser, error) {
+		sc.countCall()
 		return sc.client.CurrentUser()
 	}, sc.maxTries, sc.retryDelay)
 }
@@ -122,18 +281,28 @@ func (sc *SpotifyClient) CurrentUser() (*spotify.PrivateUser, error) {
 // SpotifyClient#NextPage() implementation.
 func (sc *SpotifyClient) NextSimpleAlbumPage(albumPage *spotify.SimpleAlbumPage) error {
 	return wrapInRetry(func() error {
+		sc.countCall()
 		return sc.client.NextPage(albumPage)
 	}, sc.maxTries, sc.retryDelay, spotify.ErrNoMorePages)
 }
 
 func (sc *SpotifyClient) NextSavedAlbumPage(albumPage *spotify.SavedAlbumPage) error {
 	return wrapInRetry(func() error {
+		sc.countCall()
 		return sc.client.NextPage(albumPage)
 	}, sc.maxTries, sc.retryDelay, spotify.ErrNoMorePages)
 }
 
 func (sc *SpotifyClient) NextSimpleTrackPage(trackPage *spotify.SimpleTrackPage) error {
 	return wrapInRetry(func() error {
+		sc.countCall()
+		return sc.client.NextPage(trackPage)
+	}, sc.maxTries, sc.retryDelay, spotify.ErrNoMorePages)
+}
+
+func (sc *SpotifyClient) NextPlaylistTrackPage(trackPage *spotify.PlaylistTrackPage) error {
+	return wrapInRetry(func() error {
+		sc.countCall()
 		return sc.client.NextPage(trackPage)
 	}, sc.maxTries, sc.retryDelay, spotify.ErrNoMorePages)
 }
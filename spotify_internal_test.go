@@ -2,10 +2,15 @@ package main
 
 import (
 	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -177,3 +182,71 @@ func TestErrorAllowList(t *testing.T) {
 	assert.ErrorIs(t, wrapInRetry(unallowedErrFunc, testMaxTries, testDelay, allowedErr), unallowedErr)
 	assert.ErrorIs(t, wrapInRetry(allowedErrFunc, testMaxTries, testDelay, allowedErr), allowedErr)
 }
+
+func TestChangePlaylistVisibility(t *testing.T) {
+	testCases := []struct {
+		name          string
+		status        int
+		expectedErr   error
+		expectedCalls int
+	}{
+		{"changed", http.StatusOK, nil, 1},
+		{"deleted", http.StatusNotFound, errPlaylistNotFound, 1},
+		{"bad gateway", http.StatusBadGateway, nil, 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			client := newTestSpotifyClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				assert.Equal(t, http.MethodPut, r.Method)
+				assert.Equal(t, "/v1/playlists/playlist", r.URL.Path)
+				body, err := ioutil.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, `{"public": false, "collaborative": true}`, string(body))
+				w.WriteHeader(tc.status)
+			}))
+
+			retries := apiRetriesMetric.values()[""]
+			err := client.ChangePlaylistVisibility("playlist", false, true)
+			switch {
+			case tc.expectedErr != nil:
+				assert.ErrorIs(t, err, tc.expectedErr)
+			case tc.status == http.StatusOK:
+				assert.NoError(t, err)
+			default:
+				assert.Error(t, err)
+				assert.NotErrorIs(t, err, errPlaylistNotFound)
+			}
+			assert.Equal(t, tc.expectedCalls, calls)
+			assert.Equal(t, int64(tc.expectedCalls), client.Calls())
+			assert.Equal(t, float64(tc.expectedCalls-1), apiRetriesMetric.values()[""]-retries)
+		})
+	}
+}
+
+// redirectTransport sends every request to a test server instead of Spotify.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestSpotifyClient returns a client that talks to handler rather than
+// Spotify, and doesn't retry.
+func newTestSpotifyClient(t *testing.T, handler http.Handler) *SpotifyClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSpotifyClient(&http.Client{Transport: redirectTransport{target}}, 1, 0)
+}
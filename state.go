@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// localState is everything fangirl remembers between runs, aside from the
+// oauth2 token. It lives next to the token in the cache directory.
+type localState struct {
+	// PlayedTracks maps the IDs of tracks we've seen in the user's
+	// recently played history to the last time they were played.
+	PlayedTracks map[spotify.ID]time.Time `json:"playedTracks"`
+	// HistorySyncedAt is the time of the most recent play we've recorded. We
+	// only ask Spotify for plays after this.
+	HistorySyncedAt time.Time `json:"historySyncedAt"`
+	// ManagedPlaylists are the playlists fangirl has created, oldest first.
+	ManagedPlaylists []managedPlaylist `json:"managedPlaylists"`
+	// Serve is the state of the serve command.
+	Serve serveState `json:"serve"`
+	// Releases are the releases fangirl has come across, keyed by album ID.
+	// These are what the feed is made of.
+	Releases map[spotify.ID]releaseRecord `json:"releases"`
+}
+
+// managedPlaylist is a playlist that fangirl created, and is therefore allowed
+// to mess with later on.
+type managedPlaylist struct {
+	ID        spotify.ID `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"createdAt"`
+	// Public and Collaborative are what we last set the playlist's
+	// visibility to, so that we know when it needs changing.
+	Public        bool `json:"public"`
+	Collaborative bool `json:"collaborative"`
+}
+
+func getStatePath() (string, bool) {
+	fangirlCacheDir, ok := getCacheDir()
+	if !ok {
+		return "", false
+	}
+
+	return filepath.Join(fangirlCacheDir, "state.json"), true
+}
+
+// loadState reads the state file, or returns an empty state if there isn't
+// one yet.
+func loadState() (*localState, error) {
+	s := &localState{
+		PlayedTracks: map[spotify.ID]time.Time{},
+		Serve: serveState{
+			AddedAlbums: map[spotify.ID]time.Time{},
+		},
+		Releases: map[spotify.ID]releaseRecord{},
+	}
+
+	statePath, ok := getStatePath()
+	if !ok {
+		return nil, errors.New("failed to find the cache dir for the state file")
+	}
+
+	stateBytes, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the state file: %w", err)
+	}
+
+	if err := json.Unmarshal(stateBytes, s); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the state file: %w", err)
+	}
+
+	// Older state files may be missing some of the maps entirely.
+	if s.PlayedTracks == nil {
+		s.PlayedTracks = map[spotify.ID]time.Time{}
+	}
+	if s.Serve.AddedAlbums == nil {
+		s.Serve.AddedAlbums = map[spotify.ID]time.Time{}
+	}
+	if s.Releases == nil {
+		s.Releases = map[spotify.ID]releaseRecord{}
+	}
+
+	return s, nil
+}
+
+func (s *localState) addManagedPlaylist(playlist *spotify.FullPlaylist, public bool, collaborative bool) {
+	s.ManagedPlaylists = append(s.ManagedPlaylists, managedPlaylist{
+		ID:            playlist.ID,
+		Name:          playlist.Name,
+		CreatedAt:     time.Now(),
+		Public:        public,
+		Collaborative: collaborative,
+	})
+}
+
+// removeManagedPlaylist forgets about the managed playlist with the given ID,
+// say because the user deleted it.
+func (s *localState) removeManagedPlaylist(id spotify.ID) {
+	kept := s.ManagedPlaylists[:0]
+	for _, playlist := range s.ManagedPlaylists {
+		if playlist.ID != id {
+			kept = append(kept, playlist)
+		}
+	}
+	s.ManagedPlaylists = kept
+
+	// serve will make a new one.
+	if s.Serve.RollingPlaylistID == id {
+		s.Serve.RollingPlaylistID = ""
+	}
+}
+
+// findManagedPlaylist returns the managed playlist with the given ID, or the
+// most recently created one if the ID is empty.
+func (s *localState) findManagedPlaylist(id spotify.ID) (*managedPlaylist, bool) {
+	if len(s.ManagedPlaylists) == 0 {
+		return nil, false
+	}
+
+	if id == "" {
+		return &s.ManagedPlaylists[len(s.ManagedPlaylists)-1], true
+	}
+
+	for i := range s.ManagedPlaylists {
+		if s.ManagedPlaylists[i].ID == id {
+			return &s.ManagedPlaylists[i], true
+		}
+	}
+
+	return nil, false
+}
+
+const (
+	// stateLockPoll is how often we check whether someone else is done with
+	// the state lock.
+	stateLockPoll = 50 * time.Millisecond
+	// stateLockStale is how old a lock has to be before we assume whoever
+	// took it crashed. Nothing holds the lock for longer than it takes to
+	// read and write the state file.
+	stateLockStale = time.Minute
+	// stateLockTimeout is how long we wait for the state lock.
+	stateLockTimeout = 30 * time.Second
+)
+
+// lockState takes a lock on the state file, so that e.g. a history cronjob
+// and a long serve run don't overwrite each other's changes. It returns a
+// function that releases the lock.
+func lockState(statePath string) (func(), error) {
+	lockPath := statePath + ".lock"
+	deadline := time.Now().Add(stateLockTimeout)
+	for {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			info, err := lockFile.Stat()
+			lockFile.Close()
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, fmt.Errorf("failed to stat the state lock: %w", err)
+			}
+			return func() { unlockState(lockPath, info) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create the state lock: %w", err)
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > stateLockStale {
+			slog.Warn("Removing a stale state lock", "path", lockPath, "locked_at", info.ModTime())
+			removeStaleLock(lockPath, info)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for the state lock at %s", lockPath)
+		}
+		time.Sleep(stateLockPoll)
+	}
+}
+
+// removeStaleLock removes the lock at lockPath, which was stale when we
+// looked at it. Someone else may have taken it over since, and simply removing
+// it would then remove their live lock. So the lock is first moved aside,
+// which only one of us can do, and then put back if it turns out to no longer
+// be the stale one.
+func removeStaleLock(lockPath string, stale os.FileInfo) {
+	asidePath := fmt.Sprintf("%s.%d.%d.stale", lockPath, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(lockPath, asidePath); err != nil {
+		// Someone else got to it first.
+		return
+	}
+	defer os.Remove(asidePath)
+
+	if aside, err := os.Stat(asidePath); err == nil && os.SameFile(aside, stale) {
+		return
+	}
+
+	// A link, unlike a rename, won't replace a lock that was taken in the
+	// meantime.
+	if err := os.Link(asidePath, lockPath); err != nil {
+		slog.Warn("Failed to put back a live state lock", "path", lockPath, logKeyError, err)
+	}
+}
+
+// unlockState releases the lock at lockPath, as long as it's still the one we
+// took, rather than one that was taken over because we held it for too long.
+func unlockState(lockPath string, ours os.FileInfo) {
+	if info, err := os.Stat(lockPath); err == nil && os.SameFile(info, ours) {
+		os.Remove(lockPath)
+	}
+}
+
+// update applies fn to the state as it is on disk right now, saves it, and
+// then makes s that up to date state. Since fangirl runs can take a long
+// time, and other invocations (e.g. history from a cronjob) may have saved
+// the state in the meantime, this is the only way the state gets written:
+// saving a long held s wholesale would undo their changes.
+func (s *localState) update(fn func(*localState)) error {
+	statePath, ok := getStatePath()
+	if !ok {
+		return errors.New("failed to find the cache dir for the state file")
+	}
+
+	unlock, err := lockState(statePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fresh, err := loadState()
+	if err != nil {
+		return err
+	}
+	fn(fresh)
+
+	stateBytes, err := json.MarshalIndent(fresh, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal the state: %w", err)
+	}
+
+	// Writing atomically matters more than usual here, since history is
+	// meant to be run very frequently.
+	if err := writeFileAtomically(statePath, stateBytes, 0600); err != nil {
+		return fmt.Errorf("failed to write the state file: %w", err)
+	}
+
+	*s = *fresh
+	return nil
+}
+
+// writeFileAtomically writes to a temporary file and renames it over the real
+// one, so that a crash halfway through writing doesn't leave us with a
+// corrupted file. The temporary file is unique, so concurrent writers don't
+// trip over each other's halfway written files either.
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	err = tmpFile.Chmod(perm)
+	if err == nil {
+		_, err = tmpFile.Write(data)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestLoadStateWithoutAFile(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	st, err := loadState()
+	require.NoError(t, err)
+	assert.NotNil(t, st.PlayedTracks)
+	assert.NotNil(t, st.Serve.AddedAlbums)
+	assert.NotNil(t, st.Releases)
+	assert.Empty(t, st.ManagedPlaylists)
+}
+
+func TestLoadStateFillsInMissingMaps(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	require.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "fangirl"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "fangirl", "state.json"), []byte(`{"managedPlaylists": [{"id": "abc"}]}`), 0600))
+
+	st, err := loadState()
+	require.NoError(t, err)
+	assert.NotNil(t, st.PlayedTracks)
+	assert.NotNil(t, st.Serve.AddedAlbums)
+	assert.NotNil(t, st.Releases)
+	assert.Equal(t, []managedPlaylist{{ID: "abc"}}, st.ManagedPlaylists)
+}
+
+func TestStateUpdate(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	playedAt := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+
+	// Two invocations that loaded the state at the same time, e.g. a long
+	// serve run and a history cronjob.
+	serveState, err := loadState()
+	require.NoError(t, err)
+	historyState, err := loadState()
+	require.NoError(t, err)
+
+	require.NoError(t, historyState.update(func(s *localState) {
+		s.PlayedTracks["track"] = playedAt
+	}))
+	require.NoError(t, serveState.update(func(s *localState) {
+		s.Serve.AddedAlbums["album"] = playedAt
+	}))
+
+	// Neither clobbered the other, and the long held state caught up.
+	assert.Equal(t, playedAt, serveState.PlayedTracks["track"])
+	st, err := loadState()
+	require.NoError(t, err)
+	assert.Equal(t, map[spotify.ID]time.Time{"track": playedAt}, st.PlayedTracks)
+	assert.Equal(t, map[spotify.ID]time.Time{"album": playedAt}, st.Serve.AddedAlbums)
+
+	// Nothing is left lying around next to the state.
+	entries, err := os.ReadDir(filepath.Join(cacheDir, "fangirl"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "state.json", entries[0].Name())
+	info, err := entries[0].Info()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestLockState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	unlock, err := lockState(statePath)
+	require.NoError(t, err)
+
+	// A second lock has to wait for the first.
+	locked := make(chan struct{})
+	go func() {
+		unlockAgain, err := lockState(statePath)
+		if err == nil {
+			unlockAgain()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("took the state lock twice")
+	case <-time.After(3 * stateLockPoll):
+	}
+	unlock()
+	<-locked
+
+	// A lock that's been around for ages was left behind by a crash.
+	lockPath := statePath + ".lock"
+	require.NoError(t, os.WriteFile(lockPath, nil, 0600))
+	old := time.Now().Add(-2 * stateLockStale)
+	require.NoError(t, os.Chtimes(lockPath, old, old))
+	unlock, err = lockState(statePath)
+	require.NoError(t, err)
+	unlock()
+	assert.NoFileExists(t, lockPath)
+}
+
+func TestRemoveStaleLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "state.json.lock")
+	// replaceLock puts a new lock in place of the current one. It's created
+	// before the old one goes, so that they can't share an inode.
+	replaceLock := func() {
+		require.NoError(t, os.WriteFile(lockPath+".new", nil, 0600))
+		require.NoError(t, os.Rename(lockPath+".new", lockPath))
+	}
+
+	require.NoError(t, os.WriteFile(lockPath, nil, 0600))
+	stale, err := os.Stat(lockPath)
+	require.NoError(t, err)
+
+	// Someone else took over the stale lock after we looked at it, so it has
+	// to be left alone.
+	replaceLock()
+	live, err := os.Stat(lockPath)
+	require.NoError(t, err)
+	removeStaleLock(lockPath, stale)
+	current, err := os.Stat(lockPath)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(live, current))
+
+	// Whereas the lock we looked at is removed.
+	removeStaleLock(lockPath, current)
+	assert.NoFileExists(t, lockPath)
+
+	// Nothing is left lying around either way.
+	entries, err := os.ReadDir(filepath.Dir(lockPath))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestUnlockStateLeavesOtherLocks(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	lockPath := statePath + ".lock"
+
+	unlock, err := lockState(statePath)
+	require.NoError(t, err)
+
+	// We held on to the lock for so long that someone else took it over.
+	require.NoError(t, os.WriteFile(lockPath+".new", nil, 0600))
+	require.NoError(t, os.Rename(lockPath+".new", lockPath))
+	unlock()
+	assert.FileExists(t, lockPath)
+}
+
+func TestRemoveManagedPlaylist(t *testing.T) {
+	s := &localState{
+		ManagedPlaylists: []managedPlaylist{{ID: "first"}, {ID: "rolling"}, {ID: "last"}},
+		Serve:            serveState{RollingPlaylistID: "rolling"},
+	}
+
+	s.removeManagedPlaylist("missing")
+	assert.Len(t, s.ManagedPlaylists, 3)
+	assert.Equal(t, spotify.ID("rolling"), s.Serve.RollingPlaylistID)
+
+	s.removeManagedPlaylist("rolling")
+	assert.Equal(t, []managedPlaylist{{ID: "first"}, {ID: "last"}}, s.ManagedPlaylists)
+	assert.Empty(t, s.Serve.RollingPlaylistID)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// tokenStorage is where the oauth2 token is kept between runs.
+type tokenStorage string
+
+const (
+	// tokenStorageFile keeps the token as plain JSON in the cache dir.
+	tokenStorageFile tokenStorage = "file"
+	// tokenStorageEncryptedFile keeps the token in the cache dir, encrypted
+	// with a passphrase.
+	tokenStorageEncryptedFile tokenStorage = "encrypted-file"
+	// tokenStorageNone only keeps the token in memory, so every invocation
+	// has to log in again.
+	tokenStorageNone tokenStorage = "none"
+)
+
+func parseTokenStorage(s string) (tokenStorage, error) {
+	switch storage := tokenStorage(s); storage {
+	case tokenStorageFile, tokenStorageEncryptedFile, tokenStorageNone:
+		return storage, nil
+	default:
+		return "", fmt.Errorf(
+			"unknown token storage %q, expected one of: %s, %s, %s",
+			s,
+			tokenStorageFile,
+			tokenStorageEncryptedFile,
+			tokenStorageNone,
+		)
+	}
+}
+
+// tokenPassphraseEnv is the environment variable the passphrase for
+// encrypted-file token storage is read from, unless -token-passphrase-file is
+// given.
+const tokenPassphraseEnv = "FANGIRL_TOKEN_PASSPHRASE"
+
+// getTokenPassphrase reads the passphrase from passphraseFile, or the
+// environment if there isn't one. It's empty if neither has it.
+func getTokenPassphrase(passphraseFile string) (string, error) {
+	if passphraseFile == "" {
+		return os.Getenv(tokenPassphraseEnv), nil
+	}
+
+	passphrase, err := ioutil.ReadFile(passphraseFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the token passphrase file: %w", err)
+	}
+
+	// Editors like to leave a trailing newline, which surely isn't meant to be
+	// part of the passphrase.
+	return strings.TrimRight(string(passphrase), "\r\n"), nil
+}
+
+// tokenStore keeps the oauth2 token between logins.
+type tokenStore interface {
+	// load returns the stored token, or errNotLoggedIn if there isn't one.
+	load() (*oauth2.Token, error)
+	save(token *oauth2.Token) error
+	// clear forgets the stored token, or returns errNotLoggedIn if there
+	// wasn't one.
+	clear() error
+}
+
+func newTokenStore(storage tokenStorage, passphrase string) (tokenStore, error) {
+	switch storage {
+	case tokenStorageEncryptedFile:
+		if passphrase == "" {
+			return nil, fmt.Errorf(
+				"%s token storage needs a passphrase, from %s or -token-passphrase-file",
+				tokenStorageEncryptedFile,
+				tokenPassphraseEnv,
+			)
+		}
+		return &encryptedFileTokenStore{name: "token.enc", passphrase: []byte(passphrase)}, nil
+	case tokenStorageNone:
+		return &memoryTokenStore{}, nil
+	default:
+		return &fileTokenStore{name: "token.txt"}, nil
+	}
+}
+
+func getTokenPath(name string) (string, error) {
+	fangirlCacheDir, ok := getCacheDir()
+	if !ok {
+		return "", errNoCacheDir
+	}
+
+	return filepath.Join(fangirlCacheDir, name), nil
+}
+
+// fileTokenStore keeps the token as plain JSON in the cache dir.
+type fileTokenStore struct {
+	name string
+}
+
+func (s *fileTokenStore) load() (*oauth2.Token, error) {
+	tokenBytes, err := readTokenFile(s.name)
+	if err != nil {
+		return nil, err
+	}
+
+	token := oauth2.Token{}
+	if err := json.Unmarshal(tokenBytes, &token); err != nil {
+		return nil, &authError{"unmarshal the token", err}
+	}
+
+	return &token, nil
+}
+
+func (s *fileTokenStore) save(token *oauth2.Token) error {
+	tokenBytes, err := json.Marshal(token)
+	if err != nil {
+		return &authError{"marshal the token", err}
+	}
+
+	return writeTokenFile(s.name, tokenBytes)
+}
+
+func (s *fileTokenStore) clear() error {
+	return removeTokenFile(s.name)
+}
+
+const (
+	// tokenKDF is the key derivation function used for encrypted tokens, which
+	// is recorded in the file in case we ever want to change it.
+	tokenKDF = "scrypt"
+	// These are the scrypt parameters, as recommended for interactive logins
+	// by the scrypt paper. They're recorded in the file too, but a file with
+	// any others is rejected, since a corrupted or tampered with one could
+	// otherwise have us use up all the memory and CPU there is.
+	tokenScryptN = 1 << 15
+	tokenScryptR = 8
+	tokenScryptP = 1
+)
+
+// encryptedToken is what's in the file of an encryptedFileTokenStore. The
+// token JSON is encrypted with AES-256-GCM, under a key derived from the
+// passphrase.
+type encryptedToken struct {
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// encryptedFileTokenStore keeps the token in the cache dir, encrypted with a
+// passphrase.
+type encryptedFileTokenStore struct {
+	name       string
+	passphrase []byte
+}
+
+func (s *encryptedFileTokenStore) load() (*oauth2.Token, error) {
+	fileBytes, err := readTokenFile(s.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted encryptedToken
+	if err := json.Unmarshal(fileBytes, &encrypted); err != nil {
+		return nil, &authError{"unmarshal the encrypted token", err}
+	}
+	if encrypted.KDF != tokenKDF {
+		return nil, &authError{"decrypt the token", fmt.Errorf("unknown key derivation function %q", encrypted.KDF)}
+	}
+	if encrypted.N != tokenScryptN || encrypted.R != tokenScryptR || encrypted.P != tokenScryptP {
+		return nil, &authError{"decrypt the token", fmt.Errorf(
+			"unexpected scrypt parameters N=%d, r=%d, p=%d", encrypted.N, encrypted.R, encrypted.P,
+		)}
+	}
+
+	aead, err := newTokenCipher(s.passphrase, &encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted.Nonce) != aead.NonceSize() {
+		return nil, &authError{"decrypt the token", errors.New("bad nonce")}
+	}
+
+	tokenBytes, err := aead.Open(nil, encrypted.Nonce, encrypted.Ciphertext, nil)
+	if err != nil {
+		return nil, &authError{"decrypt the token (is the passphrase right?)", err}
+	}
+
+	token := oauth2.Token{}
+	if err := json.Unmarshal(tokenBytes, &token); err != nil {
+		return nil, &authError{"unmarshal the token", err}
+	}
+
+	return &token, nil
+}
+
+func (s *encryptedFileTokenStore) save(token *oauth2.Token) error {
+	tokenBytes, err := json.Marshal(token)
+	if err != nil {
+		return &authError{"marshal the token", err}
+	}
+
+	encrypted := encryptedToken{
+		KDF:  tokenKDF,
+		N:    tokenScryptN,
+		R:    tokenScryptR,
+		P:    tokenScryptP,
+		Salt: make([]byte, 16),
+	}
+	if _, err := rand.Read(encrypted.Salt); err != nil {
+		return &authError{"generate a salt", err}
+	}
+
+	aead, err := newTokenCipher(s.passphrase, &encrypted)
+	if err != nil {
+		return err
+	}
+
+	encrypted.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(encrypted.Nonce); err != nil {
+		return &authError{"generate a nonce", err}
+	}
+	encrypted.Ciphertext = aead.Seal(nil, encrypted.Nonce, tokenBytes, nil)
+
+	fileBytes, err := json.Marshal(encrypted)
+	if err != nil {
+		return &authError{"marshal the encrypted token", err}
+	}
+
+	return writeTokenFile(s.name, fileBytes)
+}
+
+func (s *encryptedFileTokenStore) clear() error {
+	return removeTokenFile(s.name)
+}
+
+// newTokenCipher makes the cipher for the encrypted token, using the key
+// derivation parameters recorded with it.
+func newTokenCipher(passphrase []byte, encrypted *encryptedToken) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, encrypted.Salt, encrypted.N, encrypted.R, encrypted.P, 32)
+	if err != nil {
+		return nil, &authError{"derive the token key", err}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, &authError{"create the token cipher", err}
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, &authError{"create the token cipher", err}
+	}
+
+	return aead, nil
+}
+
+// memoryTokenStore keeps the token in memory, for as long as fangirl is
+// running.
+type memoryTokenStore struct {
+	token *oauth2.Token
+}
+
+func (s *memoryTokenStore) load() (*oauth2.Token, error) {
+	if s.token == nil {
+		return nil, errNotLoggedIn
+	}
+
+	return s.token, nil
+}
+
+func (s *memoryTokenStore) save(token *oauth2.Token) error {
+	s.token = token
+	return nil
+}
+
+func (s *memoryTokenStore) clear() error {
+	if s.token == nil {
+		return errNotLoggedIn
+	}
+
+	s.token = nil
+	return nil
+}
+
+func readTokenFile(name string) ([]byte, error) {
+	tokenPath, err := getTokenPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenBytes, err := ioutil.ReadFile(tokenPath)
+	if os.IsNotExist(err) {
+		return nil, errNotLoggedIn
+	} else if err != nil {
+		return nil, &authError{"read the token file", err}
+	}
+
+	return tokenBytes, nil
+}
+
+func writeTokenFile(name string, data []byte) error {
+	tokenPath, err := getTokenPath(name)
+	if err != nil {
+		return err
+	}
+
+	// Writing the token in place would lose it if we crashed halfway through,
+	// and would keep the mode of an existing file that's readable by others.
+	if err := writeFileAtomically(tokenPath, data, 0600); err != nil {
+		return &authError{"write the token file", err}
+	}
+
+	return nil
+}
+
+func removeTokenFile(name string) error {
+	tokenPath, err := getTokenPath(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(tokenPath); os.IsNotExist(err) {
+		return errNotLoggedIn
+	} else if err != nil {
+		return &authError{"delete the token file", err}
+	}
+
+	return nil
+}
+
+// checkTokenMigration returns an error if the token can't be migrated from
+// one storage to the other, before either of them is touched.
+func checkTokenMigration(from, to tokenStorage) error {
+	switch {
+	case from == to:
+		return fmt.Errorf("the token is already in %s storage, set -token-storage to the one to migrate to", from)
+	case from == tokenStorageNone:
+		// A new fangirl process never has a token in memory.
+		return fmt.Errorf("there is never a token in %s storage to migrate", from)
+	case to == tokenStorageNone:
+		// The token would only last until we exit, after deleting the old one.
+		return fmt.Errorf("migrating to %s storage would delete the token, use logout for that", to)
+	default:
+		return nil
+	}
+}
+
+// migrateToken moves the token from one store to another.
+func migrateToken(from, to tokenStore) error {
+	token, err := from.load()
+	if err != nil {
+		return err
+	}
+
+	if err := to.save(token); err != nil {
+		return err
+	}
+
+	// Only once the token is safely in its new home do we get rid of it, and
+	// failing to is worth knowing about, since the point may have been to not
+	// leave it lying around in plain text.
+	if err := from.clear(); err != nil {
+		return fmt.Errorf("migrated the token, but failed to delete the old one: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenStores(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	token := &oauth2.Token{
+		AccessToken:  "access",
+		TokenType:    "Bearer",
+		RefreshToken: "refresh",
+		Expiry:       time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC),
+	}
+
+	for _, storage := range []tokenStorage{tokenStorageFile, tokenStorageEncryptedFile, tokenStorageNone} {
+		store, err := newTokenStore(storage, "hunter2")
+		require.NoError(t, err)
+
+		_, err = store.load()
+		assert.ErrorIs(t, err, errNotLoggedIn, storage)
+
+		require.NoError(t, store.save(token), storage)
+		loaded, err := store.load()
+		require.NoError(t, err, storage)
+		assert.Equal(t, token.AccessToken, loaded.AccessToken, storage)
+		assert.Equal(t, token.RefreshToken, loaded.RefreshToken, storage)
+		assert.True(t, token.Expiry.Equal(loaded.Expiry), storage)
+
+		require.NoError(t, store.clear(), storage)
+		assert.ErrorIs(t, store.clear(), errNotLoggedIn, storage)
+	}
+}
+
+func TestEncryptedFileTokenStore(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+
+	_, err := newTokenStore(tokenStorageEncryptedFile, "")
+	assert.Error(t, err)
+
+	store, err := newTokenStore(tokenStorageEncryptedFile, "hunter2")
+	require.NoError(t, err)
+	require.NoError(t, store.save(&oauth2.Token{AccessToken: "access"}))
+
+	tokenPath := filepath.Join(cacheDir, "fangirl", "token.enc")
+	fileBytes, err := os.ReadFile(tokenPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(fileBytes), "access")
+
+	// The key derivation is recorded along with the token.
+	var encrypted encryptedToken
+	require.NoError(t, json.Unmarshal(fileBytes, &encrypted))
+	assert.Equal(t, "scrypt", encrypted.KDF)
+	assert.Equal(t, []int{tokenScryptN, tokenScryptR, tokenScryptP}, []int{encrypted.N, encrypted.R, encrypted.P})
+
+	wrong, err := newTokenStore(tokenStorageEncryptedFile, "hunter3")
+	require.NoError(t, err)
+	_, err = wrong.load()
+	var authErr *authError
+	assert.ErrorAs(t, err, &authErr)
+
+	badFiles := []struct {
+		name     string
+		modify   func(e *encryptedToken)
+		errorMsg string
+	}{
+		{"unknown kdf", func(e *encryptedToken) { e.KDF = "pbkdf2-sha256" }, `unknown key derivation function "pbkdf2-sha256"`},
+		{"bad parameters", func(e *encryptedToken) { e.N = 3 }, "unexpected scrypt parameters N=3, r=8, p=1"},
+		{"expensive parameters", func(e *encryptedToken) { e.N, e.P = 1<<30, 1<<20 }, "unexpected scrypt parameters"},
+		{"bad nonce", func(e *encryptedToken) { e.Nonce = e.Nonce[1:] }, "bad nonce"},
+	}
+	for _, bad := range badFiles {
+		t.Run(bad.name, func(t *testing.T) {
+			modified := encrypted
+			bad.modify(&modified)
+			modifiedBytes, err := json.Marshal(modified)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(tokenPath, modifiedBytes, 0600))
+
+			_, err = store.load()
+			assert.ErrorContains(t, err, bad.errorMsg)
+		})
+	}
+}
+
+func TestWriteTokenFile(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	fangirlDir := filepath.Join(cacheDir, "fangirl")
+	require.NoError(t, os.MkdirAll(fangirlDir, 0700))
+
+	// A token left readable by others doesn't stay that way.
+	tokenPath := filepath.Join(fangirlDir, "token.txt")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("{}"), 0644))
+	require.NoError(t, os.Chmod(tokenPath, 0644))
+
+	require.NoError(t, writeTokenFile("token.txt", []byte(`{"access_token":"access"}`)))
+	info, err := os.Stat(tokenPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	tokenBytes, err := os.ReadFile(tokenPath)
+	require.NoError(t, err)
+	assert.Equal(t, `{"access_token":"access"}`, string(tokenBytes))
+
+	// Nothing is left lying around next to the token.
+	entries, err := os.ReadDir(fangirlDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestCheckTokenMigration(t *testing.T) {
+	testCases := []struct {
+		from     tokenStorage
+		to       tokenStorage
+		errorMsg string
+	}{
+		{tokenStorageFile, tokenStorageEncryptedFile, ""},
+		{tokenStorageEncryptedFile, tokenStorageFile, ""},
+		{tokenStorageFile, tokenStorageFile, "the token is already in file storage"},
+		{tokenStorageNone, tokenStorageFile, "there is never a token in none storage"},
+		{tokenStorageFile, tokenStorageNone, "migrating to none storage would delete the token"},
+	}
+
+	for _, tc := range testCases {
+		err := checkTokenMigration(tc.from, tc.to)
+		if tc.errorMsg == "" {
+			assert.NoError(t, err, "%s to %s", tc.from, tc.to)
+			continue
+		}
+		assert.ErrorContains(t, err, tc.errorMsg, "%s to %s", tc.from, tc.to)
+	}
+}
+
+func TestMigrateToken(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	from, err := newTokenStore(tokenStorageFile, "")
+	require.NoError(t, err)
+	to, err := newTokenStore(tokenStorageEncryptedFile, "hunter2")
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, migrateToken(from, to), errNotLoggedIn)
+
+	require.NoError(t, from.save(&oauth2.Token{AccessToken: "access"}))
+	require.NoError(t, migrateToken(from, to))
+
+	_, err = from.load()
+	assert.ErrorIs(t, err, errNotLoggedIn)
+	migrated, err := to.load()
+	require.NoError(t, err)
+	assert.Equal(t, "access", migrated.AccessToken)
+}
+
+func TestGetTokenPassphrase(t *testing.T) {
+	t.Setenv(tokenPassphraseEnv, "from the env")
+
+	passphrase, err := getTokenPassphrase("")
+	require.NoError(t, err)
+	assert.Equal(t, "from the env", passphrase)
+
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	require.NoError(t, os.WriteFile(passphraseFile, []byte("from a file\n"), 0600))
+	passphrase, err = getTokenPassphrase(passphraseFile)
+	require.NoError(t, err)
+	assert.Equal(t, "from a file", passphrase)
+}
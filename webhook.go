@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webhookFormat is the shape of the payload we POST to webhooks.
+type webhookFormat string
+
+const (
+	// webhookGeneric posts the message along with the digest as is.
+	webhookGeneric webhookFormat = "generic"
+	// webhookSlack posts a Slack incoming webhook message.
+	webhookSlack webhookFormat = "slack"
+	// webhookDiscord posts a Discord webhook message.
+	webhookDiscord webhookFormat = "discord"
+)
+
+// These are the limits Slack and Discord put on their messages.
+const (
+	maxSlackBlocks    = 50
+	maxSlackText      = 3000
+	maxDiscordContent = 2000
+	maxDiscordEmbeds  = 10
+)
+
+func parseWebhookFormat(s string) (webhookFormat, error) {
+	switch format := webhookFormat(s); format {
+	case webhookGeneric, webhookSlack, webhookDiscord:
+		return format, nil
+	default:
+		return "", fmt.Errorf(
+			"unknown webhook format %q, expected one of: %s, %s, %s",
+			s, webhookGeneric, webhookSlack, webhookDiscord,
+		)
+	}
+}
+
+// stringList implements flag.Value for flags that may be repeated.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ", ")
+}
+
+func (sl *stringList) Set(s string) error {
+	*sl = append(*sl, s)
+	return nil
+}
+
+type webhookNotifier struct {
+	client     *http.Client
+	format     webhookFormat
+	maxTries   uint
+	retryDelay time.Duration
+}
+
+func newWebhookNotifier(format webhookFormat) *webhookNotifier {
+	return &webhookNotifier{
+		client:     &http.Client{Timeout: 30 * time.Second},
+		format:     format,
+		maxTries:   digestMaxTries,
+		retryDelay: digestRetryDelay,
+	}
+}
+
+// notify POSTs the digest to the webhook at url.
+func (wn *webhookNotifier) notify(url string, dg *digest, message string) error {
+	payload, err := json.Marshal(wn.payload(dg, message))
+	if err != nil {
+		return fmt.Errorf("failed to marshal the webhook payload: %w", err)
+	}
+
+	return retrySending(func() error {
+		resp, err := wn.client.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			err := fmt.Errorf("webhook responded with HTTP %d: %s", resp.StatusCode, body)
+			// Sending the same payload again isn't going to change the
+			// webhook's mind, unless it's just telling us to slow down.
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				return fmt.Errorf("%w: %v", errWebhookRejected, err)
+			}
+			return err
+		}
+
+		return nil
+	}, wn.maxTries, wn.retryDelay, errWebhookRejected)
+}
+
+var errWebhookRejected = errors.New("the webhook rejected the digest")
+
+func (wn *webhookNotifier) payload(dg *digest, message string) interface{} {
+	switch wn.format {
+	case webhookSlack:
+		return slackPayload(dg, message)
+	case webhookDiscord:
+		return discordPayload(dg, message)
+	default:
+		return struct {
+			Text string `json:"text"`
+			*digest
+		}{
+			Text:   message,
+			digest: dg,
+		}
+	}
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackAccessory struct {
+	Type     string `json:"type"`
+	ImageURL string `json:"image_url"`
+	AltText  string `json:"alt_text"`
+}
+
+type slackBlock struct {
+	Type      string          `json:"type"`
+	Text      *slackText      `json:"text,omitempty"`
+	Accessory *slackAccessory `json:"accessory,omitempty"`
+}
+
+// slackPayload makes a message with the text up top, followed by a section
+// per release. Slack only shows the blocks if there are any, with the text as
+// the notification, so we include everything in both.
+func slackPayload(dg *digest, message string) interface{} {
+	// A section can only hold so much text, so a long digest takes a few.
+	chunks := splitText(message, maxSlackText)
+	if len(chunks) > maxSlackBlocks {
+		chunks = chunks[:maxSlackBlocks]
+	}
+	blocks := make([]slackBlock, 0, maxSlackBlocks)
+	for _, chunk := range chunks {
+		blocks = append(blocks, slackBlock{
+			Type: "section",
+			Text: &slackText{Type: "mrkdwn", Text: chunk},
+		})
+	}
+
+	for _, release := range dg.Releases {
+		if len(blocks) == maxSlackBlocks {
+			break
+		}
+
+		block := slackBlock{
+			Type: "section",
+			Text: &slackText{
+				Type: "mrkdwn",
+				Text: fmt.Sprintf(
+					"*<%s|%s>*\n%s\n_%s, released %s_",
+					release.URL, release.Album, release.Artist, release.Type, release.ReleaseDate,
+				),
+			},
+		}
+		if release.ArtworkURL != "" {
+			block.Accessory = &slackAccessory{
+				Type:     "image",
+				ImageURL: release.ArtworkURL,
+				AltText:  release.Album,
+			}
+		}
+		blocks = append(blocks, block)
+	}
+
+	return struct {
+		Text   string       `json:"text"`
+		Blocks []slackBlock `json:"blocks"`
+	}{
+		Text:   message,
+		Blocks: blocks,
+	}
+}
+
+// splitText splits text into chunks of at most max characters, breaking it
+// between lines where possible.
+func splitText(text string, max int) []string {
+	var chunks []string
+	var chunk strings.Builder
+	chunkLen := 0
+	flush := func() {
+		if chunkLen != 0 {
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
+			chunkLen = 0
+		}
+	}
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		runes := []rune(line)
+		if chunkLen+len(runes) > max {
+			flush()
+		}
+		// Lines that are too long on their own have to be broken up anyway.
+		for len(runes) > max {
+			chunks = append(chunks, string(runes[:max]))
+			runes = runes[max:]
+		}
+		chunk.WriteString(string(runes))
+		chunkLen += len(runes)
+	}
+	flush()
+
+	return chunks
+}
+
+type discordThumbnail struct {
+	URL string `json:"url"`
+}
+
+type discordEmbed struct {
+	Title       string            `json:"title"`
+	URL         string            `json:"url,omitempty"`
+	Description string            `json:"description"`
+	Thumbnail   *discordThumbnail `json:"thumbnail,omitempty"`
+}
+
+// discordPayload makes a message with the text as its content, and an embed
+// for each of the newest releases. Discord has rather strict limits on both,
+// so the content may get cut off.
+func discordPayload(dg *digest, message string) interface{} {
+	// Discord counts characters rather than bytes.
+	if runes := []rune(message); len(runes) > maxDiscordContent {
+		message = string(runes[:maxDiscordContent-1]) + "…"
+	}
+
+	embeds := make([]discordEmbed, 0, maxDiscordEmbeds)
+	for _, release := range dg.Releases {
+		if len(embeds) == maxDiscordEmbeds {
+			break
+		}
+
+		embed := discordEmbed{
+			Title:       release.Album,
+			URL:         release.URL,
+			Description: fmt.Sprintf("%s\n%s, released %s", release.Artist, release.Type, release.ReleaseDate),
+		}
+		if release.ArtworkURL != "" {
+			embed.Thumbnail = &discordThumbnail{URL: release.ArtworkURL}
+		}
+		embeds = append(embeds, embed)
+	}
+
+	return struct {
+		Content string         `json:"content"`
+		Embeds  []discordEmbed `json:"embeds"`
+	}{
+		Content: message,
+		Embeds:  embeds,
+	}
+}
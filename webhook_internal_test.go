@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookNotify(t *testing.T) {
+	dg := &digest{
+		Start: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		Releases: []digestRelease{{
+			ID:          "a1",
+			Artist:      "Alpha",
+			Album:       "First",
+			Type:        "album",
+			ReleaseDate: "2024-03-03",
+			URL:         "https://open.spotify.com/album/a1",
+			ArtworkURL:  "https://i.scdn.co/image/a1",
+		}},
+	}
+
+	testCases := []struct {
+		format   webhookFormat
+		failures int
+		check    func(t *testing.T, payload map[string]interface{})
+	}{
+		{
+			format: webhookGeneric,
+			check: func(t *testing.T, payload map[string]interface{}) {
+				assert.Equal(t, "hello", payload["text"])
+				releases := payload["releases"].([]interface{})
+				require.Len(t, releases, 1)
+				release := releases[0].(map[string]interface{})
+				assert.Equal(t, "Alpha", release["artist"])
+				assert.Equal(t, "https://i.scdn.co/image/a1", release["artworkURL"])
+			},
+		},
+		{
+			format:   webhookSlack,
+			failures: 2,
+			check: func(t *testing.T, payload map[string]interface{}) {
+				assert.Equal(t, "hello", payload["text"])
+				blocks := payload["blocks"].([]interface{})
+				require.Len(t, blocks, 2)
+				block := blocks[1].(map[string]interface{})
+				assert.Contains(t, block["text"].(map[string]interface{})["text"], "<https://open.spotify.com/album/a1|First>")
+				assert.Equal(t, "https://i.scdn.co/image/a1", block["accessory"].(map[string]interface{})["image_url"])
+			},
+		},
+		{
+			format: webhookDiscord,
+			check: func(t *testing.T, payload map[string]interface{}) {
+				assert.Equal(t, "hello", payload["content"])
+				embeds := payload["embeds"].([]interface{})
+				require.Len(t, embeds, 1)
+				embed := embeds[0].(map[string]interface{})
+				assert.Equal(t, "First", embed["title"])
+				assert.Equal(t, "https://open.spotify.com/album/a1", embed["url"])
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.format), func(t *testing.T) {
+			var requests int
+			var payload map[string]interface{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= tc.failures {
+					http.Error(w, "try again", http.StatusServiceUnavailable)
+					return
+				}
+
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				body, err := ioutil.ReadAll(r.Body)
+				assert.NoError(t, err)
+				assert.NoError(t, json.Unmarshal(body, &payload))
+			}))
+			defer server.Close()
+
+			notifier := newWebhookNotifier(tc.format)
+			notifier.retryDelay = time.Millisecond
+
+			require.NoError(t, notifier.notify(server.URL, dg, "hello"))
+			assert.Equal(t, tc.failures+1, requests)
+			tc.check(t, payload)
+		})
+	}
+}
+
+func TestWebhookNotifyGivesUp(t *testing.T) {
+	testCases := []struct {
+		name             string
+		status           int
+		expectedRequests int
+	}{
+		// Only errors that might go away are worth retrying.
+		{"bad request", http.StatusBadRequest, 1},
+		{"not found", http.StatusNotFound, 1},
+		{"too many requests", http.StatusTooManyRequests, 3},
+		{"service unavailable", http.StatusServiceUnavailable, 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				http.Error(w, "nope", tc.status)
+			}))
+			defer server.Close()
+
+			notifier := newWebhookNotifier(webhookGeneric)
+			notifier.maxTries = 2
+			notifier.retryDelay = time.Millisecond
+
+			retries := apiRetriesMetric.values()[""]
+			err := notifier.notify(server.URL, &digest{}, "hello")
+			assert.ErrorContains(t, err, fmt.Sprintf("HTTP %d", tc.status))
+			assert.Equal(t, tc.expectedRequests, requests)
+			// The webhook has nothing to do with Spotify.
+			assert.Equal(t, retries, apiRetriesMetric.values()[""])
+		})
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	testCases := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{"empty", "", nil},
+		{"fits", "a\nbc", []string{"a\nbc"}},
+		{"exactly fits", "12345", []string{"12345"}},
+		{"between lines", "one\ntwo\nthree", []string{"one\n", "two\n", "three"}},
+		{"keeps lines together", "a\nb\nc\nd", []string{"a\nb\n", "c\nd"}},
+		{"long line", "1234567890ab", []string{"12345", "67890", "ab"}},
+		{"long line after short one", "a\n1234567", []string{"a\n", "12345", "67"}},
+		{"counts characters", "éééééé", []string{"ééééé", "é"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, splitText(tc.text, 5))
+		})
+	}
+}
+
+func TestSlackPayloadSplitsLongMessages(t *testing.T) {
+	line := strings.Repeat("x", 99) + "\n"
+	message := strings.Repeat(line, 100)
+	releases := make([]digestRelease, maxSlackBlocks)
+
+	payload := slackPayload(&digest{Releases: releases}, message).(struct {
+		Text   string       `json:"text"`
+		Blocks []slackBlock `json:"blocks"`
+	})
+
+	assert.Equal(t, message, payload.Text)
+	require.Len(t, payload.Blocks, maxSlackBlocks)
+	var text strings.Builder
+	for _, block := range payload.Blocks[:4] {
+		assert.LessOrEqual(t, len(block.Text.Text), maxSlackText)
+		text.WriteString(block.Text.Text)
+	}
+	assert.Equal(t, message, text.String())
+	// The rest of the blocks are releases.
+	assert.Contains(t, payload.Blocks[4].Text.Text, "released")
+}
+
+func TestDiscordPayloadTruncatesContent(t *testing.T) {
+	message := strings.Repeat("é", maxDiscordContent+10)
+	payload := discordPayload(&digest{}, message)
+
+	content := payload.(struct {
+		Content string         `json:"content"`
+		Embeds  []discordEmbed `json:"embeds"`
+	}).Content
+	assert.Len(t, []rune(content), maxDiscordContent)
+	assert.True(t, strings.HasSuffix(content, "…"))
+}
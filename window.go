@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// window is the range of time that releases need to have come out in to be
+// considered recent. It includes start, but not end.
+type window struct {
+	start time.Time
+	end   time.Time
+	// upToNow is set if the window ends at the present, in which case
+	// anything released after it is upcoming, rather than just out of the
+	// window.
+	upToNow bool
+}
+
+func (w window) String() string {
+	return fmt.Sprintf("[%v, %v)", w.start.Format(time.RFC3339), w.end.Format(time.RFC3339))
+}
+
+// window returns the window of releases for a run happening at now. This is
+// the last -duration, unless -since or -until say otherwise.
+func (cfg *config) window(now time.Time) window {
+	w := window{
+		end:     now,
+		upToNow: true,
+	}
+	// An -until in the future is the same as no -until at all, since there's
+	// nothing to listen to yet.
+	if !cfg.until.IsZero() && cfg.until.Before(now) {
+		w.end = cfg.until
+		w.upToNow = false
+	}
+
+	w.start = w.end.Add(-1 * cfg.duration)
+	if !cfg.since.IsZero() {
+		w.start = cfg.since
+	}
+
+	return w
+}
+
+// last returns the last moment in the window. This is what we show as its
+// end, since e.g. -until 2024-02 ends the window at the very start of March.
+func (w window) last() time.Time {
+	return w.end.Add(-time.Nanosecond)
+}
+
+// parseWindowFlags parses -since and -until, either of which may be empty,
+// into the start and end of the window they describe.
+func parseWindowFlags(sinceStr string, untilStr string, now time.Time) (time.Time, time.Time, error) {
+	var since, until time.Time
+	var err error
+	if sinceStr != "" {
+		since, _, err = parseDatePeriod(sinceStr, now)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid -since: %w", err)
+		}
+		// The window never ends later than now, so it'd be empty.
+		if !since.Before(now) {
+			return time.Time{}, time.Time{}, fmt.Errorf("-since (%v) must be in the past", since)
+		}
+	}
+	if untilStr != "" {
+		_, until, err = parseDatePeriod(untilStr, now)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid -until: %w", err)
+		}
+	}
+	if !since.IsZero() && !until.IsZero() && !since.Before(until) {
+		return time.Time{}, time.Time{}, fmt.Errorf("-since (%v) must be before -until (%v)", since, until)
+	}
+
+	return since, until, nil
+}
+
+var quarterRegexp = regexp.MustCompile(`^(\d{4})-[Qq]([1-4])$`)
+
+// parseDatePeriod parses a -since or -until, returning the period of time it
+// refers to. This is either a named period relative to now (e.g. last-month),
+// a year (2024), a quarter (2024-Q3), a month (2024-07), a day (2024-07-01) or
+// an RFC 3339 timestamp, in which case the period starts and ends there.
+func parseDatePeriod(s string, now time.Time) (time.Time, time.Time, error) {
+	// Spotify's release dates don't have time zones, and ReleaseDateTime
+	// treats them as UTC, so we do the same for the dates here.
+	loc := time.UTC
+	now = now.In(loc)
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	thisYear := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, loc)
+
+	switch strings.ToLower(s) {
+	case "this-month":
+		return thisMonth, thisMonth.AddDate(0, 1, 0), nil
+	case "last-month":
+		return thisMonth.AddDate(0, -1, 0), thisMonth, nil
+	case "this-year":
+		return thisYear, thisYear.AddDate(1, 0, 0), nil
+	case "last-year":
+		return thisYear.AddDate(-1, 0, 0), thisYear, nil
+	}
+
+	if matches := quarterRegexp.FindStringSubmatch(s); matches != nil {
+		// These can't fail, thanks to the regexp.
+		year, _ := strconv.Atoi(matches[1])
+		quarter, _ := strconv.Atoi(matches[2])
+		start := time.Date(year, time.Month(3*(quarter-1)+1), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 3, 0), nil
+	}
+
+	periods := []struct {
+		layout string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006", 1, 0, 0},
+		{"2006-01", 0, 1, 0},
+		{"2006-01-02", 0, 0, 1},
+	}
+	for _, period := range periods {
+		if start, err := time.ParseInLocation(period.layout, s, loc); err == nil {
+			return start, start.AddDate(period.years, period.months, period.days), nil
+		}
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, t, nil
+	}
+
+	return time.Time{}, time.Time{}, fmt.Errorf(
+		"unknown date %q, expected one of this-month, last-month, this-year, last-year, "+
+			"a year (2024), a quarter (2024-Q3), a month (2024-07), a day (2024-07-01) or an RFC 3339 timestamp",
+		s,
+	)
+}
+
+func (w window) contains(t time.Time) bool {
+	return !t.Before(w.start) && t.Before(w.end)
+}
+
+// precisionPolicy decides what to do with releases that Spotify only knows the
+// year or month of, when we can't tell whether they came out in the window.
+type precisionPolicy string
+
+const (
+	// precisionInclude includes a release if any part of its year or month is
+	// in the window. Since consecutive windows may each cover part of the
+	// same year or month, the release can turn up in several of them.
+	precisionInclude precisionPolicy = "include"
+	// precisionExclude only includes a release if all of its year or month is
+	// in the window.
+	precisionExclude precisionPolicy = "exclude"
+	// precisionEnd pretends that a release came out on the last day of its
+	// year or month. This puts it in exactly one of a run of consecutive
+	// windows, which is why it's the default.
+	precisionEnd precisionPolicy = "end"
+)
+
+func parsePrecisionPolicy(s string) (precisionPolicy, error) {
+	switch policy := precisionPolicy(s); policy {
+	case precisionInclude, precisionExclude, precisionEnd:
+		return policy, nil
+	default:
+		return "", fmt.Errorf(
+			"unknown imprecise date policy %q, expected one of: %s, %s, %s",
+			s, precisionInclude, precisionExclude, precisionEnd,
+		)
+	}
+}
+
+// releasePlacement is where a release falls relative to a window.
+type releasePlacement int
+
+const (
+	releasedBefore releasePlacement = iota
+	releasedWithin
+	// releasedAfter means the release is upcoming, at least as far as the
+	// window is concerned.
+	releasedAfter
+	// releasedLater means the policy put an imprecise release after the
+	// window, even though it may well be out already, so it isn't upcoming
+	// either. A later window may pick it up.
+	releasedLater
+)
+
+// releasePeriod returns the period of time that the album could have been
+// released in, according to the precision of its release date. The end is not
+// included in the period.
+func releasePeriod(album spotify.SimpleAlbum) (time.Time, time.Time) {
+	// ReleaseDateTime gives us the start of the year or month for imprecise
+	// release dates.
+	start := album.ReleaseDateTime()
+	switch album.ReleaseDatePrecision {
+	case "year":
+		return start, start.AddDate(1, 0, 0)
+	case "month":
+		return start, start.AddDate(0, 1, 0)
+	default:
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// placeRelease figures out where the album's release falls relative to w. It
+// also reports whether the answer came down to the policy, i.e. whether the
+// album's release date was too imprecise to tell.
+func placeRelease(album spotify.SimpleAlbum, w window, policy precisionPolicy) (releasePlacement, bool) {
+	placeTime := func(t time.Time) releasePlacement {
+		switch {
+		case t.Before(w.start):
+			return releasedBefore
+		case w.contains(t):
+			return releasedWithin
+		default:
+			return releasedAfter
+		}
+	}
+
+	periodStart, periodEnd := releasePeriod(album)
+	if album.ReleaseDatePrecision != "year" && album.ReleaseDatePrecision != "month" {
+		return placeTime(periodStart), false
+	}
+
+	// Note that periodEnd is not part of the period, while w.end is not part
+	// of the window.
+	switch {
+	case !periodEnd.After(w.start):
+		return releasedBefore, false
+	case !periodStart.Before(w.end):
+		return releasedAfter, false
+	case !periodStart.Before(w.start) && !periodEnd.After(w.end):
+		return releasedWithin, false
+	}
+
+	// The period straddles (at least) one end of the window, so we really
+	// don't know.
+	switch policy {
+	case precisionExclude:
+		if periodStart.Before(w.start) {
+			return releasedBefore, true
+		}
+		return releasedLater, true
+	case precisionEnd:
+		if placement := placeTime(periodEnd.AddDate(0, 0, -1)); placement != releasedAfter {
+			return placement, true
+		}
+		return releasedLater, true
+	default:
+		return releasedWithin, true
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify"
+)
+
+func TestPlaceRelease(t *testing.T) {
+	// The window is the first half of 2024.
+	w := window{
+		start: time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC),
+		end:   time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC),
+	}
+
+	testCases := []struct {
+		name        string
+		releaseDate string
+		precision   string
+		policy      precisionPolicy
+		expected    releasePlacement
+		imprecise   bool
+	}{
+		{"day before", "2024-01-14", "day", precisionInclude, releasedBefore, false},
+		{"day within", "2024-01-15", "day", precisionInclude, releasedWithin, false},
+		{"day after", "2024-06-15", "day", precisionInclude, releasedAfter, false},
+		{"month within", "2024-03", "month", precisionExclude, releasedWithin, false},
+		{"month before", "2023-12", "month", precisionInclude, releasedBefore, false},
+		{"month after", "2024-07", "month", precisionInclude, releasedAfter, false},
+		// January 2024 straddles the start of the window.
+		{"month straddling start, include", "2024-01", "month", precisionInclude, releasedWithin, true},
+		{"month straddling start, exclude", "2024-01", "month", precisionExclude, releasedBefore, true},
+		{"month straddling start, end", "2024-01", "month", precisionEnd, releasedWithin, true},
+		// June 2024 straddles the end of the window.
+		{"month straddling end, include", "2024-06", "month", precisionInclude, releasedWithin, true},
+		{"month straddling end, exclude", "2024-06", "month", precisionExclude, releasedLater, true},
+		{"month straddling end, end", "2024-06", "month", precisionEnd, releasedLater, true},
+		// 2024 straddles both ends of the window.
+		{"year straddling, include", "2024", "year", precisionInclude, releasedWithin, true},
+		{"year straddling, exclude", "2024", "year", precisionExclude, releasedBefore, true},
+		{"year straddling, end", "2024", "year", precisionEnd, releasedLater, true},
+		{"year before", "2023", "year", precisionInclude, releasedBefore, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			album := spotify.SimpleAlbum{
+				ReleaseDate:          tc.releaseDate,
+				ReleaseDatePrecision: tc.precision,
+			}
+
+			placement, imprecise := placeRelease(album, w, tc.policy)
+			assert.Equal(t, tc.expected, placement)
+			assert.Equal(t, tc.imprecise, imprecise)
+		})
+	}
+}
+
+func TestPlaceReleaseInConsecutiveWindows(t *testing.T) {
+	// Monthly runs through 2024, each covering the month before.
+	album := spotify.SimpleAlbum{ReleaseDate: "2024", ReleaseDatePrecision: "year"}
+	testCases := []struct {
+		policy         precisionPolicy
+		expectedWithin int
+	}{
+		{precisionEnd, 1},
+		{precisionExclude, 0},
+		// This is what makes include a poor default.
+		{precisionInclude, 12},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			within := 0
+			for month := time.February; month <= time.December+1; month++ {
+				end := time.Date(2024, month, 1, 0, 0, 0, 0, time.UTC)
+				w := window{start: end.AddDate(0, -1, 0), end: end, upToNow: true}
+				placement, _ := placeRelease(album, w, tc.policy)
+				assert.NotEqual(t, releasedAfter, placement, "the release isn't upcoming")
+				if placement == releasedWithin {
+					within++
+				}
+			}
+			assert.Equal(t, tc.expectedWithin, within)
+		})
+	}
+}
+
+func TestParseDatePeriod(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		input string
+		start time.Time
+		end   time.Time
+	}{
+		{"this-month", date(2024, 3, 1), date(2024, 4, 1)},
+		{"last-month", date(2024, 2, 1), date(2024, 3, 1)},
+		{"this-year", date(2024, 1, 1), date(2025, 1, 1)},
+		{"last-year", date(2023, 1, 1), date(2024, 1, 1)},
+		{"2023", date(2023, 1, 1), date(2024, 1, 1)},
+		{"2023-Q4", date(2023, 10, 1), date(2024, 1, 1)},
+		{"2023-q1", date(2023, 1, 1), date(2023, 4, 1)},
+		{"2023-02", date(2023, 2, 1), date(2023, 3, 1)},
+		{"2023-02-28", date(2023, 2, 28), date(2023, 3, 1)},
+		{"2023-02-28T10:00:00Z", time.Date(2023, 2, 28, 10, 0, 0, 0, time.UTC), time.Date(2023, 2, 28, 10, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			start, end, err := parseDatePeriod(tc.input, now)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.start, start)
+			assert.Equal(t, tc.end, end)
+		})
+	}
+
+	for _, input := range []string{"", "yesterday", "2024-Q5", "24-03"} {
+		_, _, err := parseDatePeriod(input, now)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestConfigWindow(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	april := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	february := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		cfg      config
+		expected window
+	}{
+		{
+			name:     "duration",
+			cfg:      config{duration: 24 * time.Hour},
+			expected: window{start: now.Add(-24 * time.Hour), end: now, upToNow: true},
+		},
+		{
+			name:     "since",
+			cfg:      config{duration: 24 * time.Hour, since: march},
+			expected: window{start: march, end: now, upToNow: true},
+		},
+		{
+			name:     "until in the past",
+			cfg:      config{duration: 24 * time.Hour, until: march},
+			expected: window{start: march.Add(-24 * time.Hour), end: march},
+		},
+		{
+			name:     "until in the future",
+			cfg:      config{duration: 24 * time.Hour, since: march, until: april},
+			expected: window{start: march, end: now, upToNow: true},
+		},
+		{
+			name:     "backfill",
+			cfg:      config{duration: 24 * time.Hour, since: february, until: march},
+			expected: window{start: february, end: march},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.cfg.window(now))
+		})
+	}
+}
+
+func TestParseWindowFlags(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		name     string
+		since    string
+		until    string
+		start    time.Time
+		end      time.Time
+		errorMsg string
+	}{
+		{name: "neither"},
+		{name: "since", since: "2024-02", start: date(2024, 2, 1)},
+		{name: "until", until: "2024-02", end: date(2024, 3, 1)},
+		{name: "both", since: "2024-02", until: "2024-02", start: date(2024, 2, 1), end: date(2024, 3, 1)},
+		{name: "since this month", since: "this-month", start: date(2024, 3, 1)},
+		{name: "since in the future", since: "2024-04", errorMsg: "-since (2024-04-01 00:00:00 +0000 UTC) must be in the past"},
+		{name: "since next year", since: "2025", until: "2025", errorMsg: "must be in the past"},
+		{name: "inverted", since: "2024-02", until: "2024-01", errorMsg: "must be before -until"},
+		{name: "bad since", since: "soon", errorMsg: "invalid -since"},
+		{name: "bad until", until: "later", errorMsg: "invalid -until"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end, err := parseWindowFlags(tc.since, tc.until, now)
+			if tc.errorMsg != "" {
+				assert.ErrorContains(t, err, tc.errorMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.start, start)
+			assert.Equal(t, tc.end, end)
+		})
+	}
+}
+
+func TestWindowLastIsInclusive(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	nameTemplate, err := parsePlaylistTemplate("name", defaultNameTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		since    string
+		until    string
+		expected string
+	}{
+		{"2024-02", "2024-02", "fangirl (Feb  1, 2024 - Feb 29, 2024)"},
+		{"2023", "2023", "fangirl (Jan  1, 2023 - Dec 31, 2023)"},
+		{"2024-02-10", "", "fangirl (Feb 10, 2024 - Mar 15, 2024)"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.since+" "+tc.until, func(t *testing.T) {
+			since, until, err := parseWindowFlags(tc.since, tc.until, now)
+			assert.NoError(t, err)
+			cfg := config{since: since, until: until}
+			w := cfg.window(now)
+
+			name, err := executePlaylistTemplate(nameTemplate, playlistTemplateData{Name: "fangirl", Start: w.start, End: w.last()})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, name)
+		})
+	}
+}